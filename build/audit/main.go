@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"vivian.infra/internal/pkg/audit"
+)
+
+// audit walks the hash chain of an audit log, keyed with VIVIAN_AUDIT_KEY if
+// it is set, and exits non-zero at the first entry that has been edited,
+// reordered or removed. Checkpoints taken from the server log also catch
+// entries cut off the end, and recomputed chains.
+func main() {
+	var checkpoints []audit.Checkpoint
+	flag.Func("checkpoint", "sequence:hash the log must still contain (repeatable)", func(value string) error {
+		checkpoint, err := audit.ParseCheckpoint(value)
+		if err == nil {
+			checkpoints = append(checkpoints, checkpoint)
+		}
+		return err
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %v [-checkpoint sequence:hash]... [audit log]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	path := flag.Arg(0)
+	if len(path) <= 0 {
+		path = os.Getenv("VIVIAN_AUDIT_LOG")
+	}
+	if len(path) <= 0 {
+		path = "logs/audit.log"
+	}
+
+	last, err := audit.VerifyFile(path, []byte(os.Getenv("VIVIAN_AUDIT_KEY")), checkpoints...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if last == nil {
+		fmt.Printf("%v: empty\n", path)
+		return
+	}
+	fmt.Printf("%v: %d entries verified, %d checkpoints matched, head %v (%v)\n", path, last.Sequence, len(checkpoints), audit.Checkpoint{Sequence: last.Sequence, Hash: last.Hash}, last.Time.Format("2006-01-02 15:04:05"))
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"vivian.infra/models"
+)
+
+const ACCOUNT_FILE_MODE os.FileMode = 0o600
+
+// accountFile is the on-disk form of an AccountStore.
+type accountFile struct {
+	Accounts   []models.Account `json:"accounts"`
+	Identities []linkedIdentity `json:"identities"`
+}
+
+type linkedIdentity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	Alias   string `json:"alias"`
+}
+
+// OpenAccountStore returns an AccountStore that is written through to path
+// after every change, so registrations, password changes and rehashes, and
+// linked identities survive a restart. The file is replaced by rename, so a
+// crash mid-write leaves the previous contents intact. A missing file is
+// created on the first change.
+func OpenAccountStore(path string) (*AccountStore, error) {
+	store := NewAccountStore()
+
+	bytes, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var contents accountFile
+		if err := json.Unmarshal(bytes, &contents); err != nil {
+			return nil, err
+		}
+		for _, account := range contents.Accounts {
+			store.store(account)
+		}
+		for _, linked := range contents.Identities {
+			store.identities[identity{issuer: linked.Issuer, subject: linked.Subject}] = models.NormalizeAlias(linked.Alias)
+		}
+	}
+
+	store.path = path
+	return store, nil
+}
+
+// save writes the store to its file, if it has one. It must be called with
+// the store locked.
+func (a *AccountStore) save() error {
+	if len(a.path) <= 0 {
+		return nil
+	}
+
+	var contents accountFile
+	for _, account := range a.accounts {
+		contents.Accounts = append(contents.Accounts, account)
+	}
+	sort.Slice(contents.Accounts, func(i, j int) bool {
+		return contents.Accounts[i].ID < contents.Accounts[j].ID
+	})
+	for key, alias := range a.identities {
+		contents.Identities = append(contents.Identities, linkedIdentity{Issuer: key.issuer, Subject: key.subject, Alias: alias})
+	}
+	sort.Slice(contents.Identities, func(i, j int) bool {
+		if contents.Identities[i].Issuer != contents.Identities[j].Issuer {
+			return contents.Identities[i].Issuer < contents.Identities[j].Issuer
+		}
+		return contents.Identities[i].Subject < contents.Identities[j].Subject
+	})
+
+	bytes, err := json.MarshalIndent(contents, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if err := temp.Chmod(ACCOUNT_FILE_MODE); err != nil {
+		temp.Close()
+		return err
+	}
+	if _, err := temp.Write(bytes); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), a.path)
+}
@@ -0,0 +1,190 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vivian.infra/models"
+)
+
+func TestAccountStoreWritesThrough(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	store, err := OpenAccountStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	created, err := store.CreateAccount(models.Account{Alias: "bella", Email: "b@x.io", Password: "old", Status: models.ACCOUNT_STATUS_PENDING})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := store.ActivateAccount("bella"); err != nil {
+		t.Fatalf("activate: %v", err)
+	}
+	if err := store.UpdatePassword("bella", "rehashed"); err != nil {
+		t.Fatalf("update password: %v", err)
+	}
+	if err := store.SetTwoFactor("bella", true); err != nil {
+		t.Fatalf("set two factor: %v", err)
+	}
+	if err := store.LinkIdentity("https://idp.test", "1234", "bella"); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+
+	reopened, err := OpenAccountStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	account, err := reopened.FetchAccount("bella")
+	if err != nil {
+		t.Fatalf("fetch after reopen: %v", err)
+	}
+	if account.ID != created.ID || account.Password != "rehashed" || !account.Active() || !account.TwoFactorEnabled {
+		t.Errorf("account after reopen = %+v", account)
+	}
+	if linked, err := reopened.FetchLinkedAccount("https://idp.test", "1234"); err != nil || linked.Alias != "bella" {
+		t.Errorf("linked identity after reopen = %v, %v", linked.Alias, err)
+	}
+	next, err := reopened.CreateAccount(models.Account{Alias: "ethan"})
+	if err != nil || next.ID == created.ID {
+		t.Errorf("new account after reopen = %+v, %v, want a fresh ID", next, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Mode().Perm() != ACCOUNT_FILE_MODE {
+		t.Errorf("file mode = %v, want %v", info.Mode().Perm(), ACCOUNT_FILE_MODE)
+	}
+}
+
+func TestLoadAccountsKeepsStoredAccounts(t *testing.T) {
+	dir := t.TempDir()
+	seed := filepath.Join(dir, "seed.json")
+	bytes, err := json.Marshal([]models.Account{{Alias: "bella", Password: "seeded"}, {Alias: "ethan", Password: "seeded"}})
+	if err != nil {
+		t.Fatalf("marshal seed: %v", err)
+	}
+	if err := os.WriteFile(seed, bytes, 0o600); err != nil {
+		t.Fatalf("write seed: %v", err)
+	}
+
+	path := filepath.Join(dir, "accounts.json")
+	store, err := OpenAccountStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := store.LoadAccounts(seed); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if err := store.UpdatePassword("bella", "changed"); err != nil {
+		t.Fatalf("update password: %v", err)
+	}
+
+	reopened, err := OpenAccountStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if err := reopened.LoadAccounts(seed); err != nil {
+		t.Fatalf("seed again: %v", err)
+	}
+	if account, _ := reopened.FetchAccount("bella"); account.Password != "changed" {
+		t.Errorf("seeding undid a password change: %q", account.Password)
+	}
+}
+
+func TestPrunePendingAccounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	store, err := OpenAccountStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	past := time.Now().Add(-48 * time.Hour)
+	for _, account := range []models.Account{
+		{Alias: "stale", Email: "s@x.io", Status: models.ACCOUNT_STATUS_PENDING, CreatedAt: past},
+		{Alias: "fresh", Email: "f@x.io", Status: models.ACCOUNT_STATUS_PENDING},
+		{Alias: "bella", Email: "b@x.io", Status: models.ACCOUNT_STATUS_ACTIVE, CreatedAt: past},
+	} {
+		if _, err := store.CreateAccount(account); err != nil {
+			t.Fatalf("create %v: %v", account.Alias, err)
+		}
+	}
+	if err := store.LinkIdentity("https://idp.test", "1234", "stale"); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+
+	pruned, err := store.PrunePendingAccounts(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if len(pruned) != 1 || pruned[0] != "stale" {
+		t.Errorf("pruned %v, want [stale]", pruned)
+	}
+
+	reopened, err := OpenAccountStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if _, err := reopened.FetchAccount("stale"); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("stale account after prune = %v, want ErrAccountNotFound", err)
+	}
+	if _, err := reopened.FetchLinkedAccount("https://idp.test", "1234"); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("identity of pruned account = %v, want ErrAccountNotFound", err)
+	}
+	for _, alias := range []string{"fresh", "bella"} {
+		if _, err := reopened.FetchAccount(alias); err != nil {
+			t.Errorf("fetch %v after prune: %v", alias, err)
+		}
+	}
+	if _, err := reopened.CreateAccount(models.Account{Alias: "stale", Email: "s@x.io"}); err != nil {
+		t.Errorf("registering a pruned alias again = %v", err)
+	}
+}
+
+func TestAliasesIgnoreCase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	store, err := OpenAccountStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	created, err := store.CreateAccount(models.Account{Alias: "Bella", Email: "b@x.io"})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if created.Alias != "bella" {
+		t.Errorf("created alias = %q, want bella", created.Alias)
+	}
+	if _, err := store.CreateAccount(models.Account{Alias: "BELLA", Email: "other@x.io"}); !errors.Is(err, ErrAliasTaken) {
+		t.Errorf("create differing in case = %v, want ErrAliasTaken", err)
+	}
+	if err := store.ActivateAccount("bElLa"); err != nil {
+		t.Fatalf("activate: %v", err)
+	}
+	if err := store.LinkIdentity("https://idp.test", "1234", "BELLA"); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	if err := store.LinkIdentity("https://idp.test", "1234", "bella"); err != nil {
+		t.Errorf("linking again differing in case = %v, want nil", err)
+	}
+
+	reopened, err := OpenAccountStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	for _, alias := range []string{"bella", "Bella", "BELLA"} {
+		account, err := reopened.FetchAccount(alias)
+		if err != nil || account.ID != created.ID || !account.Active() {
+			t.Errorf("fetch %v = %+v, %v", alias, account, err)
+		}
+	}
+	if linked, err := reopened.FetchLinkedAccount("https://idp.test", "1234"); err != nil || linked.ID != created.ID {
+		t.Errorf("linked identity = %+v, %v", linked, err)
+	}
+}
@@ -0,0 +1,283 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"vivian.infra/models"
+)
+
+var (
+	ErrAccountNotFound = errors.New("no account found for alias")
+	ErrIdentityLinked  = errors.New("external identity is already linked to another account")
+	ErrAliasTaken      = errors.New("alias is already taken")
+	ErrEmailTaken      = errors.New("email address is already registered")
+)
+
+// AccountStore keeps accounts in memory, keyed by alias, while the MySQL
+// backend in database.go is disabled. Aliases are stored and looked up in
+// the form models.NormalizeAlias gives them. Stores opened with OpenAccountStore
+// also write every change through to a file; a change that could not be
+// written is still kept in memory and its error returned.
+type AccountStore struct {
+	mu       sync.RWMutex
+	accounts map[string]models.Account
+	nextID   int
+	// identities maps an external issuer and subject to the alias they sign
+	// in as.
+	identities map[identity]string
+	path       string
+}
+
+type identity struct {
+	issuer  string
+	subject string
+}
+
+func NewAccountStore() *AccountStore {
+	return &AccountStore{accounts: make(map[string]models.Account), nextID: 1, identities: make(map[identity]string)}
+}
+
+// LoadAccounts seeds the store from a JSON array of accounts whose Password
+// fields already hold hashes. Aliases the store already holds are left as
+// they are, so seeding a persistent store does not undo later changes.
+func (a *AccountStore) LoadAccounts(path string) error {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var accounts []models.Account
+	if err := json.Unmarshal(bytes, &accounts); err != nil {
+		return err
+	}
+	if len(accounts) <= 0 {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, account := range accounts {
+		if len(account.Alias) <= 0 {
+			return errors.New("account has no alias")
+		}
+		if _, ok := a.accounts[models.NormalizeAlias(account.Alias)]; !ok {
+			a.store(account)
+		}
+	}
+	return a.save()
+}
+
+func (a *AccountStore) FetchAccount(alias string) (models.Account, error) {
+	alias = models.NormalizeAlias(alias)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	account, ok := a.accounts[alias]
+	if !ok {
+		return models.Account{}, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+// StoreAccount inserts or replaces the account under its alias, assigning an
+// ID to accounts that do not have one yet.
+func (a *AccountStore) StoreAccount(account models.Account) (models.Account, error) {
+	if len(account.Alias) <= 0 {
+		return models.Account{}, errors.New("account has no alias")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	account = a.store(account)
+	return account, a.save()
+}
+
+// store must be called with the store locked.
+func (a *AccountStore) store(account models.Account) models.Account {
+	account.Alias = models.NormalizeAlias(account.Alias)
+	if existing, ok := a.accounts[account.Alias]; ok && account.ID == 0 {
+		account.ID = existing.ID
+	}
+	if account.ID == 0 {
+		account.ID = a.nextID
+	}
+	if account.ID >= a.nextID {
+		a.nextID = account.ID + 1
+	}
+	a.accounts[account.Alias] = account
+	return account
+}
+
+// CreateAccount stores a new account, refusing aliases and email addresses
+// that are already in use.
+func (a *AccountStore) CreateAccount(account models.Account) (models.Account, error) {
+	if len(account.Alias) <= 0 {
+		return models.Account{}, errors.New("account has no alias")
+	}
+
+	account.Alias = models.NormalizeAlias(account.Alias)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.accounts[account.Alias]; ok {
+		return models.Account{}, ErrAliasTaken
+	}
+	for _, existing := range a.accounts {
+		if len(account.Email) > 0 && strings.EqualFold(existing.Email, account.Email) {
+			return models.Account{}, ErrEmailTaken
+		}
+	}
+	account.ID = 0
+	if account.CreatedAt.IsZero() {
+		account.CreatedAt = time.Now()
+	}
+	account = a.store(account)
+	return account, a.save()
+}
+
+// FetchAccountByEmail looks an account up by its address, ignoring case.
+func (a *AccountStore) FetchAccountByEmail(email string) (models.Account, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, account := range a.accounts {
+		if len(account.Email) > 0 && strings.EqualFold(account.Email, email) {
+			return account, nil
+		}
+	}
+	return models.Account{}, ErrAccountNotFound
+}
+
+// ActivateAccount marks the account of alias as verified.
+func (a *AccountStore) ActivateAccount(alias string) error {
+	alias = models.NormalizeAlias(alias)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	account, ok := a.accounts[alias]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	account.Status = models.ACCOUNT_STATUS_ACTIVE
+	a.accounts[alias] = account
+	return a.save()
+}
+
+// SetTwoFactor records whether logins to alias must pass a second factor.
+func (a *AccountStore) SetTwoFactor(alias string, enabled bool) error {
+	alias = models.NormalizeAlias(alias)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	account, ok := a.accounts[alias]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	account.TwoFactorEnabled = enabled
+	a.accounts[alias] = account
+	return a.save()
+}
+
+func (a *AccountStore) UpdatePassword(alias, hash string) error {
+	alias = models.NormalizeAlias(alias)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	account, ok := a.accounts[alias]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	account.Password = hash
+	a.accounts[alias] = account
+	return a.save()
+}
+
+// LinkIdentity lets the subject issued by an external provider sign in as
+// alias. A subject links to one alias only; linking it again to the same
+// alias is a no-op.
+func (a *AccountStore) LinkIdentity(issuer, subject, alias string) error {
+	alias = models.NormalizeAlias(alias)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.accounts[alias]; !ok {
+		return ErrAccountNotFound
+	}
+	key := identity{issuer: issuer, subject: subject}
+	if linked, ok := a.identities[key]; ok && linked != alias {
+		return ErrIdentityLinked
+	}
+	if linked, ok := a.identities[key]; ok && linked == alias {
+		return nil
+	}
+	a.identities[key] = alias
+	return a.save()
+}
+
+func (a *AccountStore) FetchLinkedAccount(issuer, subject string) (models.Account, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	alias, ok := a.identities[identity{issuer: issuer, subject: subject}]
+	if !ok {
+		return models.Account{}, ErrAccountNotFound
+	}
+	account, ok := a.accounts[alias]
+	if !ok {
+		return models.Account{}, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+// PrunePendingAccounts removes accounts still pending verification that
+// were created before cutoff, with any identities linked to them, freeing
+// their alias and address to register again. It returns the removed aliases.
+func (a *AccountStore) PrunePendingAccounts(cutoff time.Time) ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var pruned []string
+	for alias, account := range a.accounts {
+		if account.Active() || account.CreatedAt.After(cutoff) {
+			continue
+		}
+		delete(a.accounts, alias)
+		pruned = append(pruned, alias)
+	}
+	if len(pruned) <= 0 {
+		return nil, nil
+	}
+	for key, alias := range a.identities {
+		if _, ok := a.accounts[alias]; !ok {
+			delete(a.identities, key)
+		}
+	}
+	return pruned, a.save()
+}
+
+// ResetPassword replaces the password of alias and records when, so that
+// sessions established with the old password can be told apart. Resetting
+// through an emailed token also proves the address, activating the account.
+func (a *AccountStore) ResetPassword(alias, hash string) error {
+	alias = models.NormalizeAlias(alias)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	account, ok := a.accounts[alias]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	account.Password = hash
+	account.PasswordChangedAt = time.Now()
+	account.Status = models.ACCOUNT_STATUS_ACTIVE
+	a.accounts[alias] = account
+	return a.save()
+}
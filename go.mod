@@ -4,15 +4,16 @@ go 1.21.1
 
 require (
 	github.com/TwiN/go-color v1.4.1
+	github.com/aws/aws-sdk-go v1.50.21
 	github.com/google/uuid v1.5.0
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.1
 	golang.org/x/crypto v0.18.0
 )
 
 require (
-	github.com/aws/aws-sdk-go v1.50.21 // indirect
 	github.com/go-sql-driver/mysql v1.7.1 // indirect
-	github.com/gorilla/websocket v1.5.1 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
 )
@@ -2,13 +2,21 @@ package app
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
+	"vivian.infra/database"
+	"vivian.infra/internal/pkg/auth"
+	"vivian.infra/internal/pkg/oauth"
+	"vivian.infra/internal/pkg/rbac"
 	"vivian.infra/utils"
 )
 
@@ -16,6 +24,9 @@ const (
 	VIVIAN_APP_NAME          string        = "vivian.infra"
 	VIVIAN_HOST_ADDR         string        = ":8080"
 	VIVIAN_READWRITE_TIMEOUT time.Duration = time.Second * 10
+	// VIVIAN_STEP_UP_MAX_AGE is how recently a session must have passed a
+	// second factor for the routes wrapped in requireStepUp with it.
+	VIVIAN_STEP_UP_MAX_AGE time.Duration = 10 * time.Minute
 )
 
 type ServerInitialization interface {
@@ -34,6 +45,110 @@ type Server struct {
 
 var VivianServerLogger *utils.VivianLogger
 
+var (
+	vivianAuthenticator auth.LoginAuthenticator2FA
+	// vivianFactors are the factors an owner enrolls, by the name used in
+	// the 2FA actions.
+	vivianFactors  map[string]auth.Enroller2FA
+	vivianAttempts *auth.AttemptTracker
+)
+
+const (
+	FACTOR_TOTP     string = "totp"
+	FACTOR_HOTP     string = "hotp"
+	FACTOR_RECOVERY string = "recovery"
+)
+
+// initStateStore keeps 2FA challenges, enrollments, recovery codes and
+// lockouts in the file named by VIVIAN_2FA_STORE so that they survive a
+// restart, or in memory when it is not set. Sessions, refresh tokens, API
+// keys and one-time tokens are always kept in memory.
+func initStateStore() (auth.StateStore, error) {
+	path := os.Getenv("VIVIAN_2FA_STORE")
+	if len(path) <= 0 {
+		return auth.NewMemoryStateStore(), nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	store, err := auth.OpenFileStateStore(path)
+	if err != nil {
+		return nil, err
+	}
+	VivianServerLogger.LogDebug(fmt.Sprintf("2FA state is kept in %v", path))
+	return store, nil
+}
+
+// initAccountStore writes accounts through to the file named by
+// VIVIAN_ACCOUNTS_STORE so that registrations, password changes and linked
+// identities survive a restart, or keeps them in memory when it is not set.
+// VIVIAN_ACCOUNTS_FILE seeds either one.
+func initAccountStore() (*database.AccountStore, error) {
+	path := os.Getenv("VIVIAN_ACCOUNTS_STORE")
+	if len(path) <= 0 {
+		return database.NewAccountStore(), nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	store, err := database.OpenAccountStore(path)
+	if err != nil {
+		return nil, err
+	}
+	VivianServerLogger.LogDebug(fmt.Sprintf("accounts are kept in %v", path))
+	return store, nil
+}
+
+// initPasswordPolicy adjusts the default password policy from the
+// environment. A VIVIAN_BREACH_CORPUS without range files is an error rather
+// than a policy that lets every password through the breach check.
+func initPasswordPolicy() (auth.PasswordPolicy, error) {
+	policy := auth.CurrentPasswordPolicy()
+	if length, err := strconv.Atoi(os.Getenv("VIVIAN_PASSWORD_MIN_LENGTH")); err == nil {
+		policy.MinLength = length
+	}
+	if classes, err := strconv.Atoi(os.Getenv("VIVIAN_PASSWORD_MIN_CLASSES")); err == nil {
+		policy.MinClasses = classes
+	}
+	if strength, err := strconv.Atoi(os.Getenv("VIVIAN_PASSWORD_MIN_STRENGTH")); err == nil {
+		policy.MinStrength = strength
+	}
+	if similar, err := strconv.ParseBool(os.Getenv("VIVIAN_PASSWORD_REJECT_SIMILAR")); err == nil {
+		policy.RejectSimilar = similar
+	}
+	if directory := os.Getenv("VIVIAN_BREACH_CORPUS"); len(directory) > 0 {
+		corpus, err := auth.OpenBreachCorpus(directory)
+		if err != nil {
+			return policy, err
+		}
+		policy.Breaches = corpus
+	}
+	return policy, nil
+}
+
+// initAuthKeyGenerator builds the 2FA key generator from VIVIAN_2FA_ALPHABET,
+// VIVIAN_2FA_LENGTH and VIVIAN_2FA_GROUP, defaulting to the CHARSET and
+// AUTH_KEY_SIZE keys used so far.
+func initAuthKeyGenerator() (*auth.CodeGenerator, error) {
+	alphabet := auth.CHARSET
+	if name := os.Getenv("VIVIAN_2FA_ALPHABET"); len(name) > 0 {
+		named, ok := auth.CODE_ALPHABETS[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown 2FA alphabet %q", name)
+		}
+		alphabet = named
+	}
+	length := auth.AUTH_KEY_SIZE
+	if size, err := strconv.Atoi(os.Getenv("VIVIAN_2FA_LENGTH")); err == nil {
+		length = size
+	}
+	group := 0
+	if size, err := strconv.Atoi(os.Getenv("VIVIAN_2FA_GROUP")); err == nil {
+		group = size
+	}
+	return auth.NewCodeGenerator(alphabet, length, group)
+}
+
 func Deploy(ctx context.Context) error {
 	router := mux.NewRouter()
 
@@ -47,10 +162,154 @@ func Deploy(ctx context.Context) error {
 	VivianServerLogger = vivianServer.Logger
 	vivianServer.Logger.Deploy(false)
 
+	auditLog, err := initAudit(vivianServer.Logger.DeploymentID)
+	if err != nil {
+		vivianServer.Logger.LogError("unable to open audit log", err)
+		return err
+	}
+	vivianAudit = auditLog
+	defer vivianAudit.Close()
+
+	if hasher, ok := auth.Hashers()[os.Getenv("VIVIAN_PASSWORD_HASHER")]; ok {
+		auth.SetPreferredHasher(hasher)
+	}
+	if key := os.Getenv("VIVIAN_SECRET_KEY"); len(key) > 0 {
+		if err := auth.SetSecretKey([]byte(key)); err != nil {
+			vivianServer.Logger.LogError("invalid secret key", err)
+			return err
+		}
+	} else if len(os.Getenv("VIVIAN_2FA_STORE")) > 0 {
+		//the 2FA store outlives the random key that would be used instead,
+		//and the keys hashed in it would stop verifying after a restart.
+		err := errors.New("VIVIAN_SECRET_KEY must be set when VIVIAN_2FA_STORE is")
+		vivianServer.Logger.LogError("no secret key configured", err)
+		return err
+	} else {
+		vivianServer.Logger.LogWarning("no secret key configured, 2FA keys and client secrets are hashed under a key that lasts until a restart")
+	}
+	policy, err := initPasswordPolicy()
+	if err != nil {
+		vivianServer.Logger.LogError("unable to open breach corpus", err)
+		return err
+	}
+	auth.SetPasswordPolicy(policy)
+	state, err := initStateStore()
+	if err != nil {
+		vivianServer.Logger.LogError("unable to open 2FA store", err)
+		return err
+	}
+	authKeyTTL, _ := time.ParseDuration(os.Getenv("VIVIAN_2FA_TTL"))
+	challenges := auth.NewChallengeAuthenticator(state, authKeyTTL)
+	vivianAuthenticator = challenges
+	vivianAttempts = auth.NewAttemptTracker(state)
+	if generator, err := initAuthKeyGenerator(); err != nil {
+		vivianServer.Logger.LogError("invalid 2FA key configuration, keeping the default", err)
+	} else {
+		auth.SetAuthKeyGenerator(generator)
+	}
+	vivianServer.Logger.LogDebug(fmt.Sprintf("2FA keys are %v", auth.AuthKeyGenerator()))
+	totpSkew := auth.TOTP_DEFAULT_SKEW
+	if skew, err := strconv.ParseUint(os.Getenv("VIVIAN_TOTP_SKEW"), 10, 8); err == nil {
+		totpSkew = uint(skew)
+	}
+	hotpLookAhead := auth.HOTP_DEFAULT_LOOK_AHEAD
+	if lookAhead, err := strconv.ParseUint(os.Getenv("VIVIAN_HOTP_LOOK_AHEAD"), 10, 8); err == nil {
+		hotpLookAhead = uint(lookAhead)
+	}
+	vivianFactors = map[string]auth.Enroller2FA{
+		FACTOR_TOTP:     auth.NewTOTPAuthenticator(state, totpSkew),
+		FACTOR_HOTP:     auth.NewHOTPAuthenticator(state, hotpLookAhead),
+		FACTOR_RECOVERY: auth.NewRecoveryAuthenticator(state),
+	}
+	vivianNotifiers = initNotifiers()
+
+	tokens, err := initTokens()
+	if err != nil {
+		vivianServer.Logger.LogError("unable to initialise access tokens", err)
+		return err
+	}
+	vivianTokens = tokens
+	go vivianTokens.KeyRing().RunRotation(ctx, VivianServerLogger)
+
+	vivianOAuth = oauth.NewServer(vivianTokens)
+	go vivianOAuth.RunPruner(ctx, auth.AUTH_REAPER_INTERVAL)
+
+	resetAddressLimiter = NewLimiter(RESET_LIMITER_ADDRESS_SIZE, BUCKET_LIMITER_LEAK_AMT, RESET_LIMITER_LEAK_RATE)
+	resetIPLimiter = NewLimiter(RESET_LIMITER_IP_SIZE, BUCKET_LIMITER_LEAK_AMT, RESET_LIMITER_LEAK_RATE)
+
+	magicLinks, err := initMagicLinks()
+	if err != nil {
+		vivianServer.Logger.LogError("unable to initialise login links", err)
+		return err
+	}
+	vivianMagicLinks = magicLinks
+	if vivianMagicLinks != nil {
+		go vivianMagicLinks.RunPruner(ctx, auth.AUTH_REAPER_INTERVAL)
+		magicLinkLimiter = NewLimiter(MAGIC_LINK_LIMITER_SIZE, BUCKET_LIMITER_LEAK_AMT, MAGIC_LINK_LIMITER_LEAK_RATE)
+	}
+
+	vivianOIDC = initOIDC()
+	if vivianOIDC != nil {
+		go vivianOIDC.RunPruner(ctx, auth.AUTH_REAPER_INTERVAL)
+	}
+
+	accounts, err := initAccountStore()
+	if err != nil {
+		vivianServer.Logger.LogError("unable to open account store", err)
+		return err
+	}
+	VivianDatabase = accounts
+	if path := os.Getenv("VIVIAN_ACCOUNTS_FILE"); len(path) > 0 {
+		if err := VivianDatabase.LoadAccounts(path); err != nil {
+			VivianServerLogger.LogError("unable to load accounts", err)
+		}
+	}
+
+	go auth.Reap2FA(ctx, auth.AUTH_REAPER_INTERVAL, challenges, vivianAttempts, VivianServerLogger)
+	go reapPendingAccounts(ctx, auth.AUTH_REAPER_INTERVAL)
+
 	//router.Handle("/{alias}/fetch", fetchUserAccount(ctx)).Methods("GET")
-	router.Handle("/{alias}/2FA", authentication2FA(ctx)).Methods("GET")
+	//each 2FA action is routed on its query with the guards it needs; the
+	//handler refuses any action its route was not registered for.
+	router.Handle("/{alias}/2FA", audited("2fa", requireScope(auth.API_SCOPE_2FA_GENERATE, authorize(requireOwner(authentication2FA(ctx, "generate")))))).Methods("GET").Queries("action", "generate")
+	for _, action := range []string{"totp-enroll", "hotp-enroll", "recovery-generate", "totp-remove", "hotp-remove", "recovery-remove", "expire"} {
+		router.Handle("/{alias}/2FA", audited("2fa", requireAuthentication(authorize(requireOwner(requireStepUp(VIVIAN_STEP_UP_MAX_AGE, authentication2FA(ctx, action))))))).Methods("GET").Queries("action", action)
+	}
+	for _, action := range []string{"totp-confirm", "hotp-confirm", "hotp-resync"} {
+		router.Handle("/{alias}/2FA", audited("2fa", requireAuthentication(authorize(requireOwner(authentication2FA(ctx, action)))))).Methods("GET").Queries("action", action)
+	}
+	//the verify actions complete a login and answer only with its pending
+	//token, so they are the only ones reachable without a session.
+	router.Handle("/{alias}/2FA", audited("2fa", authentication2FA(ctx, "verify", "totp-verify", "hotp-verify", "recover"))).Methods("GET")
+	router.Handle("/{alias}/login", audited("login", loginAccount(ctx))).Methods("POST")
+	router.Handle("/accounts", audited("account.register", registerAccount(ctx))).Methods("POST")
+	router.Handle("/accounts/verify", audited("account.verify", verifyAccountEmail())).Methods("GET")
+	router.Handle("/accounts/reset", audited("password.reset_request", requestPasswordReset(ctx))).Methods("POST")
+	router.Handle("/accounts/reset/confirm", audited("password.reset", confirmPasswordReset(ctx))).Methods("POST")
+	router.Handle("/token/refresh", audited("token.refresh", refreshAccessToken())).Methods("POST")
+	router.Handle("/clients", audited("oauth.client_register", requireAuthentication(authorize(registerOAuthClient())))).Methods("POST")
+	router.Handle("/authorize", audited("oauth.authorize", browserSession(requireAuthentication(authorize(authorizeOAuth()))))).Methods("GET", "POST")
+	router.Handle("/token", audited("oauth.token", exchangeOAuthToken())).Methods("POST")
+	if vivianOIDC != nil {
+		router.Handle("/oidc/login", beginOIDCLogin()).Methods("GET")
+		router.Handle("/oidc/link", audited("oidc.link", requireAuthentication(authorize(requireStepUp(VIVIAN_STEP_UP_MAX_AGE, beginOIDCLink()))))).Methods("GET")
+		router.Handle("/oidc/callback", audited("oidc.callback", completeOIDCLogin())).Methods("GET")
+	}
+	if vivianMagicLinks != nil {
+		router.Handle("/{alias}/login/link", audited("login.link_request", requestMagicLink(ctx))).Methods("POST")
+		router.Handle(VIVIAN_MAGIC_LINK_PATH, audited("login.link", redeemMagicLink())).Methods("GET")
+	}
+	router.Handle("/.well-known/jwks.json", fetchJWKS()).Methods("GET")
 	router.Handle("/sockettime", HandleWebSocketTimestamp(ctx))
-	router.Handle("/{alias}/bucket/fetch", fetchBucketContents()).Methods("GET")
+	router.Handle("/socketcalls", requireAuthentication(authorize(SocketCalls(ctx)))).Methods("GET")
+	router.Handle("/{alias}/keys", audited("apikey.create", requireAuthentication(authorize(requireOwner(requireStepUp(VIVIAN_STEP_UP_MAX_AGE, createAPIKey())))))).Methods("POST")
+	router.Handle("/{alias}/keys", requireAuthentication(authorize(requireOwner(listAPIKeys())))).Methods("GET")
+	router.Handle("/{alias}/keys/{id}", audited("apikey.revoke", requireAuthentication(authorize(requireOwner(revokeAPIKey()))))).Methods("DELETE")
+	router.Handle("/{alias}/sessions", requireAuthentication(authorize(requireOwner(listSessions())))).Methods("GET")
+	router.Handle("/{alias}/sessions", audited("session.revoke_all", requireAuthentication(authorize(requireOwner(requireStepUp(VIVIAN_STEP_UP_MAX_AGE, revokeAllSessions())))))).Methods("DELETE")
+	router.Handle("/{alias}/step-up", audited("session.step_up", requireAuthentication(authorize(requireOwner(stepUpSession(ctx)))))).Methods("POST")
+	router.Handle("/{alias}/sessions/{id}", audited("session.revoke", requireAuthentication(authorize(requireOwner(requireStepUp(VIVIAN_STEP_UP_MAX_AGE, revokeSession())))))).Methods("DELETE")
+	router.Handle("/{alias}/bucket/fetch", requireScope(auth.API_SCOPE_BUCKET_READ, authorize(requireOwnerOr(rbac.PERMISSION_BUCKET_LIST, fetchBucketContents())))).Methods("GET")
 
 	httpServer := &http.Server{
 		Addr:         vivianServer.Addr,
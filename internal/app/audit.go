@@ -0,0 +1,166 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"vivian.infra/internal/pkg/audit"
+)
+
+const (
+	VIVIAN_AUDIT_LOG string = "logs/audit.log"
+	// VIVIAN_AUDIT_CHECKPOINT_INTERVAL is how many entries pass between the
+	// checkpoints written to the server log.
+	VIVIAN_AUDIT_CHECKPOINT_INTERVAL uint64 = 100
+
+	auditRecordKey contextKey = "vivian.audit"
+)
+
+// VIVIAN_AUDIT_SUBACTIONS are the values of an action parameter that are
+// recorded as part of the audited action; any other value is recorded as
+// "other" so that callers cannot write what they like into the log.
+var VIVIAN_AUDIT_SUBACTIONS = map[string]bool{
+	"generate":          true,
+	"verify":            true,
+	"expire":            true,
+	"totp-enroll":       true,
+	"totp-confirm":      true,
+	"totp-verify":       true,
+	"hotp-enroll":       true,
+	"hotp-confirm":      true,
+	"hotp-verify":       true,
+	"hotp-resync":       true,
+	"recovery-generate": true,
+	"recover":           true,
+	"totp-remove":       true,
+	"hotp-remove":       true,
+	"recovery-remove":   true,
+}
+
+var vivianAudit *audit.Log
+
+// initAudit opens the audit log named by VIVIAN_AUDIT_LOG, refusing to
+// continue a chain that has been tampered with. VIVIAN_AUDIT_KEY keys the
+// chain, and its head is written to the server log as a checkpoint on
+// opening and every VIVIAN_AUDIT_CHECKPOINT_INTERVAL entries, so that
+// truncation and recomputation show up against a copy kept elsewhere.
+func initAudit(deploymentID string) (*audit.Log, error) {
+	path := os.Getenv("VIVIAN_AUDIT_LOG")
+	if len(path) <= 0 {
+		path = VIVIAN_AUDIT_LOG
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	key := []byte(os.Getenv("VIVIAN_AUDIT_KEY"))
+	if len(key) <= 0 {
+		VivianServerLogger.LogWarning("no VIVIAN_AUDIT_KEY configured, audit chain can be recomputed by anyone")
+	}
+
+	log, err := audit.Open(path, deploymentID, key)
+	if err != nil {
+		return nil, err
+	}
+	if discarded := log.Discarded(); discarded > 0 {
+		VivianServerLogger.LogWarning(fmt.Sprintf("discarded %d bytes of an incomplete final audit entry", discarded))
+	}
+	VivianServerLogger.LogSuccess(fmt.Sprintf("audit checkpoint %v", log.Head()))
+	return log, nil
+}
+
+// auditAction names the audited action, qualified by the action parameter
+// of the request if it has one.
+func auditAction(action, sub string) string {
+	switch {
+	case len(sub) <= 0:
+		return action
+	case VIVIAN_AUDIT_SUBACTIONS[sub]:
+		return action + "." + sub
+	default:
+		return action + ".other"
+	}
+}
+
+// auditRecord is filled in while a request is handled: the authentication
+// middleware names the actor once it knows who is calling.
+type auditRecord struct {
+	actor string
+}
+
+func setAuditActor(ctx context.Context, actor string) {
+	if record, ok := ctx.Value(auditRecordKey).(*auditRecord); ok {
+		record.actor = actor
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// audited appends an entry for every request to next once it has been
+// answered, with the result derived from the response status. Requests that
+// carry an action parameter, as the 2FA route does, are recorded as
+// action.<parameter> if the parameter is one of VIVIAN_AUDIT_SUBACTIONS.
+func audited(action string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &auditRecord{actor: "anonymous"}
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditRecordKey, record)))
+
+		if vivianAudit == nil {
+			return
+		}
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		entry := audit.Entry{
+			Actor:  record.actor,
+			Alias:  routeAlias(r),
+			Action: auditAction(action, r.URL.Query().Get("action")),
+			Result: auditResult(status),
+			IP:     clientIP(r),
+			Detail: http.StatusText(status),
+		}
+		head, err := vivianAudit.Record(entry)
+		if err != nil {
+			VivianServerLogger.LogError("unable to write audit entry", err)
+			return
+		}
+		if head.Sequence%VIVIAN_AUDIT_CHECKPOINT_INTERVAL == 0 {
+			VivianServerLogger.LogSuccess(fmt.Sprintf("audit checkpoint %v", head))
+		}
+	})
+}
+
+func auditResult(status int) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return audit.AUDIT_RESULT_SUCCESS
+	case status == http.StatusLocked || status == http.StatusTooManyRequests:
+		return audit.AUDIT_RESULT_LOCKED
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusGone:
+		return audit.AUDIT_RESULT_DENIED
+	default:
+		return audit.AUDIT_RESULT_ERROR
+	}
+}
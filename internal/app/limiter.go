@@ -3,6 +3,7 @@ package app
 import (
 	"fmt"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -15,47 +16,86 @@ const (
 
 var RequestChannel *chan uint32
 var RequestChannelCounter *uint32
-var KillRequestTickerChannel = make(chan uint16)
 
+// Limiter is a leaky bucket. The request channel below queues every request
+// of the server through one, while Allow keeps a bucket per key and refuses
+// a request once its bucket is full instead of queueing it, so that one key
+// filling its bucket does not hold up anyone else.
 type Limiter struct {
+	size                  uint32
+	leak                  uint32
 	requestTicker         time.Ticker
 	requestChannel        chan uint32
 	requestChannelCounter uint32
 	requestBlockerState   atomic.Uint32
+	mu                    sync.Mutex
+	buckets               map[string]uint32
 }
 
-// TODO: change from init()
-func init() {
-	limiter := Limiter{
-		requestTicker:         *time.NewTicker(BUCKET_LIMITER_LEAK_RATE),
-		requestChannel:        make(chan uint32, BUCKET_LIMITER_SIZE),
+// NewLimiter starts a limiter holding size requests per bucket that leaks
+// leak of them every rate.
+func NewLimiter(size, leak uint32, rate time.Duration) *Limiter {
+	limiter := &Limiter{
+		size:                  size,
+		leak:                  leak,
+		requestTicker:         *time.NewTicker(rate),
+		requestChannel:        make(chan uint32, size),
 		requestChannelCounter: 0,
 		requestBlockerState:   atomic.Uint32{},
+		buckets:               make(map[string]uint32),
 	}
+	limiter.RateLimiter()
+	return limiter
+}
+
+// TODO: change from init()
+func init() {
+	limiter := NewLimiter(BUCKET_LIMITER_SIZE, BUCKET_LIMITER_LEAK_AMT, BUCKET_LIMITER_LEAK_RATE)
 	RequestChannel = &limiter.requestChannel
 	RequestChannelCounter = &limiter.requestChannelCounter
-	limiter.RateLimiter()
 }
 
 func (l *Limiter) RateLimiter() {
+	//limiters live as long as the server, so the ticker is never stopped.
 	go func() {
-		for {
-			select {
-			case <-l.requestTicker.C:
-				if l.requestChannelCounter >= 10 {
-					VivianServerLogger.LogWarning(fmt.Sprintf("blocked channel {status code:%v}", http.StatusTooManyRequests))
-				}
-				//debugging: fmt.Println("Channel Len:", len(l.requestChannel), "Channel Cap:", cap(l.requestChannel), "Pool:", l.requestChannelCounter)
-				if l.requestChannelCounter > 0 {
-					l.requestChannelCounter -= BUCKET_LIMITER_LEAK_AMT
-				} else {
-					l.requestChannelCounter = 0
-					l.requestChannel = make(chan uint32, BUCKET_LIMITER_SIZE)
-				}
-			case <-KillRequestTickerChannel:
-				VivianServerLogger.LogDebug("killing request ticker channel")
-				return
+		for range l.requestTicker.C {
+			if l.requestChannelCounter >= l.size {
+				VivianServerLogger.LogWarning(fmt.Sprintf("blocked channel {status code:%v}", http.StatusTooManyRequests))
+			}
+			//debugging: fmt.Println("Channel Len:", len(l.requestChannel), "Channel Cap:", cap(l.requestChannel), "Pool:", l.requestChannelCounter)
+			if l.requestChannelCounter > 0 {
+				l.requestChannelCounter -= l.leak
+			} else {
+				l.requestChannelCounter = 0
+				l.requestChannel = make(chan uint32, l.size)
 			}
+			l.leakBuckets()
 		}
 	}()
 }
+
+// Allow adds a request to the bucket of key and reports whether it fit.
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buckets[key] >= l.size {
+		return false
+	}
+	l.buckets[key]++
+	return true
+}
+
+// leakBuckets leaks every keyed bucket, forgetting the empty ones.
+func (l *Limiter) leakBuckets() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, level := range l.buckets {
+		if level <= l.leak {
+			delete(l.buckets, key)
+			continue
+		}
+		l.buckets[key] = level - l.leak
+	}
+}
@@ -0,0 +1,354 @@
+package app
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"vivian.infra/internal/pkg/auth"
+	"vivian.infra/internal/pkg/rbac"
+	"vivian.infra/models"
+)
+
+type contextKey string
+
+const (
+	authenticatedAliasKey  contextKey = "vivian.alias"
+	authenticatedClaimsKey contextKey = "vivian.claims"
+	authenticatedAPIKeyKey contextKey = "vivian.apikey"
+)
+
+var vivianTokens *auth.TokenIssuer
+
+// initTokens builds the access token issuer from the environment. The
+// configured key, or a generated one, only seeds the key ring; later keys
+// are generated on rotation, so tokens do not survive a restart.
+func initTokens() (*auth.TokenIssuer, error) {
+	algorithm := os.Getenv("VIVIAN_TOKEN_ALG")
+	if len(algorithm) <= 0 {
+		algorithm = auth.TOKEN_ALG_EDDSA
+	}
+
+	var key *auth.SigningKey
+	var err error
+	switch {
+	case algorithm == auth.TOKEN_ALG_HS256 && len(os.Getenv("VIVIAN_TOKEN_SECRET")) > 0:
+		key, err = auth.NewHS256Key([]byte(os.Getenv("VIVIAN_TOKEN_SECRET")))
+	case algorithm == auth.TOKEN_ALG_EDDSA && len(os.Getenv("VIVIAN_TOKEN_ED25519_SEED")) > 0:
+		var seed []byte
+		seed, err = base64.StdEncoding.DecodeString(os.Getenv("VIVIAN_TOKEN_ED25519_SEED"))
+		if err == nil && len(seed) != ed25519.SeedSize {
+			err = fmt.Errorf("ed25519 seed must be %d bytes", ed25519.SeedSize)
+		}
+		if err == nil {
+			key = auth.NewEdDSAKey(ed25519.NewKeyFromSeed(seed))
+		}
+	default:
+		VivianServerLogger.LogWarning(fmt.Sprintf("no %v signing key configured, generating one", algorithm))
+		key, err = auth.GenerateSigningKey(algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := auth.TokenConfig{Audience: os.Getenv("VIVIAN_TOKEN_AUDIENCE"), Lifetime: auth.TOKEN_DEFAULT_LIFETIME}
+	if lifetime, err := time.ParseDuration(os.Getenv("VIVIAN_TOKEN_LIFETIME")); err == nil {
+		config.Lifetime = lifetime
+	}
+	interval := auth.KEYRING_ROTATION_INTERVAL
+	if rotation, err := time.ParseDuration(os.Getenv("VIVIAN_KEY_ROTATION_INTERVAL")); err == nil {
+		interval = rotation
+	}
+
+	//retiring keys have to outlive every token they signed.
+	ring := auth.NewKeyRing(key, interval, config.Lifetime+auth.TOKEN_LEEWAY)
+	return auth.NewTokenIssuer(ring, config), nil
+}
+
+// AuthenticatedAlias returns the alias that requireAuthentication placed in
+// ctx.
+func AuthenticatedAlias(ctx context.Context) (string, bool) {
+	alias, ok := ctx.Value(authenticatedAliasKey).(string)
+	return alias, ok
+}
+
+func authenticatedClaims(ctx context.Context) (*auth.Claims, bool) {
+	claims, ok := ctx.Value(authenticatedClaimsKey).(*auth.Claims)
+	return claims, ok
+}
+
+// authenticatedSession returns the session the request's access token was
+// issued under, if it was issued to a login rather than a client.
+func authenticatedSession(ctx context.Context) (string, bool) {
+	claims, ok := authenticatedClaims(ctx)
+	if !ok {
+		return "", false
+	}
+	sid, ok := claims.Custom["sid"].(string)
+	return sid, ok
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || len(strings.TrimSpace(token)) <= 0 {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// browserSession lets a browser that logged in with session=cookie reach
+// next with the access token from its session cookie, when it sends no
+// Authorization header of its own. Besides the cookie being SameSite,
+// requests that change state must come from the server's own origin.
+func browserSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(VIVIAN_SESSION_COOKIE)
+		if _, ok := bearerToken(r); ok || err != nil || len(cookie.Value) <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			public, _ := url.Parse(publicURL())
+			if origin := r.Header.Get("Origin"); origin != public.Scheme+"://"+public.Host {
+				VivianServerLogger.LogWarning(fmt.Sprintf("refused session cookie on %v %v from origin %q", r.Method, r.URL.Path, origin))
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+cookie.Value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAuthentication rejects requests without a valid bearer access token
+// and otherwise passes them on with the token's subject as the
+// authenticated alias. Only full session tokens are accepted; delegated
+// OAuth tokens and API keys can only reach routes wrapped in requireScope.
+func requireAuthentication(next http.Handler) http.Handler {
+	return authenticate("", next)
+}
+
+// requireScope is requireAuthentication for routes that machine clients may
+// call: it also accepts API keys and OAuth access tokens granted scope.
+func requireScope(scope string, next http.Handler) http.Handler {
+	return authenticate(scope, next)
+}
+
+func authenticate(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+VIVIAN_APP_NAME+`"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		if strings.HasPrefix(token, auth.API_KEY_PREFIX) {
+			key, err := auth.AuthenticateAPIKey(token, clientIP(r))
+			if err != nil {
+				VivianServerLogger.LogWarning(fmt.Sprintf("rejected api key from %v: %v", clientIP(r), err))
+				writeInvalidToken(w, "invalid api key")
+				return
+			}
+			//a key is held to its account like a token: it dies with the
+			//account and with the password it was created under.
+			account, err := VivianDatabase.FetchAccount(key.Alias)
+			if err != nil || !account.Active() || key.CreatedAt.Before(account.PasswordChangedAt) {
+				VivianServerLogger.LogWarning(fmt.Sprintf("rejected api key %v of %v, whose account is gone, unverified or has reset its password since", key.Prefix, key.Alias))
+				writeInvalidToken(w, "api key has been revoked")
+				return
+			}
+			if len(scope) <= 0 || !key.HasScope(scope) {
+				VivianServerLogger.LogWarning(fmt.Sprintf("api key %v of %v lacks scope %q for %v", key.Prefix, key.Alias, scope, r.URL.Path))
+				writeInsufficientScope(w, scope)
+				return
+			}
+			setAuditActor(r.Context(), key.Prefix)
+			ctx := context.WithValue(r.Context(), authenticatedAliasKey, key.Alias)
+			ctx = context.WithValue(ctx, authenticatedAPIKeyKey, key)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		claims, err := vivianTokens.Validate(token)
+		if err != nil {
+			description := "invalid token"
+			if errors.Is(err, auth.ErrTokenExpired) {
+				description = "token has expired"
+			}
+			VivianServerLogger.LogWarning(fmt.Sprintf("rejected token from %v: %v", clientIP(r), err))
+			writeInvalidToken(w, description)
+			return
+		}
+		account, err := VivianDatabase.FetchAccount(claims.Subject)
+		if err != nil || claims.IssuedAt.Before(account.PasswordChangedAt.Truncate(time.Second)) {
+			VivianServerLogger.LogWarning(fmt.Sprintf("rejected token of %v issued before its password was reset", claims.Subject))
+			writeInvalidToken(w, "token has been revoked")
+			return
+		}
+
+		//tokens issued to OAuth clients carry the scopes the user consented
+		//to; session tokens carry none and may do anything the alias can
+		//for as long as their session is live.
+		if granted, delegated := claims.Custom["scope"].(string); delegated {
+			if len(scope) <= 0 || !containsScope(granted, scope) {
+				VivianServerLogger.LogWarning(fmt.Sprintf("token of %v lacks scope %q for %v", claims.Subject, scope, r.URL.Path))
+				writeInsufficientScope(w, scope)
+				return
+			}
+		} else {
+			sid, _ := claims.Custom["sid"].(string)
+			if err := auth.TouchSession(sid, clientIP(r)); err != nil {
+				VivianServerLogger.LogWarning(fmt.Sprintf("rejected token of %v for ended session %v", claims.Subject, sid))
+				writeInvalidToken(w, "token has been revoked")
+				return
+			}
+		}
+
+		if client, ok := claims.Custom["client_id"].(string); ok {
+			setAuditActor(r.Context(), claims.Subject+" via "+client)
+		} else {
+			setAuditActor(r.Context(), claims.Subject)
+		}
+		ctx := context.WithValue(r.Context(), authenticatedAliasKey, claims.Subject)
+		ctx = context.WithValue(ctx, authenticatedClaimsKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func containsScope(granted, scope string) bool {
+	for _, entry := range strings.Fields(granted) {
+		if entry == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func writeInvalidToken(w http.ResponseWriter, description string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="`+VIVIAN_APP_NAME+`", error="invalid_token", error_description="`+description+`"`)
+	http.Error(w, description, http.StatusUnauthorized)
+}
+
+func writeInsufficientScope(w http.ResponseWriter, scope string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="`+VIVIAN_APP_NAME+`", error="insufficient_scope", scope="`+scope+`"`)
+	http.Error(w, "insufficient scope", http.StatusForbidden)
+}
+
+// requireStepUp only lets a request through if its session completed a
+// second factor within maxAge, so that a stolen or long-lived session alone
+// is not enough for the routes it guards. It must run after
+// requireAuthentication.
+func requireStepUp(maxAge time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+		sid, ok := authenticatedSession(r.Context())
+		if !ok {
+			VivianServerLogger.LogWarning(fmt.Sprintf("step-up required for %v on %v without a session", alias, r.URL.Path))
+			writeStepUpRequired(w, maxAge)
+			return
+		}
+		if verifiedAt, ok := auth.SessionVerifiedAt(sid); !ok || time.Since(verifiedAt) > maxAge {
+			VivianServerLogger.LogDebug(fmt.Sprintf("step-up required for %v on %v", alias, r.URL.Path))
+			writeStepUpRequired(w, maxAge)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeStepUpRequired answers with the RFC 9470 challenge, naming the oldest
+// second factor the route accepts in both the header and the body.
+func writeStepUpRequired(w http.ResponseWriter, maxAge time.Duration) {
+	seconds := int64(maxAge.Seconds())
+	bytes, err := json.Marshal(struct {
+		Error  string `json:"error"`
+		MaxAge int64  `json:"max_age"`
+	}{"step_up_required", seconds})
+	if err != nil {
+		VivianServerLogger.LogError("failure marshalling results", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%v", error="insufficient_user_authentication", max_age=%d`, VIVIAN_APP_NAME, seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+		VivianServerLogger.LogError("failure writing results", err)
+	}
+}
+
+// routeAlias is the {alias} of the route r matched, in the form accounts are
+// stored under.
+func routeAlias(r *http.Request) string {
+	return models.NormalizeAlias(mux.Vars(r)["alias"])
+}
+
+// requireOwner only lets the authenticated alias act on its own {alias}
+// routes. It must run after requireAuthentication.
+func requireOwner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, ok := AuthenticatedAlias(r.Context())
+		if !ok || alias != routeAlias(r) {
+			VivianServerLogger.LogWarning(fmt.Sprintf("%v attempted to access %v", alias, r.URL.Path))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireOwnerOr is requireOwner, except that accounts holding permission
+// may also act on the resources of other aliases. It must run after
+// authorize.
+func requireOwnerOr(permission rbac.Permission, next http.Handler) http.Handler {
+	owner := requireOwner(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+		if account, err := VivianDatabase.FetchAccount(alias); err == nil && rbac.Allowed(account.Roles, permission) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		owner.ServeHTTP(w, r)
+	})
+}
+
+// authorize enforces the rbac.POLICY entry of the matched route against the
+// roles of the authenticated alias. Roles are read from the account on every
+// request so that a demotion takes effect without waiting for tokens to
+// expire. It must run after requireAuthentication or requireScope.
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+
+		template := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ = route.GetPathTemplate()
+		}
+		permission, ok := rbac.Required(r.Method, template)
+		if !ok {
+			VivianServerLogger.LogError("refusing request", fmt.Errorf("no policy for %v %v", r.Method, template))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		account, err := VivianDatabase.FetchAccount(alias)
+		if err != nil || !rbac.Allowed(account.Roles, permission) {
+			VivianServerLogger.LogWarning(fmt.Sprintf("%v lacks permission %v for %v %v", alias, permission, r.Method, r.URL.Path))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
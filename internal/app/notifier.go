@@ -0,0 +1,48 @@
+package app
+
+import (
+	"os"
+
+	"vivian.infra/internal/pkg/notify"
+)
+
+const (
+	VIVIAN_OUTBOX_DIRECTORY string = "outbox"
+)
+
+var vivianNotifiers *notify.Registry
+
+// initNotifiers registers every delivery backend that has been configured
+// through the environment. The outbox is always available so that local
+// deployments can read generated keys without a relay or webhook receiver.
+func initNotifiers() *notify.Registry {
+	fallback := os.Getenv("VIVIAN_NOTIFY_DEFAULT")
+	if len(fallback) <= 0 {
+		fallback = notify.NOTIFY_CHANNEL_OUTBOX
+	}
+	registry := notify.NewRegistry(fallback)
+
+	outbox := os.Getenv("VIVIAN_OUTBOX_DIRECTORY")
+	if len(outbox) <= 0 {
+		outbox = VIVIAN_OUTBOX_DIRECTORY
+	}
+	registry.Register(notify.NOTIFY_CHANNEL_OUTBOX, notify.NewOutboxNotifier(outbox))
+
+	if addr := os.Getenv("VIVIAN_SMTP_ADDR"); len(addr) > 0 {
+		registry.Register(notify.NOTIFY_CHANNEL_EMAIL, notify.NewSMTPNotifier(
+			addr,
+			os.Getenv("VIVIAN_SMTP_FROM"),
+			os.Getenv("VIVIAN_SMTP_USER"),
+			os.Getenv("VIVIAN_SMTP_PASSWORD"),
+		))
+	}
+
+	if url := os.Getenv("VIVIAN_WEBHOOK_URL"); len(url) > 0 {
+		registry.Register(notify.NOTIFY_CHANNEL_WEBHOOK, notify.NewWebhookNotifier(url, []byte(os.Getenv("VIVIAN_WEBHOOK_SECRET"))))
+	}
+
+	if err := registry.LoadRoutes(os.Getenv("VIVIAN_NOTIFY_ROUTES")); err != nil {
+		VivianServerLogger.LogError("invalid notification routes", err)
+	}
+	return registry
+}
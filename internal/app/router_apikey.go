@@ -0,0 +1,92 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"vivian.infra/internal/pkg/auth"
+)
+
+// createAPIKey issues a key for the authenticated alias. The response is the
+// only time the full key is shown.
+func createAPIKey() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+
+		var request struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			ExpiresIn int64    `json:"expires_in"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, VIVIAN_MAX_BODY_SIZE)
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "malformed api key request", http.StatusBadRequest)
+			return
+		}
+
+		key, token, err := auth.CreateAPIKey(alias, request.Name, request.Scopes, time.Duration(request.ExpiresIn)*time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		bytes, err := json.Marshal(struct {
+			*auth.APIKey
+			Key string `json:"key"`
+		}{key, token})
+		if err != nil {
+			VivianServerLogger.LogError("failure marshalling results", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+			VivianServerLogger.LogError("failure writing results", err)
+			return
+		}
+		VivianServerLogger.LogSuccess(fmt.Sprintf("created api key %v for %v with scopes %v", key.Prefix, alias, key.Scopes))
+	})
+}
+
+func listAPIKeys() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+
+		bytes, err := json.Marshal(auth.ListAPIKeys(alias))
+		if err != nil {
+			VivianServerLogger.LogError("failure marshalling results", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+			VivianServerLogger.LogError("failure writing results", err)
+			return
+		}
+	})
+}
+
+func revokeAPIKey() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+		id := mux.Vars(r)["id"]
+
+		if err := auth.RevokeAPIKey(alias, id); err != nil {
+			if errors.Is(err, auth.ErrAPIKeyNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			VivianServerLogger.LogError("unable to revoke api key", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		VivianServerLogger.LogSuccess(fmt.Sprintf("revoked api key %v%v of %v", auth.API_KEY_PREFIX, id, alias))
+	})
+}
@@ -5,41 +5,107 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 
 	"vivian.infra/internal/pkg/auth"
+	"vivian.infra/internal/pkg/notify"
 )
 
-func authentication2FA(ctx context.Context) http.Handler {
+// authentication2FA serves the 2FA actions named in actions and nothing
+// else, so that each route in Deploy only reaches the actions its guards
+// were chosen for.
+func authentication2FA(ctx context.Context, actions ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		*RequestChannelCounter++
 
+		alias := routeAlias(r)
 		q := r.URL.Query()
 		action := strings.TrimSpace(q.Get("action"))
+		if !slices.Contains(actions, action) {
+			http.NotFound(w, r)
+			return
+		}
 		switch action {
 		case "generate":
+			//generation is routed through requireScope in Deploy; a request
+			//that reaches here unauthenticated slipped past that route.
+			if _, ok := AuthenticatedAlias(r.Context()); !ok {
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+				return
+			}
 			*RequestChannel <- 1
-			generateAuthentication2FA(w, ctx)
+			generateAuthentication2FA(w, ctx, alias)
 		case "verify":
 			*RequestChannel <- 1
 			key := strings.TrimSpace(q.Get("key"))
-			verifyAuthentication2FA(w, ctx, key)
+			pending := strings.TrimSpace(q.Get("pending"))
+			verifyAuthentication2FA(w, r, ctx, alias, key, pending)
 		case "expire":
 			*RequestChannel <- 1
-			expireAuthentication2FA(w, ctx)
+			expireAuthentication2FA(w, ctx, alias)
+		case "totp-enroll":
+			*RequestChannel <- 1
+			enroll2FA(w, ctx, alias, FACTOR_TOTP)
+		case "totp-confirm":
+			*RequestChannel <- 1
+			key := strings.TrimSpace(q.Get("key"))
+			confirm2FA(w, ctx, alias, FACTOR_TOTP, key, clientIP(r))
+		case "totp-verify":
+			*RequestChannel <- 1
+			key := strings.TrimSpace(q.Get("key"))
+			pending := strings.TrimSpace(q.Get("pending"))
+			completeLogin2FA(w, r, ctx, alias, FACTOR_TOTP, key, pending)
+		case "hotp-enroll":
+			*RequestChannel <- 1
+			enroll2FA(w, ctx, alias, FACTOR_HOTP)
+		case "hotp-confirm":
+			*RequestChannel <- 1
+			key := strings.TrimSpace(q.Get("key"))
+			confirm2FA(w, ctx, alias, FACTOR_HOTP, key, clientIP(r))
+		case "hotp-verify":
+			*RequestChannel <- 1
+			key := strings.TrimSpace(q.Get("key"))
+			pending := strings.TrimSpace(q.Get("pending"))
+			completeLogin2FA(w, r, ctx, alias, FACTOR_HOTP, key, pending)
+		case "hotp-resync":
+			*RequestChannel <- 1
+			key := strings.TrimSpace(q.Get("key"))
+			next := strings.TrimSpace(q.Get("next"))
+			resync2FA(w, ctx, alias, FACTOR_HOTP, key, next, clientIP(r))
+		case "recovery-generate":
+			*RequestChannel <- 1
+			enroll2FA(w, ctx, alias, FACTOR_RECOVERY)
+		case "totp-remove":
+			*RequestChannel <- 1
+			remove2FA(w, ctx, alias, FACTOR_TOTP)
+		case "hotp-remove":
+			*RequestChannel <- 1
+			remove2FA(w, ctx, alias, FACTOR_HOTP)
+		case "recovery-remove":
+			*RequestChannel <- 1
+			remove2FA(w, ctx, alias, FACTOR_RECOVERY)
+		case "recover":
+			*RequestChannel <- 1
+			code := strings.TrimSpace(q.Get("key"))
+			pending := strings.TrimSpace(q.Get("pending"))
+			completeLogin2FA(w, r, ctx, alias, FACTOR_RECOVERY, code, pending)
 		default:
 			http.NotFound(w, r)
 		}
 	})
 }
 
-func generateAuthentication2FA(w http.ResponseWriter, ctx context.Context) {
+func generateAuthentication2FA(w http.ResponseWriter, ctx context.Context, alias string) {
 	keyChan := make(chan string)
 	errorChan := make(chan error)
 
 	go func() {
-		key2FA, err := auth.GenerateAuthKey2FA(ctx, VivianServerLogger)
+		key2FA, err := vivianAuthenticator.GenerateAuthKey2FA(ctx, alias, VivianServerLogger)
 		if err != nil {
 			errorChan <- err
 			return
@@ -48,62 +114,348 @@ func generateAuthentication2FA(w http.ResponseWriter, ctx context.Context) {
 	}()
 
 	select {
-	case hash2FA := <-keyChan:
-		_, err := json.Marshal(hash2FA)
+	case key2FA := <-keyChan:
+		channel, err := deliverAuthKey2FA(ctx, alias, key2FA)
+		if err != nil {
+			http.Error(w, "unable to deliver authentication key", http.StatusBadGateway)
+			return
+		}
+
+		//the key itself never goes back to the client, only where it was sent.
+		bytes, err := json.Marshal(struct {
+			Channel string `json:"channel"`
+		}{channel})
 		if err != nil {
 			VivianServerLogger.LogError("failure marshalling results", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		//this just fucking prints it to the client, probably good for JS.
-		//if _, err := fmt.Fprintln(w, "2FA generation successful"); err != nil {
-		//	VivianServerLogger.LogError("Failure writing results", err)
-		//	return
-		//}
+		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+			VivianServerLogger.LogError("failure writing results", err)
+			return
+		}
 	case err := <-errorChan:
 		VivianServerLogger.LogError("unable to generate authentication 2FA", err)
 		return
 	}
 }
 
-func verifyAuthentication2FA(w http.ResponseWriter, ctx context.Context, key2FA string) {
+// deliverAuthKey2FA sends key2FA through the notifier assigned to alias and
+// returns the channel used. The key goes to the email address of the account
+// unless the route of alias names an address of its own. An undelivered key
+// is expired straight away so that the alias can generate another.
+func deliverAuthKey2FA(ctx context.Context, alias, key2FA string) (string, error) {
+	msg := notify.Message{
+		Alias:   alias,
+		Subject: "vivian.infra authentication key",
+		Body:    fmt.Sprintf("your authentication key is %v", key2FA),
+	}
+	if account, err := VivianDatabase.FetchAccount(alias); err == nil && len(vivianNotifiers.Route(alias).Address) <= 0 {
+		msg.Address = account.Email
+	}
+	channel, err := vivianNotifiers.Notify(ctx, msg)
+	if err != nil {
+		VivianServerLogger.LogError("unable to deliver authentication 2FA", err)
+		if err := vivianAuthenticator.ExpireAuthentication2FA(ctx, alias, VivianServerLogger); err != nil {
+			VivianServerLogger.LogError("failed to expire undelivered 2FA ->", err)
+		}
+		return "", err
+	}
+	VivianServerLogger.LogSuccess(fmt.Sprintf("delivered authentication key for %v via %v", alias, channel))
+	return channel, nil
+}
+
+func verifyAuthentication2FA(w http.ResponseWriter, r *http.Request, ctx context.Context, alias, key2FA, pending string) {
+	ip := clientIP(r)
+	if lockedOut(w, alias, ip) {
+		return
+	}
+	//the pending login is checked first since verifying the key consumes
+	//the challenge it is bound to. Keys are only verified for a login;
+	//sessions verify theirs through step-up.
+	if err := vivianAuthenticator.CheckPendingLogin(ctx, alias, pending); err != nil {
+		VivianServerLogger.LogWarning(fmt.Sprintf("unable to complete login for %v: %v", alias, err))
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	resultChan := make(chan bool)
 	errorChan := make(chan error)
 
 	go func() {
-		result, err := auth.VerifyAuthKey2FA(ctx, key2FA, VivianServerLogger)
+		result, err := vivianAuthenticator.VerifyAuthKey2FA(ctx, alias, key2FA, VivianServerLogger)
 		if err != nil {
 			errorChan <- err
 			return
 		}
 		resultChan <- result
-		KillRequestTickerChannel <- 1
 	}()
 
 	select {
 	case result := <-resultChan:
-		bytes, err := json.Marshal(result)
-		if err != nil {
-			VivianServerLogger.LogError("failure marshalling results", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !result {
+			http.Error(w, auth.ErrInvalidKey.Error(), http.StatusUnauthorized)
 			return
 		}
-		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
-			VivianServerLogger.LogError("failure writing results", err)
+		issueSession(w, r, alias, true)
+	case err := <-errorChan:
+		if errors.Is(err, auth.ErrKeyExpired) {
+			VivianServerLogger.LogError("unable to verify key", err)
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		if errors.Is(err, auth.ErrInvalidKey) {
+			if recordFailure(w, ctx, alias, ip) {
+				return
+			}
+			VivianServerLogger.LogError("unable to verify key", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
-	case err := <-errorChan:
 		VivianServerLogger.LogError("unable to verify key", errors.New("invalid Key"))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func expireAuthentication2FA(_ http.ResponseWriter, ctx context.Context) {
-	err := auth.Expire2FA(ctx, VivianServerLogger)
+func expireAuthentication2FA(_ http.ResponseWriter, ctx context.Context, alias string) {
+	err := vivianAuthenticator.ExpireAuthentication2FA(ctx, alias, VivianServerLogger)
 	if err != nil {
 		VivianServerLogger.LogError("failed to expire 2FA ->", err)
 		return
 	}
 	VivianServerLogger.LogSuccess("successfully expired 2FA token")
 }
+
+// enroll2FA sets up factor for alias and answers with what the owner needs
+// to use it, which is shown this once. Factors that need no confirmation
+// turn on 2FA for the account straight away.
+func enroll2FA(w http.ResponseWriter, ctx context.Context, alias, factor string) {
+	enrollment, err := vivianFactors[factor].Enroll(ctx, alias, VivianServerLogger)
+	if err != nil {
+		VivianServerLogger.LogError(fmt.Sprintf("unable to enroll %v", factor), err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if _, ok := vivianFactors[factor].(auth.Confirmer2FA); !ok {
+		setTwoFactor(alias, true)
+	}
+
+	bytes, err := json.Marshal(enrollment)
+	if err != nil {
+		VivianServerLogger.LogError("failure marshalling results", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+		VivianServerLogger.LogError("failure writing results", err)
+		return
+	}
+}
+
+// completeLogin2FA verifies code with factor in place of the emailed key the
+// login pending was waiting on, and answers with a session. The lockout and
+// the pending login are checked before the code is compared with anything.
+func completeLogin2FA(w http.ResponseWriter, r *http.Request, ctx context.Context, alias, factor, code, pending string) {
+	ip := clientIP(r)
+	if lockedOut(w, alias, ip) {
+		return
+	}
+	if err := vivianAuthenticator.CheckPendingLogin(ctx, alias, pending); err != nil {
+		VivianServerLogger.LogWarning(fmt.Sprintf("unable to complete login for %v: %v", alias, err))
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	result, err := vivianFactors[factor].VerifyAuthKey2FA(ctx, alias, code, VivianServerLogger)
+	if err != nil {
+		if invalidCode(err) && recordFailure(w, ctx, alias, ip) {
+			return
+		}
+		VivianServerLogger.LogError(fmt.Sprintf("unable to verify %v code", factor), err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !result {
+		http.Error(w, auth.ErrInvalidCode.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	//expiring the emailed key ends the pending login, so only one request
+	//can complete it however many codes are raced against it.
+	if err := vivianAuthenticator.ExpireAuthentication2FA(ctx, alias, VivianServerLogger); err != nil {
+		VivianServerLogger.LogWarning(fmt.Sprintf("login of %v was completed concurrently", alias))
+		http.Error(w, auth.ErrInvalidPendingLogin.Error(), http.StatusUnauthorized)
+		return
+	}
+	issueSession(w, r, alias, true)
+}
+
+// confirm2FA takes the first code of a new enrollment from its owner, after
+// which factor can be used to log in and logins to alias require 2FA.
+func confirm2FA(w http.ResponseWriter, ctx context.Context, alias, factor, code, ip string) {
+	confirmer, ok := vivianFactors[factor].(auth.Confirmer2FA)
+	if !ok {
+		http.Error(w, fmt.Sprintf("%v needs no confirmation", factor), http.StatusBadRequest)
+		return
+	}
+	if lockedOut(w, alias, ip) {
+		return
+	}
+
+	if err := confirmer.Confirm2FA(ctx, alias, code, VivianServerLogger); err != nil {
+		if invalidCode(err) && recordFailure(w, ctx, alias, ip) {
+			return
+		}
+		VivianServerLogger.LogError(fmt.Sprintf("unable to confirm %v", factor), err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	vivianAttempts.RecordSuccess(alias)
+	setTwoFactor(alias, true)
+	if _, err := fmt.Fprintln(w, "true"); err != nil {
+		VivianServerLogger.LogError("failure writing results", err)
+		return
+	}
+}
+
+// remove2FA takes factor away from alias. Once no factor is left enrolled,
+// logins to alias no longer require 2FA.
+func remove2FA(w http.ResponseWriter, ctx context.Context, alias, factor string) {
+	remover, ok := vivianFactors[factor].(auth.Remover2FA)
+	if !ok {
+		http.Error(w, fmt.Sprintf("%v cannot be removed", factor), http.StatusBadRequest)
+		return
+	}
+	if err := remover.Remove2FA(ctx, alias, VivianServerLogger); err != nil {
+		VivianServerLogger.LogError(fmt.Sprintf("unable to remove %v", factor), err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	enrolled := false
+	for name, other := range vivianFactors {
+		enrollable, ok := other.(auth.Remover2FA)
+		if !ok {
+			continue
+		}
+		ok, err := enrollable.Enrolled(ctx, alias)
+		if err != nil {
+			//an unknown factor is assumed enrolled, so 2FA stays on.
+			VivianServerLogger.LogError(fmt.Sprintf("unable to check %v enrollment", name), err)
+		}
+		if ok || err != nil {
+			enrolled = true
+			break
+		}
+	}
+	if !enrolled {
+		setTwoFactor(alias, false)
+	}
+
+	if _, err := fmt.Fprintln(w, "true"); err != nil {
+		VivianServerLogger.LogError("failure writing results", err)
+		return
+	}
+}
+
+// setTwoFactor records whether logins to alias require 2FA, which the login
+// routes read from the account.
+func setTwoFactor(alias string, enabled bool) {
+	if err := VivianDatabase.SetTwoFactor(alias, enabled); err != nil {
+		VivianServerLogger.LogError(fmt.Sprintf("unable to set 2FA of %v to %v", alias, enabled), err)
+		return
+	}
+	VivianServerLogger.LogSuccess(fmt.Sprintf("audit: 2FA of %v set to %v", alias, enabled))
+}
+
+func resync2FA(w http.ResponseWriter, ctx context.Context, alias, factor, first, second, ip string) {
+	resynchronizer, ok := vivianFactors[factor].(auth.Resynchronizer2FA)
+	if !ok {
+		http.Error(w, fmt.Sprintf("%v cannot be resynchronised", factor), http.StatusBadRequest)
+		return
+	}
+	if lockedOut(w, alias, ip) {
+		return
+	}
+
+	if err := resynchronizer.Resync2FA(ctx, alias, first, second, VivianServerLogger); err != nil {
+		if invalidCode(err) && recordFailure(w, ctx, alias, ip) {
+			return
+		}
+		VivianServerLogger.LogError(fmt.Sprintf("unable to resync %v", factor), err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	vivianAttempts.RecordSuccess(alias)
+	if _, err := fmt.Fprintln(w, "true"); err != nil {
+		VivianServerLogger.LogError("failure writing results", err)
+		return
+	}
+}
+
+// invalidCode reports whether err is a wrong code, which counts towards the
+// lockout, rather than a factor that is not set up.
+func invalidCode(err error) bool {
+	return errors.Is(err, auth.ErrInvalidCode) || errors.Is(err, auth.ErrInvalidRecoveryCode)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// lockedOut answers with the lockout and reports true when alias or ip must
+// wait before attempting verification again.
+func lockedOut(w http.ResponseWriter, alias, ip string) bool {
+	var lockout *auth.LockoutError
+	if err := vivianAttempts.Check(alias, ip); !errors.As(err, &lockout) {
+		return false
+	}
+	VivianServerLogger.LogWarning(fmt.Sprintf("rejected 2FA attempt for %v from %v: %v", alias, ip, lockout))
+	writeLockout(w, lockout)
+	return true
+}
+
+// recordFailure counts a wrong key and reports true, having answered with
+// the lockout, when that failure locked alias out.
+func recordFailure(w http.ResponseWriter, ctx context.Context, alias, ip string) bool {
+	var lockout *auth.LockoutError
+	if err := vivianAttempts.RecordFailure(ctx, alias, ip, vivianAuthenticator, VivianServerLogger); !errors.As(err, &lockout) {
+		return false
+	}
+	writeLockout(w, lockout)
+	return true
+}
+
+// writeLockout answers 423 for a hard lockout and 429 during backoff, with
+// the wait in both the Retry-After header and the body.
+func writeLockout(w http.ResponseWriter, lockout *auth.LockoutError) {
+	retryAfter := int(math.Ceil(lockout.RetryAfter.Seconds()))
+	status := http.StatusTooManyRequests
+	if lockout.Locked {
+		status = http.StatusLocked
+	}
+
+	bytes, err := json.Marshal(struct {
+		Error      string `json:"error"`
+		Locked     bool   `json:"locked"`
+		RetryAfter int    `json:"retry_after"`
+	}{lockout.Error(), lockout.Locked, retryAfter})
+	if err != nil {
+		VivianServerLogger.LogError("failure marshalling results", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(status)
+	if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+		VivianServerLogger.LogError("failure writing results", err)
+		return
+	}
+}
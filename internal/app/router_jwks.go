@@ -0,0 +1,35 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"vivian.infra/internal/pkg/auth"
+)
+
+const (
+	VIVIAN_JWKS_MAX_AGE int = int(auth.JWKS_MAX_AGE / time.Second)
+)
+
+// fetchJWKS publishes the public signing keys so that other services can
+// verify access tokens without calling back. The cache lifetime is far
+// shorter than the time a retiring key stays in the set.
+func fetchJWKS() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := json.Marshal(vivianTokens.KeyRing().JWKS())
+		if err != nil {
+			VivianServerLogger.LogError("failure marshalling results", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", VIVIAN_JWKS_MAX_AGE))
+		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+			VivianServerLogger.LogError("failure writing results", err)
+			return
+		}
+	})
+}
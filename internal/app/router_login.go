@@ -0,0 +1,207 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"vivian.infra/database"
+	"vivian.infra/internal/pkg/auth"
+)
+
+const (
+	VIVIAN_MAX_BODY_SIZE int64 = 1 << 16
+	// VIVIAN_SESSION_COOKIE holds the access token of a browser that logged
+	// in with session=cookie, for the routes wrapped in browserSession.
+	VIVIAN_SESSION_COOKIE string = "vivian_session"
+)
+
+var VivianDatabase *database.AccountStore
+
+func loginAccount(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*RequestChannelCounter++
+		*RequestChannel <- 1
+
+		alias := routeAlias(r)
+		ip := clientIP(r)
+
+		var credentials struct {
+			Password string `json:"password"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, VIVIAN_MAX_BODY_SIZE)
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			http.Error(w, "malformed login request", http.StatusBadRequest)
+			return
+		}
+
+		if lockedOut(w, alias, ip) {
+			return
+		}
+
+		account, err := VivianDatabase.FetchAccount(alias)
+		if err != nil {
+			//burn the same time as a real comparison so response times do
+			//not reveal which aliases exist.
+			auth.VerifyDummyKeyphrase(credentials.Password)
+			VivianServerLogger.LogWarning(fmt.Sprintf("login attempted for unknown alias %v from %v", alias, ip))
+			if recordFailure(w, ctx, alias, ip) {
+				return
+			}
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		ok, rehash, err := auth.VerifyAndRehashKeyphrase(ctx, account.Password, credentials.Password)
+		if err != nil && !errors.Is(err, auth.ErrUnknownHash) {
+			VivianServerLogger.LogError("failure verifying password", err)
+		}
+		if !ok {
+			VivianServerLogger.LogWarning(fmt.Sprintf("failed login for %v from %v", alias, ip))
+			if recordFailure(w, ctx, alias, ip) {
+				return
+			}
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		if !account.Active() {
+			VivianServerLogger.LogWarning(fmt.Sprintf("login for unverified %v", alias))
+			http.Error(w, "email address has not been verified", http.StatusForbidden)
+			return
+		}
+
+		if len(rehash) > 0 {
+			if err := VivianDatabase.UpdatePassword(alias, rehash); err != nil {
+				VivianServerLogger.LogError("failure upgrading password hash", err)
+			} else {
+				VivianServerLogger.LogDebug(fmt.Sprintf("upgraded password hash for %v", alias))
+			}
+		}
+
+		//failures are only forgotten by issueSession once the whole login
+		//has succeeded, so a correct password does not buy more guesses at
+		//the second factor.
+		if !account.TwoFactorEnabled {
+			issueSession(w, r, alias, false)
+			return
+		}
+		beginPendingLogin(w, ctx, alias)
+	})
+}
+
+// beginPendingLogin sends a fresh 2FA key to alias and answers with the
+// pending token that the verify action needs alongside it.
+func beginPendingLogin(w http.ResponseWriter, ctx context.Context, alias string) {
+	if err := vivianAuthenticator.ExpireAuthentication2FA(ctx, alias, VivianServerLogger); err == nil {
+		VivianServerLogger.LogDebug(fmt.Sprintf("replaced outstanding 2FA key for %v on login", alias))
+	}
+
+	key2FA, err := vivianAuthenticator.GenerateAuthKey2FA(ctx, alias, VivianServerLogger)
+	if err != nil {
+		VivianServerLogger.LogError("unable to generate authentication 2FA", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	channel, err := deliverAuthKey2FA(ctx, alias, key2FA)
+	if err != nil {
+		http.Error(w, "unable to deliver authentication key", http.StatusBadGateway)
+		return
+	}
+
+	pending, err := vivianAuthenticator.BeginPendingLogin(ctx, alias)
+	if err != nil {
+		VivianServerLogger.LogError("unable to begin pending login", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(struct {
+		Status  string `json:"status"`
+		Pending string `json:"pending"`
+		Channel string `json:"channel"`
+	}{"pending_2fa", pending, channel})
+	if err != nil {
+		VivianServerLogger.LogError("failure marshalling results", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+		VivianServerLogger.LogError("failure writing results", err)
+		return
+	}
+	VivianServerLogger.LogSuccess(fmt.Sprintf("password verified for %v, awaiting 2FA", alias))
+}
+
+// issueSession answers a fully authenticated login for alias with a signed
+// access token and the first refresh token of a new session, recording the
+// client that r came from. A login that passed a second factor starts out
+// stepped up. The failed attempts of alias are forgotten only here, once
+// every factor has been passed.
+func issueSession(w http.ResponseWriter, r *http.Request, alias string, verified bool) {
+	if err := vivianAttempts.RecordSuccess(alias); err != nil {
+		VivianServerLogger.LogError("unable to clear failed attempts", err)
+	}
+	session, refresh, err := auth.StartSession(alias, clientIP(r), r.UserAgent())
+	if err != nil {
+		VivianServerLogger.LogError("unable to start session", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if verified {
+		if err := auth.StepUpSession(session.ID); err != nil {
+			VivianServerLogger.LogError("unable to record second factor", err)
+		}
+	}
+	writeTokens(w, r, alias, session.ID, refresh)
+	VivianServerLogger.LogSuccess(fmt.Sprintf("authenticated %v, session %v (%v)", alias, session.ID, session.Device))
+}
+
+// writeTokens issues an access token for alias bound to session sid and
+// answers with it and the given refresh token. Requests made with
+// session=cookie also get the access token as a session cookie, so that a
+// browser can go on to the authorization endpoint.
+func writeTokens(w http.ResponseWriter, r *http.Request, alias, sid, refresh string) {
+	token, claims, err := vivianTokens.Issue(alias, map[string]any{"sid": sid})
+	if err != nil {
+		VivianServerLogger.LogError("unable to issue access token", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("session") == "cookie" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     VIVIAN_SESSION_COOKIE,
+			Value:    token,
+			Path:     "/authorize",
+			Expires:  claims.ExpiresAt,
+			Secure:   strings.HasPrefix(publicURL(), "https://"),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	bytes, err := json.Marshal(struct {
+		Status       string `json:"status"`
+		Alias        string `json:"alias"`
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+	}{"authenticated", alias, token, "Bearer", int64(claims.ExpiresAt.Sub(claims.IssuedAt).Seconds()), refresh})
+	if err != nil {
+		VivianServerLogger.LogError("failure marshalling results", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+		VivianServerLogger.LogError("failure writing results", err)
+		return
+	}
+	VivianServerLogger.LogDebug(fmt.Sprintf("issued access token %v to %v", claims.ID, alias))
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"vivian.infra/internal/pkg/auth"
+)
+
+const (
+	VIVIAN_MAGIC_LINK_COOKIE string = "vivian_magic_link"
+	VIVIAN_MAGIC_LINK_PATH   string = "/login/link"
+
+	MAGIC_LINK_LIMITER_SIZE      uint32        = 3
+	MAGIC_LINK_LIMITER_LEAK_RATE time.Duration = 5 * time.Minute
+)
+
+var (
+	vivianMagicLinks *auth.MagicLinks
+	magicLinkLimiter *Limiter
+)
+
+// initMagicLinks enables passwordless login when VIVIAN_MAGIC_LINKS is true,
+// returning nil otherwise. Links are signed with VIVIAN_MAGIC_LINK_SECRET,
+// or a generated secret that does not survive a restart.
+func initMagicLinks() (*auth.MagicLinks, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("VIVIAN_MAGIC_LINKS")); !enabled {
+		return nil, nil
+	}
+
+	var key *auth.SigningKey
+	var err error
+	if secret := os.Getenv("VIVIAN_MAGIC_LINK_SECRET"); len(secret) > 0 {
+		key, err = auth.NewHS256Key([]byte(secret))
+	} else {
+		VivianServerLogger.LogWarning("no magic link secret configured, generating one")
+		key, err = auth.GenerateSigningKey(auth.TOKEN_ALG_HS256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lifetime, _ := time.ParseDuration(os.Getenv("VIVIAN_MAGIC_LINK_LIFETIME"))
+	return auth.NewMagicLinks(key, lifetime)
+}
+
+// requestMagicLink emails alias a login link and binds it to the requesting
+// browser with a nonce cookie. Requests are limited per alias and client
+// address, so that one address cannot use up the links of an alias for
+// everyone else, and a link is not replaced within its first minute. Beyond
+// that the answer is the same whether or not the alias exists, and the
+// lookup and delivery happen after it has been written.
+func requestMagicLink(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*RequestChannelCounter++
+		*RequestChannel <- 1
+
+		alias := routeAlias(r)
+		ip := clientIP(r)
+		if !magicLinkLimiter.Allow(alias + "@" + ip) {
+			VivianServerLogger.LogWarning(fmt.Sprintf("rate limited login links for %v from %v", alias, ip))
+			w.Header().Set("Retry-After", strconv.Itoa(int(MAGIC_LINK_LIMITER_LEAK_RATE.Seconds())))
+			http.Error(w, "too many login links requested", http.StatusTooManyRequests)
+			return
+		}
+
+		token, nonce, err := vivianMagicLinks.Issue(alias)
+		var recent *auth.RecentMagicLinkError
+		if errors.As(err, &recent) {
+			VivianServerLogger.LogDebug(fmt.Sprintf("kept the recent login link of %v requested again from %v", alias, ip))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(recent.RetryAfter.Seconds()))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			VivianServerLogger.LogError("unable to issue login link", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     VIVIAN_MAGIC_LINK_COOKIE,
+			Value:    nonce,
+			Path:     VIVIAN_MAGIC_LINK_PATH,
+			MaxAge:   int(vivianMagicLinks.Lifetime().Seconds()),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(publicURL(), "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+		w.WriteHeader(http.StatusAccepted)
+
+		go sendMagicLink(ctx, alias, token)
+	})
+}
+
+func sendMagicLink(ctx context.Context, alias, token string) {
+	account, err := VivianDatabase.FetchAccount(alias)
+	if err != nil || !account.Active() || len(account.Email) <= 0 {
+		VivianServerLogger.LogDebug(fmt.Sprintf("login link requested for %v, which cannot receive one", alias))
+		return
+	}
+
+	link := publicURL() + VIVIAN_MAGIC_LINK_PATH + "?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("sign in to %v: %v\nthe link works once, within %v, and only in the browser it was requested from. if you did not ask for this, ignore this message.",
+		alias, link, vivianMagicLinks.Lifetime())
+	if err := deliverAccountMessage(ctx, alias, account.Email, "your vivian.infra login link", body); err != nil {
+		return
+	}
+	VivianServerLogger.LogSuccess(fmt.Sprintf("sent login link to %v", alias))
+}
+
+// redeemMagicLink logs in the alias a link was issued to, provided it is
+// opened in the browser holding the nonce cookie. Accounts with 2FA still
+// have to verify a key, as after a password.
+func redeemMagicLink() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*RequestChannelCounter++
+		*RequestChannel <- 1
+
+		nonce := ""
+		if cookie, err := r.Cookie(VIVIAN_MAGIC_LINK_COOKIE); err == nil {
+			nonce = cookie.Value
+		}
+		alias, err := vivianMagicLinks.Redeem(strings.TrimSpace(r.URL.Query().Get("token")), nonce)
+		if err != nil {
+			VivianServerLogger.LogWarning(fmt.Sprintf("rejected login link from %v: %v", clientIP(r), err))
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: VIVIAN_MAGIC_LINK_COOKIE, Path: VIVIAN_MAGIC_LINK_PATH, MaxAge: -1})
+
+		account, err := VivianDatabase.FetchAccount(alias)
+		if err != nil {
+			VivianServerLogger.LogWarning(fmt.Sprintf("login link redeemed for unknown alias %v", alias))
+			http.Error(w, auth.ErrInvalidMagicLink.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !account.Active() {
+			http.Error(w, "email address has not been verified", http.StatusForbidden)
+			return
+		}
+
+		if !account.TwoFactorEnabled {
+			issueSession(w, r, alias, false)
+			return
+		}
+		beginPendingLogin(w, r.Context(), alias)
+	})
+}
@@ -0,0 +1,188 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"vivian.infra/internal/pkg/oauth"
+)
+
+var vivianOAuth *oauth.Server
+
+func registerOAuthClient() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+
+		var metadata struct {
+			Name         string   `json:"client_name"`
+			RedirectURIs []string `json:"redirect_uris"`
+			Scopes       []string `json:"scopes"`
+			Confidential bool     `json:"confidential"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, VIVIAN_MAX_BODY_SIZE)
+		if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+			writeOAuthError(w, &oauth.Error{Code: "invalid_client_metadata", Description: "malformed registration request"}, http.StatusBadRequest)
+			return
+		}
+
+		client, secret, oerr := vivianOAuth.RegisterClient(r.Context(), alias, metadata.Name, metadata.RedirectURIs, metadata.Scopes, metadata.Confidential)
+		if oerr != nil {
+			writeOAuthError(w, oerr, http.StatusBadRequest)
+			return
+		}
+
+		bytes, err := json.Marshal(struct {
+			*oauth.Client
+			Secret string `json:"client_secret,omitempty"`
+		}{client, secret})
+		if err != nil {
+			VivianServerLogger.LogError("failure marshalling results", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+			VivianServerLogger.LogError("failure writing results", err)
+			return
+		}
+		VivianServerLogger.LogSuccess(fmt.Sprintf("registered oauth client %v (%v) for %v", client.ID, client.Name, alias))
+	})
+}
+
+// authorizeOAuth handles the authorization endpoint for an authenticated
+// user. A GET without prior consent answers with the consent prompt; the
+// user's decision is POSTed back with the same parameters plus consent.
+// Browsers authenticate with the cookie of a login made with session=cookie.
+func authorizeOAuth() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, &oauth.Error{Code: "invalid_request", Description: "malformed request"}, http.StatusBadRequest)
+			return
+		}
+
+		request, oerr := vivianOAuth.ParseAuthorization(r.Form)
+		if request == nil {
+			writeOAuthError(w, oerr, http.StatusBadRequest)
+			return
+		}
+		if oerr != nil {
+			http.Redirect(w, r, request.ErrorRedirectURL(oerr), http.StatusFound)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			if r.PostForm.Get("consent") != "approve" {
+				VivianServerLogger.LogDebug(fmt.Sprintf("%v denied oauth client %v", alias, request.Client.ID))
+				http.Redirect(w, r, request.ErrorRedirectURL(&oauth.Error{Code: "access_denied", Description: "the user denied the request"}), http.StatusFound)
+				return
+			}
+			vivianOAuth.GrantConsent(alias, request)
+			VivianServerLogger.LogSuccess(fmt.Sprintf("%v granted %v to oauth client %v", alias, request.Scopes, request.Client.ID))
+		} else if !vivianOAuth.HasConsent(alias, request) {
+			writeConsentPrompt(w, request)
+			return
+		}
+
+		code, oerr := vivianOAuth.IssueCode(alias, request)
+		if oerr != nil {
+			http.Redirect(w, r, request.ErrorRedirectURL(oerr), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, request.RedirectURL(url.Values{"code": {code}}), http.StatusFound)
+	})
+}
+
+func writeConsentPrompt(w http.ResponseWriter, request *oauth.AuthorizationRequest) {
+	type scopeDescription struct {
+		Scope       string `json:"scope"`
+		Description string `json:"description"`
+	}
+	scopes := make([]scopeDescription, 0, len(request.Scopes))
+	for _, scope := range request.Scopes {
+		scopes = append(scopes, scopeDescription{scope, oauth.SCOPES[scope]})
+	}
+
+	bytes, err := json.Marshal(struct {
+		ConsentRequired bool               `json:"consent_required"`
+		ClientID        string             `json:"client_id"`
+		ClientName      string             `json:"client_name"`
+		RedirectURI     string             `json:"redirect_uri"`
+		Scopes          []scopeDescription `json:"scopes"`
+	}{true, request.Client.ID, request.Client.Name, request.RedirectURI, scopes})
+	if err != nil {
+		VivianServerLogger.LogError("failure marshalling results", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+		VivianServerLogger.LogError("failure writing results", err)
+		return
+	}
+}
+
+func exchangeOAuthToken() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*RequestChannelCounter++
+		*RequestChannel <- 1
+
+		r.Body = http.MaxBytesReader(w, r.Body, VIVIAN_MAX_BODY_SIZE)
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, &oauth.Error{Code: "invalid_request", Description: "malformed request"}, http.StatusBadRequest)
+			return
+		}
+
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok {
+			clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+		}
+
+		response, oerr := vivianOAuth.Exchange(r.PostForm, clientID, clientSecret)
+		if oerr != nil {
+			VivianServerLogger.LogWarning(fmt.Sprintf("oauth token request from %v for client %v failed: %v", clientIP(r), clientID, oerr))
+			status := http.StatusBadRequest
+			if oerr.Code == "invalid_client" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+VIVIAN_APP_NAME+`"`)
+				status = http.StatusUnauthorized
+			}
+			writeOAuthError(w, oerr, status)
+			return
+		}
+
+		bytes, err := json.Marshal(response)
+		if err != nil {
+			VivianServerLogger.LogError("failure marshalling results", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+			VivianServerLogger.LogError("failure writing results", err)
+			return
+		}
+		VivianServerLogger.LogSuccess(fmt.Sprintf("issued oauth access token to client %v", clientID))
+	})
+}
+
+func writeOAuthError(w http.ResponseWriter, oerr *oauth.Error, status int) {
+	bytes, err := json.Marshal(oerr)
+	if err != nil {
+		VivianServerLogger.LogError("failure marshalling results", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+		VivianServerLogger.LogError("failure writing results", err)
+		return
+	}
+}
@@ -0,0 +1,181 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"vivian.infra/database"
+	"vivian.infra/internal/pkg/oidc"
+)
+
+const (
+	VIVIAN_OIDC_STATE_COOKIE string = "vivian_oidc_state"
+	VIVIAN_OIDC_COOKIE_PATH  string = "/oidc"
+)
+
+var vivianOIDC *oidc.RelyingParty
+
+// initOIDC configures the external identity provider from the environment,
+// returning nil when VIVIAN_OIDC_ISSUER is unset.
+func initOIDC() *oidc.RelyingParty {
+	issuer := os.Getenv("VIVIAN_OIDC_ISSUER")
+	if len(issuer) <= 0 {
+		return nil
+	}
+
+	config := oidc.Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("VIVIAN_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("VIVIAN_OIDC_CLIENT_SECRET"),
+		RedirectURI:  os.Getenv("VIVIAN_OIDC_REDIRECT_URI"),
+	}
+	if scopes := os.Getenv("VIVIAN_OIDC_SCOPES"); len(scopes) > 0 {
+		config.Scopes = strings.Fields(scopes)
+	}
+	return oidc.NewRelyingParty(config, nil)
+}
+
+// beginOIDCLogin sends the browser to the identity provider to sign in with
+// an already linked identity.
+func beginOIDCLogin() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirect, state, err := vivianOIDC.AuthCodeURL(r.Context(), "")
+		if err != nil {
+			VivianServerLogger.LogError("unable to start oidc login", err)
+			http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+			return
+		}
+		setOIDCStateCookie(w, state)
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+}
+
+// beginOIDCLink starts the same flow for an authenticated user, so that the
+// identity returned is linked to their alias. It is called from script with
+// a bearer token, so the provider URL is returned rather than redirected to,
+// and no state cookie is set: the browser that later opens the URL never saw
+// this response. The state is bound to the alias by the relying party.
+func beginOIDCLink() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+
+		redirect, _, err := vivianOIDC.AuthCodeURL(r.Context(), alias)
+		if err != nil {
+			VivianServerLogger.LogError("unable to start oidc link", err)
+			http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+			return
+		}
+
+		bytes, err := json.Marshal(struct {
+			AuthorizationURL string `json:"authorization_url"`
+		}{redirect})
+		if err != nil {
+			VivianServerLogger.LogError("failure marshalling results", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+			VivianServerLogger.LogError("failure writing results", err)
+			return
+		}
+	})
+}
+
+// completeOIDCLogin handles the provider's redirect back. The state of a
+// login must match the cookie set when it began, so a callback cannot be
+// replayed into another user's browser; the state of a link is already
+// bound to the alias that started it. Depending on how the flow began, the verified
+// identity is either linked to an alias or used to sign in as its linked
+// alias, subject to that account's 2FA.
+func completeOIDCLogin() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		state := query.Get("state")
+
+		cookie, err := r.Cookie(VIVIAN_OIDC_STATE_COOKIE)
+		http.SetCookie(w, &http.Cookie{Name: VIVIAN_OIDC_STATE_COOKIE, Path: VIVIAN_OIDC_COOKIE_PATH, MaxAge: -1})
+		linking := len(state) > 0 && len(vivianOIDC.LinkAlias(state)) > 0
+		if len(state) <= 0 || (!linking && (err != nil || cookie.Value != state)) {
+			VivianServerLogger.LogWarning(fmt.Sprintf("oidc callback with mismatched state from %v", clientIP(r)))
+			http.Error(w, "invalid login state", http.StatusBadRequest)
+			return
+		}
+		if providerError := query.Get("error"); len(providerError) > 0 {
+			VivianServerLogger.LogWarning(fmt.Sprintf("identity provider refused login: %v %v", providerError, query.Get("error_description")))
+			http.Error(w, "login was refused by the identity provider", http.StatusUnauthorized)
+			return
+		}
+
+		claims, linkAlias, err := vivianOIDC.Exchange(r.Context(), state, query.Get("code"))
+		if err != nil {
+			VivianServerLogger.LogWarning(fmt.Sprintf("oidc login failed from %v: %v", clientIP(r), err))
+			http.Error(w, "unable to verify identity", http.StatusUnauthorized)
+			return
+		}
+
+		if len(linkAlias) > 0 {
+			if err := VivianDatabase.LinkIdentity(claims.Issuer, claims.Subject, linkAlias); err != nil {
+				if errors.Is(err, database.ErrIdentityLinked) {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				VivianServerLogger.LogError("unable to link identity", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			VivianServerLogger.LogSuccess(fmt.Sprintf("linked %v subject %v to %v", claims.Issuer, claims.Subject, linkAlias))
+
+			bytes, err := json.Marshal(struct {
+				Status  string `json:"status"`
+				Alias   string `json:"alias"`
+				Subject string `json:"subject"`
+			}{"linked", linkAlias, claims.Subject})
+			if err != nil {
+				VivianServerLogger.LogError("failure marshalling results", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+				VivianServerLogger.LogError("failure writing results", err)
+			}
+			return
+		}
+
+		account, err := VivianDatabase.FetchLinkedAccount(claims.Issuer, claims.Subject)
+		if err != nil {
+			VivianServerLogger.LogWarning(fmt.Sprintf("oidc login for unlinked %v subject %v", claims.Issuer, claims.Subject))
+			http.Error(w, "no account is linked to this identity", http.StatusForbidden)
+			return
+		}
+		if !account.Active() {
+			VivianServerLogger.LogWarning(fmt.Sprintf("oidc login for unverified %v", account.Alias))
+			http.Error(w, "email address has not been verified", http.StatusForbidden)
+			return
+		}
+
+		if !account.TwoFactorEnabled {
+			issueSession(w, r, account.Alias, false)
+			return
+		}
+		beginPendingLogin(w, r.Context(), account.Alias)
+	})
+}
+
+func setOIDCStateCookie(w http.ResponseWriter, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     VIVIAN_OIDC_STATE_COOKIE,
+		Value:    state,
+		Path:     VIVIAN_OIDC_COOKIE_PATH,
+		MaxAge:   int(oidc.OIDC_STATE_LIFETIME.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(publicURL(), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,248 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"vivian.infra/database"
+	"vivian.infra/internal/pkg/auth"
+	"vivian.infra/internal/pkg/notify"
+	"vivian.infra/models"
+)
+
+// VIVIAN_RESERVED_ALIASES would shadow or be shadowed by top level routes.
+var VIVIAN_RESERVED_ALIASES = map[string]bool{
+	"accounts":    true,
+	"authorize":   true,
+	"clients":     true,
+	"oidc":        true,
+	"socketcalls": true,
+	"sockettime":  true,
+	"token":       true,
+}
+
+// passwordAccepted applies the password policy and, if password breaks it,
+// answers with every violation so that clients can show them all at once.
+func passwordAccepted(w http.ResponseWriter, password, alias, email string) bool {
+	violations, err := auth.CheckPassword(password, alias, email)
+	if err != nil {
+		VivianServerLogger.LogError("unable to check breach corpus", err)
+	}
+	if len(violations) <= 0 {
+		return true
+	}
+
+	bytes, err := json.Marshal(struct {
+		Error      string                 `json:"error"`
+		Violations []auth.PolicyViolation `json:"violations"`
+	}{"password_policy", violations})
+	if err != nil {
+		VivianServerLogger.LogError("failure marshalling results", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+		VivianServerLogger.LogError("failure writing results", err)
+	}
+	return false
+}
+
+// PENDING_ACCOUNT_GRACE is waited beyond VERIFY_EMAIL_LIFETIME before a
+// pending account is removed, since its verification token is issued just
+// after the account is created and so outlives it slightly.
+const PENDING_ACCOUNT_GRACE time.Duration = time.Minute
+
+// publicURL is the externally reachable base of the server, used in links
+// that are emailed out.
+func publicURL() string {
+	if base := os.Getenv("VIVIAN_PUBLIC_URL"); len(base) > 0 {
+		return strings.TrimSuffix(base, "/")
+	}
+	return "http://localhost" + VIVIAN_HOST_ADDR
+}
+
+// registerAccount creates a pending account and emails a verification link.
+// Registering with an address that already has an account sends that address
+// a notice instead and answers exactly as if it had worked, so the endpoint
+// cannot be used to discover who has an account.
+func registerAccount(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*RequestChannelCounter++
+		*RequestChannel <- 1
+
+		var registration struct {
+			Alias    string `json:"alias"`
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, VIVIAN_MAX_BODY_SIZE)
+		if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+			http.Error(w, "malformed registration request", http.StatusBadRequest)
+			return
+		}
+
+		if err := auth.ValidateAlias(registration.Alias); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		registration.Alias = models.NormalizeAlias(registration.Alias)
+		if VIVIAN_RESERVED_ALIASES[registration.Alias] {
+			http.Error(w, "alias is reserved", http.StatusBadRequest)
+			return
+		}
+		if err := auth.ValidateEmail(registration.Email); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !passwordAccepted(w, registration.Password, registration.Alias, registration.Email) {
+			return
+		}
+
+		hash, err := auth.HashKeyphrase(ctx, registration.Password)
+		if err != nil {
+			VivianServerLogger.LogError("unable to hash password", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		account, err := VivianDatabase.CreateAccount(models.Account{
+			Alias:    registration.Alias,
+			Email:    registration.Email,
+			Password: hash,
+			Status:   models.ACCOUNT_STATUS_PENDING,
+		})
+		switch {
+		case errors.Is(err, database.ErrAliasTaken):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, database.ErrEmailTaken):
+			VivianServerLogger.LogWarning(fmt.Sprintf("registration of %v attempted with a registered address", registration.Alias))
+			err = deliverAccountMessage(ctx, registration.Alias, registration.Email, "vivian.infra registration attempt",
+				"someone tried to register a new account with this address. if it was you, log in or reset your password instead.")
+		case err != nil:
+			VivianServerLogger.LogError("unable to create account", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		default:
+			err = sendVerificationEmail(ctx, account)
+		}
+		if err != nil {
+			http.Error(w, "unable to deliver verification email", http.StatusBadGateway)
+			return
+		}
+
+		bytes, err := json.Marshal(struct {
+			Status string `json:"status"`
+			Alias  string `json:"alias"`
+		}{"pending_verification", registration.Alias})
+		if err != nil {
+			VivianServerLogger.LogError("failure marshalling results", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+			VivianServerLogger.LogError("failure writing results", err)
+			return
+		}
+	})
+}
+
+func sendVerificationEmail(ctx context.Context, account models.Account) error {
+	token, err := auth.IssueOneTimeToken(auth.PURPOSE_VERIFY_EMAIL, account.Alias, auth.VERIFY_EMAIL_LIFETIME)
+	if err != nil {
+		VivianServerLogger.LogError("unable to issue verification token", err)
+		return err
+	}
+	link := publicURL() + "/accounts/verify?token=" + url.QueryEscape(token)
+	if err := deliverAccountMessage(ctx, account.Alias, account.Email, "verify your vivian.infra account",
+		fmt.Sprintf("confirm your email address to activate %v: %v", account.Alias, link)); err != nil {
+		return err
+	}
+	VivianServerLogger.LogSuccess(fmt.Sprintf("registered %v, awaiting email verification", account.Alias))
+	return nil
+}
+
+// deliverAccountMessage sends body to address, which has not necessarily
+// been verified, through the notifier of alias.
+func deliverAccountMessage(ctx context.Context, alias, address, subject, body string) error {
+	channel, err := vivianNotifiers.Notify(ctx, notify.Message{Alias: alias, Address: address, Subject: subject, Body: body})
+	if err != nil {
+		VivianServerLogger.LogError("unable to deliver account message", err)
+		return err
+	}
+	VivianServerLogger.LogDebug(fmt.Sprintf("delivered %q for %v via %v", subject, alias, channel))
+	return nil
+}
+
+// verifyAccountEmail redeems a verification token and activates its
+// account.
+func verifyAccountEmail() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, err := auth.RedeemOneTimeToken(auth.PURPOSE_VERIFY_EMAIL, r.URL.Query().Get("token"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = VivianDatabase.ActivateAccount(alias)
+		if errors.Is(err, database.ErrAccountNotFound) {
+			http.Error(w, "verification link has expired, register again", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			VivianServerLogger.LogError("unable to activate account", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		bytes, err := json.Marshal(struct {
+			Status string `json:"status"`
+			Alias  string `json:"alias"`
+		}{models.ACCOUNT_STATUS_ACTIVE, alias})
+		if err != nil {
+			VivianServerLogger.LogError("failure marshalling results", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+			VivianServerLogger.LogError("failure writing results", err)
+			return
+		}
+		VivianServerLogger.LogSuccess(fmt.Sprintf("verified email address of %v", alias))
+	})
+}
+
+// reapPendingAccounts removes accounts that were never verified every
+// interval until ctx is done, so an abandoned registration does not hold its
+// alias and address forever.
+func reapPendingAccounts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			VivianServerLogger.LogDebug("stopping pending account reaper")
+			return
+		case now := <-ticker.C:
+			reaped, err := VivianDatabase.PrunePendingAccounts(now.Add(-(auth.VERIFY_EMAIL_LIFETIME + PENDING_ACCOUNT_GRACE)))
+			if err != nil {
+				VivianServerLogger.LogError("failure reaping pending accounts", err)
+			}
+			for _, alias := range reaped {
+				VivianServerLogger.LogDebug(fmt.Sprintf("reaped unverified account %v", alias))
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package app
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"vivian.infra/database"
+	"vivian.infra/internal/pkg/auth"
+	"vivian.infra/internal/pkg/notify"
+	"vivian.infra/models"
+	"vivian.infra/utils"
+)
+
+const testPassword = "violet-Harbor-93-lantern"
+
+// testOutbox is where the account handlers deliver messages during tests.
+var testOutbox string
+
+// TestMain points the globals the account handlers use at fresh stores once,
+// since messages are delivered in the background after a handler answers.
+// Tests keep apart by using aliases and addresses of their own.
+func TestMain(m *testing.M) {
+	outbox, err := os.MkdirTemp("", "vivian-outbox")
+	if err != nil {
+		log.Fatal(err)
+	}
+	testOutbox = outbox
+
+	VivianServerLogger = &utils.VivianLogger{
+		Logger:       log.New(io.Discard, "", 0),
+		LogFile:      os.DevNull,
+		DeploymentID: "testtesttest",
+	}
+	requests := make(chan uint32, 64)
+	var counter uint32
+	RequestChannel, RequestChannelCounter = &requests, &counter
+	auth.SetPreferredHasher(&auth.BcryptHasher{Cost: 4})
+
+	state := auth.NewMemoryStateStore()
+	VivianDatabase = database.NewAccountStore()
+	vivianAuthenticator = auth.NewChallengeAuthenticator(state, 0)
+	vivianAttempts = auth.NewAttemptTracker(state)
+	resetAddressLimiter = NewLimiter(RESET_LIMITER_ADDRESS_SIZE, BUCKET_LIMITER_LEAK_AMT, RESET_LIMITER_LEAK_RATE)
+	resetIPLimiter = NewLimiter(RESET_LIMITER_IP_SIZE, BUCKET_LIMITER_LEAK_AMT, RESET_LIMITER_LEAK_RATE)
+	vivianNotifiers = notify.NewRegistry(notify.NOTIFY_CHANNEL_OUTBOX)
+	vivianNotifiers.Register(notify.NOTIFY_CHANNEL_OUTBOX, notify.NewOutboxNotifier(outbox))
+
+	code := m.Run()
+	os.RemoveAll(outbox)
+	os.Exit(code)
+}
+
+// awaitMessages waits for count messages to address, some of which are
+// delivered after the response is written, and returns their contents.
+func awaitMessages(t *testing.T, address string, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var messages []string
+		entries, _ := os.ReadDir(filepath.Join(testOutbox, "new"))
+		for _, entry := range entries {
+			bytes, err := os.ReadFile(filepath.Join(testOutbox, "new", entry.Name()))
+			if err != nil {
+				t.Fatalf("read message: %v", err)
+			}
+			if strings.Contains(string(bytes), "<"+address+">") {
+				messages = append(messages, string(bytes))
+			}
+		}
+		if len(messages) >= count {
+			return messages
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v has %v messages, want %v", address, len(messages), count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func serve(handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestRegisterAccount(t *testing.T) {
+	ctx := context.Background()
+	if _, err := VivianDatabase.CreateAccount(models.Account{Alias: "bella", Email: "b@x.io", Password: "unused"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		body    string
+		status  int
+		address string
+	}{
+		{"malformed", `{"alias":`, http.StatusBadRequest, ""},
+		{"invalid alias", `{"alias":"no spaces","email":"n@x.io","password":"` + testPassword + `"}`, http.StatusBadRequest, ""},
+		{"reserved alias", `{"alias":"Accounts","email":"a@x.io","password":"` + testPassword + `"}`, http.StatusBadRequest, ""},
+		{"invalid email", `{"alias":"dana","email":"dana","password":"` + testPassword + `"}`, http.StatusBadRequest, ""},
+		{"weak password", `{"alias":"dana","email":"d@x.io","password":"password"}`, http.StatusBadRequest, ""},
+		{"taken alias", `{"alias":"BELLA","email":"other@x.io","password":"` + testPassword + `"}`, http.StatusConflict, ""},
+		{"registered email", `{"alias":"someone","email":"B@x.io","password":"` + testPassword + `"}`, http.StatusAccepted, "B@x.io"},
+		{"registered", `{"alias":"Dana","email":"d@x.io","password":"` + testPassword + `"}`, http.StatusAccepted, "d@x.io"},
+	}
+	for _, c := range cases {
+		w := serve(registerAccount(ctx), http.MethodPost, "/accounts/register", c.body)
+		if w.Code != c.status {
+			t.Errorf("%v: status = %v, want %v: %v", c.name, w.Code, c.status, w.Body.String())
+		}
+		//the address is told either way, so that registering does not show
+		//whether it already has an account.
+		if len(c.address) > 0 {
+			awaitMessages(t, c.address, 1)
+		}
+	}
+
+	if _, err := VivianDatabase.FetchAccount("someone"); err == nil {
+		t.Errorf("registering a registered address created an account")
+	}
+	account, err := VivianDatabase.FetchAccount("DANA")
+	if err != nil {
+		t.Fatalf("fetch registered account: %v", err)
+	}
+	if account.Alias != "dana" || account.Active() {
+		t.Errorf("registered account = %+v, want pending dana", account)
+	}
+}
+
+func TestVerifyAccountEmail(t *testing.T) {
+	ctx := context.Background()
+
+	w := serve(registerAccount(ctx), http.MethodPost, "/accounts/register", `{"alias":"Flora","email":"f@x.io","password":"`+testPassword+`"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("register: %v %v", w.Code, w.Body.String())
+	}
+	link := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(awaitMessages(t, "f@x.io", 1)[0])
+	if link == nil {
+		t.Fatalf("verification message holds no link")
+	}
+	token, err := url.QueryUnescape(link[1])
+	if err != nil {
+		t.Fatalf("unescape token: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"unknown token", "not-a-token", http.StatusBadRequest},
+		{"verified", token, http.StatusOK},
+		{"redeemed twice", token, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := serve(verifyAccountEmail(), http.MethodGet, "/accounts/verify?token="+url.QueryEscape(c.token), "")
+		if w.Code != c.status {
+			t.Errorf("%v: status = %v, want %v: %v", c.name, w.Code, c.status, w.Body.String())
+		}
+	}
+
+	if account, err := VivianDatabase.FetchAccount("flora"); err != nil || !account.Active() {
+		t.Errorf("account after verification = %+v, %v", account, err)
+	}
+
+	//a token outliving its account, which was reaped meanwhile.
+	orphan, err := auth.IssueOneTimeToken(auth.PURPOSE_VERIFY_EMAIL, "ghost", auth.VERIFY_EMAIL_LIFETIME)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	if w := serve(verifyAccountEmail(), http.MethodGet, "/accounts/verify?token="+url.QueryEscape(orphan), ""); w.Code != http.StatusBadRequest {
+		t.Errorf("token of a removed account: status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,153 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"vivian.infra/internal/pkg/auth"
+)
+
+const (
+	RESET_LIMITER_ADDRESS_SIZE uint32        = 3
+	RESET_LIMITER_IP_SIZE      uint32        = 10
+	RESET_LIMITER_LEAK_RATE    time.Duration = 5 * time.Minute
+)
+
+// resetAddressLimiter and resetIPLimiter bound the reset emails that can be
+// sent to one address, and requested from one client address.
+var resetAddressLimiter, resetIPLimiter *Limiter
+
+// requestPasswordReset emails a reset token to the account registered under
+// the given address. The answer is the same whether or not such an account
+// exists, and the lookup and delivery happen after it has been written so
+// that response times do not tell either. Requests are limited per address
+// and per client, whether or not the address is registered.
+func requestPasswordReset(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*RequestChannelCounter++
+		*RequestChannel <- 1
+
+		var request struct {
+			Email string `json:"email"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, VIVIAN_MAX_BODY_SIZE)
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "malformed reset request", http.StatusBadRequest)
+			return
+		}
+		email := strings.TrimSpace(request.Email)
+
+		ip := clientIP(r)
+		if !resetIPLimiter.Allow(ip) || !resetAddressLimiter.Allow(strings.ToLower(email)) {
+			VivianServerLogger.LogWarning(fmt.Sprintf("rate limited password resets requested from %v", ip))
+			w.Header().Set("Retry-After", strconv.Itoa(int(RESET_LIMITER_LEAK_RATE.Seconds())))
+			http.Error(w, "too many password resets requested", http.StatusTooManyRequests)
+			return
+		}
+
+		bytes, err := json.Marshal(struct {
+			Status string `json:"status"`
+		}{"reset_requested"})
+		if err != nil {
+			VivianServerLogger.LogError("failure marshalling results", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+			VivianServerLogger.LogError("failure writing results", err)
+		}
+
+		go sendPasswordReset(ctx, email)
+	})
+}
+
+func sendPasswordReset(ctx context.Context, email string) {
+	account, err := VivianDatabase.FetchAccountByEmail(email)
+	if err != nil {
+		VivianServerLogger.LogDebug("password reset requested for an unregistered address")
+		return
+	}
+
+	token, err := auth.IssueOneTimeToken(auth.PURPOSE_RESET_PASSWORD, account.Alias, auth.RESET_PASSWORD_LIFETIME)
+	if err != nil {
+		VivianServerLogger.LogError("unable to issue reset token", err)
+		return
+	}
+	body := fmt.Sprintf("a password reset was requested for %v. post this token with your new password to %v/accounts/reset/confirm; it expires in %v and can be used once:\n%v\nif you did not ask for this, ignore this message.",
+		account.Alias, publicURL(), auth.RESET_PASSWORD_LIFETIME, token)
+	if err := deliverAccountMessage(ctx, account.Alias, account.Email, "reset your vivian.infra password", body); err != nil {
+		return
+	}
+	VivianServerLogger.LogSuccess(fmt.Sprintf("sent password reset for %v", account.Alias))
+}
+
+// confirmPasswordReset redeems a reset token, sets the new password and
+// ends every session of the account.
+func confirmPasswordReset(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*RequestChannelCounter++
+		*RequestChannel <- 1
+
+		var request struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, VIVIAN_MAX_BODY_SIZE)
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "malformed reset request", http.StatusBadRequest)
+			return
+		}
+
+		//the policy is checked before the token is redeemed so that a
+		//rejected password does not use it up.
+		alias, err := auth.PeekOneTimeToken(auth.PURPOSE_RESET_PASSWORD, request.Token)
+		if err != nil {
+			VivianServerLogger.LogWarning(fmt.Sprintf("invalid password reset token from %v", clientIP(r)))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		account, err := VivianDatabase.FetchAccount(alias)
+		if err != nil {
+			http.Error(w, auth.ErrInvalidOneTimeToken.Error(), http.StatusBadRequest)
+			return
+		}
+		if !passwordAccepted(w, request.Password, alias, account.Email) {
+			return
+		}
+		if _, err := auth.RedeemOneTimeToken(auth.PURPOSE_RESET_PASSWORD, request.Token); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hash, err := auth.HashKeyphrase(ctx, request.Password)
+		if err != nil {
+			VivianServerLogger.LogError("unable to hash password", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := VivianDatabase.ResetPassword(alias, hash); err != nil {
+			VivianServerLogger.LogError("unable to reset password", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		revoked := auth.RevokeSessions(alias)
+		vivianAttempts.RecordSuccess(alias)
+		if err := vivianAuthenticator.ExpireAuthentication2FA(ctx, alias, VivianServerLogger); err == nil {
+			VivianServerLogger.LogDebug(fmt.Sprintf("expired outstanding 2FA key for %v on password reset", alias))
+		}
+		VivianServerLogger.LogSuccess(fmt.Sprintf("reset password of %v, revoked %v sessions", alias, revoked))
+
+		go deliverAccountMessage(ctx, alias, account.Email, "your vivian.infra password was changed",
+			"the password of "+alias+" was just reset and every session was signed out.")
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"vivian.infra/internal/pkg/auth"
+	"vivian.infra/models"
+)
+
+func TestRequestPasswordResetIsLimitedPerAddress(t *testing.T) {
+	ctx := context.Background()
+
+	for i, email := range []string{"n@x.io", "N@x.io", " n@X.io", "N@X.IO"} {
+		want := http.StatusAccepted
+		if i >= int(RESET_LIMITER_ADDRESS_SIZE) {
+			want = http.StatusTooManyRequests
+		}
+		w := serve(requestPasswordReset(ctx), http.MethodPost, "/accounts/reset", `{"email":"`+email+`"}`)
+		if w.Code != want {
+			t.Errorf("request %v for %q: status = %v, want %v", i, email, w.Code, want)
+		}
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	ctx := context.Background()
+	hash, err := auth.HashKeyphrase(ctx, "hunter2")
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	if _, err := VivianDatabase.CreateAccount(models.Account{Alias: "Gale", Email: "g@x.io", Password: hash, Status: models.ACCOUNT_STATUS_PENDING}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, _, err := auth.StartSession("gale", "192.0.2.1", "test"); err != nil {
+		t.Fatalf("start session: %v", err)
+	}
+
+	w := serve(requestPasswordReset(ctx), http.MethodPost, "/accounts/reset", `{"email":"G@x.io"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("request: status = %v: %v", w.Code, w.Body.String())
+	}
+	token := regexp.MustCompile(`(?m)^(\S+)\nif you did not`).FindStringSubmatch(awaitMessages(t, "g@x.io", 1)[0])
+	if token == nil {
+		t.Fatalf("reset message holds no token")
+	}
+
+	cases := []struct {
+		name     string
+		token    string
+		password string
+		status   int
+	}{
+		{"unknown token", "not-a-token", testPassword, http.StatusBadRequest},
+		{"weak password", token[1], "password", http.StatusBadRequest},
+		{"reset", token[1], testPassword, http.StatusNoContent},
+		{"redeemed twice", token[1], testPassword, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := serve(confirmPasswordReset(ctx), http.MethodPost, "/accounts/reset/confirm", `{"token":"`+c.token+`","password":"`+c.password+`"}`)
+		if w.Code != c.status {
+			t.Errorf("%v: status = %v, want %v: %v", c.name, w.Code, c.status, w.Body.String())
+		}
+	}
+	//the notice that the password changed.
+	awaitMessages(t, "g@x.io", 2)
+
+	account, err := VivianDatabase.FetchAccount("gale")
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if !auth.VerfiyHashKeyphrase(account.Password, testPassword) {
+		t.Errorf("new password does not verify")
+	}
+	if !account.Active() || account.PasswordChangedAt.IsZero() {
+		t.Errorf("account after reset = %+v, want active with PasswordChangedAt set", account)
+	}
+	if sessions := auth.ListSessions("gale"); len(sessions) != 0 {
+		t.Errorf("%v sessions survived the reset", len(sessions))
+	}
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"vivian.infra/internal/pkg/auth"
+)
+
+// listSessions shows the authenticated alias where it is logged in, marking
+// the session the request itself was made from.
+func listSessions() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+		current, _ := authenticatedSession(r.Context())
+
+		type listedSession struct {
+			auth.Session
+			Current bool `json:"current"`
+		}
+		sessions := []listedSession{}
+		for _, session := range auth.ListSessions(alias) {
+			sessions = append(sessions, listedSession{session, session.ID == current})
+		}
+
+		bytes, err := json.Marshal(sessions)
+		if err != nil {
+			VivianServerLogger.LogError("failure marshalling results", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := fmt.Fprintln(w, string(bytes)); err != nil {
+			VivianServerLogger.LogError("failure writing results", err)
+			return
+		}
+	})
+}
+
+func revokeSession() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+		id := mux.Vars(r)["id"]
+
+		if err := auth.RevokeSession(alias, id); err != nil {
+			if errors.Is(err, auth.ErrSessionNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			VivianServerLogger.LogError("unable to revoke session", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		VivianServerLogger.LogSuccess(fmt.Sprintf("revoked session %v of %v", id, alias))
+	})
+}
+
+// revokeAllSessions logs the alias out everywhere, including the session
+// making the request.
+func revokeAllSessions() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alias, _ := AuthenticatedAlias(r.Context())
+
+		revoked := auth.RevokeSessions(alias)
+		w.WriteHeader(http.StatusNoContent)
+		VivianServerLogger.LogSuccess(fmt.Sprintf("logged %v out everywhere, revoked %v sessions", alias, revoked))
+	})
+}
+
+// stepUpSession verifies a fresh second factor for the session making the
+// request, satisfying requireStepUp on its routes for their maximum auth
+// age. The factor is the emailed key unless the request names an enrolled
+// TOTP or HOTP factor instead.
+func stepUpSession(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*RequestChannelCounter++
+		*RequestChannel <- 1
+
+		alias, _ := AuthenticatedAlias(r.Context())
+		sid, ok := authenticatedSession(r.Context())
+		if !ok {
+			http.Error(w, "step-up requires a login session", http.StatusForbidden)
+			return
+		}
+		ip := clientIP(r)
+
+		var request struct {
+			Key    string `json:"key"`
+			Factor string `json:"factor"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, VIVIAN_MAX_BODY_SIZE)
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "malformed step-up request", http.StatusBadRequest)
+			return
+		}
+
+		var authenticator auth.Authenticator2FA = vivianAuthenticator
+		switch request.Factor {
+		case "":
+		case FACTOR_TOTP, FACTOR_HOTP:
+			authenticator = vivianFactors[request.Factor]
+		default:
+			http.Error(w, fmt.Sprintf("%q cannot be used to step up", request.Factor), http.StatusBadRequest)
+			return
+		}
+
+		if lockedOut(w, alias, ip) {
+			return
+		}
+		if _, err := authenticator.VerifyAuthKey2FA(ctx, alias, request.Key, VivianServerLogger); err != nil {
+			switch {
+			case errors.Is(err, auth.ErrKeyExpired):
+				http.Error(w, err.Error(), http.StatusGone)
+			case errors.Is(err, auth.ErrInvalidKey) || invalidCode(err):
+				if recordFailure(w, ctx, alias, ip) {
+					return
+				}
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			default:
+				http.Error(w, err.Error(), http.StatusConflict)
+			}
+			return
+		}
+		vivianAttempts.RecordSuccess(alias)
+
+		if err := auth.StepUpSession(sid); err != nil {
+			VivianServerLogger.LogError("unable to record step-up", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		VivianServerLogger.LogSuccess(fmt.Sprintf("stepped up session %v of %v", sid, alias))
+	})
+}
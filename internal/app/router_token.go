@@ -0,0 +1,43 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"vivian.infra/internal/pkg/auth"
+)
+
+func refreshAccessToken() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*RequestChannelCounter++
+		*RequestChannel <- 1
+
+		var request struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, VIVIAN_MAX_BODY_SIZE)
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.RefreshToken) <= 0 {
+			http.Error(w, "malformed refresh request", http.StatusBadRequest)
+			return
+		}
+
+		alias, family, refresh, err := auth.RotateRefreshToken(request.RefreshToken)
+		if err != nil {
+			if errors.Is(err, auth.ErrRefreshTokenReused) {
+				VivianServerLogger.LogWarning(fmt.Sprintf("refresh token reuse for %v from %v, revoked family %v", alias, clientIP(r), family))
+			} else {
+				VivianServerLogger.LogDebug(fmt.Sprintf("rejected refresh token from %v: %v", clientIP(r), err))
+			}
+			http.Error(w, auth.ErrInvalidRefreshToken.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if err := auth.TouchSession(family, clientIP(r)); err != nil {
+			http.Error(w, auth.ErrInvalidRefreshToken.Error(), http.StatusUnauthorized)
+			return
+		}
+		writeTokens(w, r, alias, family, refresh)
+	})
+}
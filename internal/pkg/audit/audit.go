@@ -0,0 +1,280 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_RESULT_SUCCESS string = "success"
+	AUDIT_RESULT_DENIED  string = "denied"
+	AUDIT_RESULT_LOCKED  string = "locked"
+	AUDIT_RESULT_ERROR   string = "error"
+
+	AUDIT_MAX_LINE int = 1 << 20
+	AUDIT_KEY_SIZE int = 32
+)
+
+// AUDIT_GENESIS is the previous hash of the first entry in a log.
+var AUDIT_GENESIS = hex.EncodeToString(make([]byte, sha256.Size))
+
+// Entry is one security event. Hash covers every other field, including
+// the hash of the entry before it, so changing, inserting, reordering or
+// removing a line breaks the chain from that point on. The chain alone
+// cannot tell that lines were cut off the end, nor, unless it is keyed,
+// that it was rewritten and recomputed from some point on; comparing it
+// against an exported Checkpoint catches both.
+type Entry struct {
+	Sequence     uint64    `json:"seq"`
+	Time         time.Time `json:"time"`
+	DeploymentID string    `json:"deployment_id"`
+	Actor        string    `json:"actor"`
+	Alias        string    `json:"alias"`
+	Action       string    `json:"action"`
+	Result       string    `json:"result"`
+	IP           string    `json:"ip"`
+	Detail       string    `json:"detail,omitempty"`
+	Previous     string    `json:"prev"`
+	Hash         string    `json:"hash"`
+}
+
+// digest hashes every field but Hash with SHA-256, or with HMAC-SHA256
+// under key if one is given, so that the chain cannot be recomputed by
+// anyone who does not hold the key.
+func (e Entry) digest(key []byte) (string, error) {
+	e.Hash = ""
+	canonical, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	if len(key) <= 0 {
+		sum := sha256.Sum256(canonical)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(canonical)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Checkpoint is the head of a chain at some point. Kept outside the log, it
+// proves that the log still reaches at least that far, unchanged.
+type Checkpoint struct {
+	Sequence uint64
+	Hash     string
+}
+
+func (c Checkpoint) String() string {
+	return fmt.Sprintf("%d:%v", c.Sequence, c.Hash)
+}
+
+// ParseCheckpoint reads a checkpoint in the form written by String.
+func ParseCheckpoint(value string) (Checkpoint, error) {
+	sequence, hash, ok := strings.Cut(value, ":")
+	parsed, err := strconv.ParseUint(sequence, 10, 64)
+	if !ok || err != nil || parsed == 0 || len(hash) != hex.EncodedLen(sha256.Size) {
+		return Checkpoint{}, fmt.Errorf("checkpoint %q is not of the form sequence:hash", value)
+	}
+	return Checkpoint{Sequence: parsed, Hash: hash}, nil
+}
+
+// Log appends entries to a file that is only ever opened for appending.
+type Log struct {
+	mu           sync.Mutex
+	file         *os.File
+	deploymentID string
+	key          []byte
+	sequence     uint64
+	previous     string
+	discarded    int64
+}
+
+// Open continues the chain in path, creating the file if needed. A key
+// turns the chain into one of HMACs; a log cannot switch between keyed and
+// unkeyed, or change key, without starting a new file. The existing chain
+// is verified first: appending to a broken chain would make the break look
+// like it happened later than it did. A final line left incomplete by a
+// crash is the one break that is repaired, by cutting it off; Discarded
+// reports how much was cut.
+func Open(path, deploymentID string, key []byte) (*Log, error) {
+	if len(key) > 0 && len(key) < AUDIT_KEY_SIZE {
+		return nil, fmt.Errorf("audit key must be at least %d bytes", AUDIT_KEY_SIZE)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	complete, size, err := completeLines(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	last, err := Verify(io.NewSectionReader(file, 0, complete), key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if complete < size {
+		if err := file.Truncate(complete); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	log := &Log{file: file, deploymentID: deploymentID, key: key, previous: AUDIT_GENESIS, discarded: size - complete}
+	if last != nil {
+		log.sequence, log.previous = last.Sequence, last.Hash
+	}
+	return log, nil
+}
+
+// completeLines returns the length of file up to the end of its last
+// newline, and its full size.
+func completeLines(file *os.File) (int64, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := info.Size()
+
+	tail := make([]byte, min(size, int64(AUDIT_MAX_LINE)+1))
+	if _, err := file.ReadAt(tail, size-int64(len(tail))); err != nil && !errors.Is(err, io.EOF) {
+		return 0, 0, err
+	}
+	end := bytes.LastIndexByte(tail, '\n')
+	if end < 0 && int64(len(tail)) < size {
+		return 0, 0, &ChainError{Line: 0, Reason: "final line is longer than any entry"}
+	}
+	return size - int64(len(tail)) + int64(end) + 1, size, nil
+}
+
+// Discarded returns the number of bytes of an incomplete final line that
+// Open cut off.
+func (l *Log) Discarded() int64 {
+	return l.discarded
+}
+
+// Head returns the checkpoint of the last entry recorded.
+func (l *Log) Head() Checkpoint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Checkpoint{Sequence: l.sequence, Hash: l.previous}
+}
+
+// Record appends entry, filling in its sequence, time, deployment and chain
+// fields, and syncs it to disk before returning the new head.
+func (l *Log) Record(entry Entry) (Checkpoint, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Sequence = l.sequence + 1
+	entry.Time = time.Now().UTC()
+	entry.DeploymentID = l.deploymentID
+	entry.Previous = l.previous
+	hash, err := entry.digest(l.key)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	entry.Hash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return Checkpoint{}, err
+	}
+	if err := l.file.Sync(); err != nil {
+		return Checkpoint{}, err
+	}
+	l.sequence, l.previous = entry.Sequence, entry.Hash
+	return Checkpoint{Sequence: entry.Sequence, Hash: entry.Hash}, nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// ChainError locates the first entry that does not follow from the ones
+// before it.
+type ChainError struct {
+	Line   int
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit chain broken at line %d: %v", e.Line, e.Reason)
+}
+
+// Verify walks the chain in r, hashed under key if it is keyed, and returns
+// its last entry, or nil for an empty log. Any malformed, edited, reordered
+// or missing entry yields a *ChainError, as does a log that does not hold
+// the entry of every checkpoint.
+func Verify(r io.Reader, key []byte, checkpoints ...Checkpoint) (*Entry, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), AUDIT_MAX_LINE)
+
+	var last *Entry
+	previous, sequence := AUDIT_GENESIS, uint64(0)
+	for line := 1; scanner.Scan(); line++ {
+		var entry Entry
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&entry); err != nil {
+			return last, &ChainError{Line: line, Reason: "malformed entry"}
+		}
+		if entry.Sequence != sequence+1 {
+			return last, &ChainError{Line: line, Reason: fmt.Sprintf("expected sequence %d, found %d", sequence+1, entry.Sequence)}
+		}
+		if entry.Previous != previous {
+			return last, &ChainError{Line: line, Reason: "previous hash does not match the entry before"}
+		}
+		hash, err := entry.digest(key)
+		if err != nil {
+			return last, err
+		}
+		if hash != entry.Hash {
+			return last, &ChainError{Line: line, Reason: "entry hash does not match its contents"}
+		}
+		for _, checkpoint := range checkpoints {
+			if checkpoint.Sequence == entry.Sequence && checkpoint.Hash != entry.Hash {
+				return last, &ChainError{Line: line, Reason: fmt.Sprintf("entry does not match checkpoint %v", checkpoint)}
+			}
+		}
+		previous, sequence = entry.Hash, entry.Sequence
+		last = &entry
+	}
+	if err := scanner.Err(); err != nil {
+		return last, err
+	}
+	for _, checkpoint := range checkpoints {
+		if checkpoint.Sequence > sequence {
+			return last, &ChainError{Line: int(sequence) + 1, Reason: fmt.Sprintf("log ends before checkpoint %v", checkpoint)}
+		}
+	}
+	return last, nil
+}
+
+// VerifyFile runs Verify over the log at path.
+func VerifyFile(path string, key []byte, checkpoints ...Checkpoint) (*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Verify(file, key, checkpoints...)
+}
@@ -0,0 +1,218 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte(strings.Repeat("k", AUDIT_KEY_SIZE))
+
+// writeLog records count entries in a new log and returns its path and the
+// checkpoint of every entry.
+func writeLog(t *testing.T, key []byte, count int) (string, []Checkpoint) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Open(path, "testtesttest", key)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer log.Close()
+
+	var heads []Checkpoint
+	for i := 0; i < count; i++ {
+		head, err := log.Record(Entry{Actor: "bella", Alias: "bella", Action: "login", Result: AUDIT_RESULT_SUCCESS, IP: "127.0.0.1"})
+		if err != nil {
+			t.Fatalf("record: %v", err)
+		}
+		heads = append(heads, head)
+	}
+	return path, heads
+}
+
+func readLines(t *testing.T, path string) [][]byte {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return bytes.SplitAfter(contents, []byte("\n"))
+}
+
+func writeLines(t *testing.T, path string, lines [][]byte) {
+	if err := os.WriteFile(path, bytes.Join(lines, nil), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+// recompute rewrites the chain from the entry at index on, hashed under
+// key, as someone who edited it would.
+func recompute(t *testing.T, lines [][]byte, index int, key []byte, edit func(*Entry)) [][]byte {
+	previous := AUDIT_GENESIS
+	if index > 0 {
+		var before Entry
+		if err := json.Unmarshal(lines[index-1], &before); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		previous = before.Hash
+	}
+	for i := index; i < len(lines) && len(lines[i]) > 0; i++ {
+		var entry Entry
+		if err := json.Unmarshal(lines[i], &entry); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if i == index {
+			edit(&entry)
+		}
+		entry.Previous = previous
+		hash, err := entry.digest(key)
+		if err != nil {
+			t.Fatalf("digest: %v", err)
+		}
+		entry.Hash, previous = hash, hash
+		line, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		lines[i] = append(line, '\n')
+	}
+	return lines
+}
+
+func TestAuditChainVerifies(t *testing.T) {
+	path, heads := writeLog(t, testKey, 5)
+	last, err := VerifyFile(path, testKey, heads[1], heads[4])
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if last.Sequence != 5 || last.Hash != heads[4].Hash {
+		t.Errorf("last entry %+v, want head %v", last, heads[4])
+	}
+
+	// the chain continues across reopening
+	log, err := Open(path, "testtesttest", testKey)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	head, err := log.Record(Entry{Action: "login"})
+	log.Close()
+	if err != nil || head.Sequence != 6 {
+		t.Fatalf("record after reopen = %v, %v, want sequence 6", head, err)
+	}
+	if _, err := VerifyFile(path, testKey); err != nil {
+		t.Errorf("verify after reopen: %v", err)
+	}
+}
+
+func TestAuditDetectsEdits(t *testing.T) {
+	cases := map[string]func(lines [][]byte) [][]byte{
+		"edited": func(lines [][]byte) [][]byte {
+			lines[2] = bytes.Replace(lines[2], []byte(`"result":"success"`), []byte(`"result":"denied"`), 1)
+			return lines
+		},
+		"removed": func(lines [][]byte) [][]byte {
+			return append(lines[:2], lines[3:]...)
+		},
+		"reordered": func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		},
+		"recomputed without the key": func(lines [][]byte) [][]byte {
+			return recompute(t, lines, 2, nil, func(entry *Entry) { entry.Actor = "ethan" })
+		},
+		"recomputed under another key": func(lines [][]byte) [][]byte {
+			return recompute(t, lines, 2, []byte(strings.Repeat("x", AUDIT_KEY_SIZE)), func(entry *Entry) { entry.Actor = "ethan" })
+		},
+	}
+	for name, tamper := range cases {
+		path, _ := writeLog(t, testKey, 5)
+		writeLines(t, path, tamper(readLines(t, path)))
+
+		var chain *ChainError
+		if _, err := VerifyFile(path, testKey); !errors.As(err, &chain) {
+			t.Errorf("%v: verify = %v, want a *ChainError", name, err)
+		}
+		if _, err := Open(path, "testtesttest", testKey); err == nil {
+			t.Errorf("%v: opened a tampered log", name)
+		}
+	}
+}
+
+func TestAuditCheckpointsDetectTruncationAndRecomputation(t *testing.T) {
+	path, heads := writeLog(t, nil, 5)
+	lines := readLines(t, path)
+
+	// cutting entries off the end leaves a valid chain
+	writeLines(t, path, lines[:3])
+	if _, err := VerifyFile(path, nil); err != nil {
+		t.Fatalf("truncated chain without checkpoints: %v", err)
+	}
+	var chain *ChainError
+	if _, err := VerifyFile(path, nil, heads[4]); !errors.As(err, &chain) {
+		t.Errorf("truncated past a checkpoint: verify = %v, want a *ChainError", err)
+	}
+
+	// so does recomputing an unkeyed chain
+	writeLines(t, path, recompute(t, readLines(t, path), 1, nil, func(entry *Entry) { entry.Actor = "ethan" }))
+	if _, err := VerifyFile(path, nil); err != nil {
+		t.Fatalf("recomputed chain without checkpoints: %v", err)
+	}
+	if _, err := VerifyFile(path, nil, heads[1]); !errors.As(err, &chain) {
+		t.Errorf("recomputed past a checkpoint: verify = %v, want a *ChainError", err)
+	}
+}
+
+func TestAuditOpenCutsTornFinalLine(t *testing.T) {
+	path, heads := writeLog(t, testKey, 3)
+	lines := readLines(t, path)
+	torn := lines[2][:len(lines[2])/2]
+	writeLines(t, path, append(lines[:2], torn))
+
+	log, err := Open(path, "testtesttest", testKey)
+	if err != nil {
+		t.Fatalf("open with a torn final line: %v", err)
+	}
+	if log.Discarded() != int64(len(torn)) {
+		t.Errorf("discarded %v bytes, want %v", log.Discarded(), len(torn))
+	}
+	if head := log.Head(); head != heads[1] {
+		t.Errorf("head after repair %v, want %v", head, heads[1])
+	}
+	if _, err := log.Record(Entry{Action: "login"}); err != nil {
+		t.Fatalf("record after repair: %v", err)
+	}
+	log.Close()
+	if last, err := VerifyFile(path, testKey); err != nil || last.Sequence != 3 {
+		t.Errorf("verify after repair = %v, %v, want 3 entries", last, err)
+	}
+
+	// only the final line may be incomplete
+	path, _ = writeLog(t, testKey, 3)
+	lines = readLines(t, path)
+	lines[1] = append(lines[1][:len(lines[1])/2], '\n')
+	writeLines(t, path, lines)
+	if _, err := Open(path, "testtesttest", testKey); err == nil {
+		t.Error("opened a log with a torn line in the middle")
+	}
+}
+
+func TestAuditRejectsShortKey(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "audit.log"), "testtesttest", []byte("short")); err == nil {
+		t.Error("opened a log with a short key")
+	}
+}
+
+func TestParseCheckpoint(t *testing.T) {
+	_, heads := writeLog(t, nil, 1)
+	parsed, err := ParseCheckpoint(heads[0].String())
+	if err != nil || parsed != heads[0] {
+		t.Errorf("parse %v = %v, %v", heads[0], parsed, err)
+	}
+	for _, value := range []string{"", "1", "0:" + heads[0].Hash, "x:" + heads[0].Hash, "1:abc"} {
+		if _, err := ParseCheckpoint(value); err == nil {
+			t.Errorf("parsed %q", value)
+		}
+	}
+}
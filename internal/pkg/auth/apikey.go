@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	API_KEY_PREFIX           string        = "viv_"
+	API_KEY_ID_SIZE          int           = 6
+	API_KEY_SECRET_SIZE      int           = 32
+	API_KEY_DEFAULT_LIFETIME time.Duration = 90 * 24 * time.Hour
+	API_KEY_MAX_LIFETIME     time.Duration = 365 * 24 * time.Hour
+
+	API_SCOPE_BUCKET_READ  string = "bucket:read"
+	API_SCOPE_2FA_GENERATE string = "2fa:generate"
+)
+
+// API_KEY_SCOPES lists every scope an API key may be granted.
+var API_KEY_SCOPES = map[string]string{
+	API_SCOPE_BUCKET_READ:  "list the contents of the bucket",
+	API_SCOPE_2FA_GENERATE: "generate and deliver 2FA keys",
+}
+
+var (
+	ErrInvalidAPIKey  = errors.New("invalid api key")
+	ErrAPIKeyNotFound = errors.New("no such api key")
+)
+
+// APIKey is a long-lived credential for scripts acting as one alias. Keys
+// look like viv_<id>_<secret>; the viv_<id> part is the visible prefix shown
+// in listings and logs, while only the SHA-256 of the whole key is kept.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Prefix     string     `json:"prefix"`
+	Alias      string     `json:"alias"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	Revoked    bool       `json:"revoked"`
+	hash       [sha256.Size]byte
+}
+
+// HasScope reports whether the key was granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type APIKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]*APIKey
+}
+
+var apiKeyStore = APIKeyStore{keys: make(map[string]*APIKey)}
+
+// CreateAPIKey issues a key for alias limited to scopes that expires after
+// lifetime, or API_KEY_DEFAULT_LIFETIME if lifetime is zero. The full key is
+// only ever returned here.
+func CreateAPIKey(alias, name string, scopes []string, lifetime time.Duration) (*APIKey, string, error) {
+	if len(scopes) <= 0 {
+		return nil, "", errors.New("an api key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if _, ok := API_KEY_SCOPES[scope]; !ok {
+			return nil, "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	if lifetime == 0 {
+		lifetime = API_KEY_DEFAULT_LIFETIME
+	}
+	if lifetime < 0 || lifetime > API_KEY_MAX_LIFETIME {
+		return nil, "", fmt.Errorf("api key lifetime must be at most %v", API_KEY_MAX_LIFETIME)
+	}
+
+	id := make([]byte, API_KEY_ID_SIZE)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	secret := make([]byte, API_KEY_SECRET_SIZE)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	key := &APIKey{
+		ID:        hex.EncodeToString(id),
+		Alias:     alias,
+		Name:      name,
+		Scopes:    append([]string(nil), scopes...),
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+	}
+	key.Prefix = API_KEY_PREFIX + key.ID
+	token := key.Prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	key.hash = sha256.Sum256([]byte(token))
+
+	apiKeyStore.mu.Lock()
+	defer apiKeyStore.mu.Unlock()
+
+	apiKeyStore.keys[key.ID] = key
+	copied := *key
+	return &copied, token, nil
+}
+
+// AuthenticateAPIKey returns the key token belongs to if it is still valid,
+// recording ip as its last use. The secret carries 256 bits of entropy, so a
+// fast hash is enough to keep the stored form useless to a reader.
+func AuthenticateAPIKey(token, ip string) (*APIKey, error) {
+	rest, ok := strings.CutPrefix(token, API_KEY_PREFIX)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	id, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	hash := sha256.Sum256([]byte(token))
+
+	apiKeyStore.mu.Lock()
+	defer apiKeyStore.mu.Unlock()
+
+	key, ok := apiKeyStore.keys[id]
+	if !ok || subtle.ConstantTimeCompare(key.hash[:], hash[:]) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if key.Revoked || now.After(key.ExpiresAt) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	key.LastUsedAt, key.LastUsedIP = &now, ip
+	copied := *key
+	return &copied, nil
+}
+
+// ListAPIKeys returns the keys of alias, newest first.
+func ListAPIKeys(alias string) []APIKey {
+	apiKeyStore.mu.Lock()
+	defer apiKeyStore.mu.Unlock()
+
+	keys := []APIKey{}
+	for _, key := range apiKeyStore.keys {
+		if key.Alias == alias {
+			keys = append(keys, *key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// RevokeAPIKey revokes the key id of alias. Revoked keys stay listed until
+// they would have expired.
+func RevokeAPIKey(alias, id string) error {
+	apiKeyStore.mu.Lock()
+	defer apiKeyStore.mu.Unlock()
+
+	key, ok := apiKeyStore.keys[id]
+	if !ok || key.Alias != alias {
+		return ErrAPIKeyNotFound
+	}
+	key.Revoked = true
+	return nil
+}
+
+// pruneAPIKeys forgets keys that have expired.
+func (a *APIKeyStore) pruneAPIKeys(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for id, key := range a.keys {
+		if now.After(key.ExpiresAt) {
+			delete(a.keys, id)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyHashing(t *testing.T) {
+	key, token, err := CreateAPIKey("hashed", "ci", []string{API_SCOPE_BUCKET_READ}, 0)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !strings.HasPrefix(token, key.Prefix+"_") || key.Prefix != API_KEY_PREFIX+key.ID {
+		t.Errorf("token %q does not start with prefix %q", token, key.Prefix)
+	}
+	if key.ExpiresAt.Sub(key.CreatedAt) != API_KEY_DEFAULT_LIFETIME {
+		t.Errorf("lifetime %v, want %v", key.ExpiresAt.Sub(key.CreatedAt), API_KEY_DEFAULT_LIFETIME)
+	}
+
+	apiKeyStore.mu.Lock()
+	stored := apiKeyStore.keys[key.ID].hash
+	apiKeyStore.mu.Unlock()
+	if stored != sha256.Sum256([]byte(token)) {
+		t.Error("stored hash is not the SHA-256 of the token")
+	}
+
+	authenticated, err := AuthenticateAPIKey(token, "192.0.2.1")
+	if err != nil || authenticated.ID != key.ID {
+		t.Fatalf("authenticate = %v, %v", authenticated, err)
+	}
+	if authenticated.LastUsedAt == nil || authenticated.LastUsedIP != "192.0.2.1" {
+		t.Errorf("last use not recorded: %v, %q", authenticated.LastUsedAt, authenticated.LastUsedIP)
+	}
+
+	last := token[len(token)-1:]
+	changed := "A"
+	if last == changed {
+		changed = "B"
+	}
+	for name, invalid := range map[string]string{
+		"changed secret": token[:len(token)-1] + changed,
+		"no prefix":      strings.TrimPrefix(token, API_KEY_PREFIX),
+		"no secret":      key.Prefix,
+		"unknown id":     API_KEY_PREFIX + "000000000000" + token[len(key.Prefix):],
+	} {
+		if _, err := AuthenticateAPIKey(invalid, "192.0.2.1"); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Errorf("%v: authenticate = %v, want ErrInvalidAPIKey", name, err)
+		}
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	cases := []struct {
+		name   string
+		scopes []string
+		valid  bool
+	}{
+		{"one scope", []string{API_SCOPE_BUCKET_READ}, true},
+		{"every scope", []string{API_SCOPE_BUCKET_READ, API_SCOPE_2FA_GENERATE}, true},
+		{"no scopes", nil, false},
+		{"unknown scope", []string{API_SCOPE_BUCKET_READ, "bucket:write"}, false},
+		{"differently cased scope", []string{"Bucket:Read"}, false},
+	}
+	for _, c := range cases {
+		key, _, err := CreateAPIKey("scoped", c.name, c.scopes, 0)
+		if (err == nil) != c.valid {
+			t.Errorf("%v: create = %v, want valid %v", c.name, err, c.valid)
+			continue
+		}
+		if !c.valid {
+			continue
+		}
+		for _, scope := range c.scopes {
+			if !key.HasScope(scope) {
+				t.Errorf("%v: lacks granted scope %q", c.name, scope)
+			}
+		}
+		if len(c.scopes) == 1 && key.HasScope(API_SCOPE_2FA_GENERATE) {
+			t.Errorf("%v: has a scope it was not granted", c.name)
+		}
+	}
+
+	for _, lifetime := range []time.Duration{-time.Hour, API_KEY_MAX_LIFETIME + time.Hour} {
+		if _, _, err := CreateAPIKey("scoped", "lifetime", []string{API_SCOPE_BUCKET_READ}, lifetime); err == nil {
+			t.Errorf("created a key with lifetime %v", lifetime)
+		}
+	}
+}
+
+func TestAPIKeyRevocation(t *testing.T) {
+	key, token, err := CreateAPIKey("revoking", "ci", []string{API_SCOPE_BUCKET_READ}, 0)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if err := RevokeAPIKey("bystander", key.ID); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("revoke by another alias = %v, want ErrAPIKeyNotFound", err)
+	}
+	if _, err := AuthenticateAPIKey(token, "192.0.2.1"); err != nil {
+		t.Fatalf("key stopped working after a refused revocation: %v", err)
+	}
+
+	if err := RevokeAPIKey("revoking", key.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, err := AuthenticateAPIKey(token, "192.0.2.1"); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("authenticate revoked key = %v, want ErrInvalidAPIKey", err)
+	}
+	listed := ListAPIKeys("revoking")
+	if len(listed) != 1 || !listed[0].Revoked {
+		t.Errorf("listed %+v, want the revoked key", listed)
+	}
+
+	// revoked keys are listed until they would have expired.
+	apiKeyStore.pruneAPIKeys(key.ExpiresAt.Add(time.Second))
+	if listed := ListAPIKeys("revoking"); len(listed) != 0 {
+		t.Errorf("listed %+v after expiry, want none", listed)
+	}
+	if err := RevokeAPIKey("revoking", key.ID); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("revoke expired key = %v, want ErrAPIKeyNotFound", err)
+	}
+}
@@ -2,130 +2,329 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/rand"
-	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
 	"vivian.infra/utils"
 )
 
+// CHARSET and AUTH_KEY_SIZE give the default 2FA key of about 25.9 bits,
+// which leans on the lockout to stay out of reach; CodeGenerator.Entropy
+// reports the strength of other configurations.
 const (
 	CHARSET       string = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	AUTH_KEY_SIZE int    = 5
-	HASH_COST     int    = 12 
+	HASH_COST     int    = 12
 )
 
+const (
+	AUTH_KEY_TTL         time.Duration = 5 * time.Minute
+	AUTH_REAPER_INTERVAL time.Duration = 30 * time.Second
+	PENDING_TOKEN_SIZE   int           = 32
+	CHALLENGE_ID_SIZE    int           = 16
+)
+
+// Authenticator2FA is a second factor. GenerateAuthKey2FA produces a key for
+// delivery to the account, which factors whose codes come from the owner's
+// own device do not support; ExpireAuthentication2FA invalidates whatever
+// would be accepted right now.
 type Authenticator2FA interface {
-	GenerateAuthKey2FA(context.Context, *utils.VivianLogger) (string, error)
-	VerifyAuthKey2FA(context.Context, string, *utils.VivianLogger) (bool, error)
-	ExpireAuthentication2FA(context.Context, *utils.VivianLogger) error
+	GenerateAuthKey2FA(context.Context, string, *utils.VivianLogger) (string, error)
+	VerifyAuthKey2FA(context.Context, string, string, *utils.VivianLogger) (bool, error)
+	ExpireAuthentication2FA(context.Context, string, *utils.VivianLogger) error
+}
+
+// LoginAuthenticator2FA is an Authenticator2FA that can hold a password login
+// open until the key sent for it is verified.
+type LoginAuthenticator2FA interface {
+	Authenticator2FA
+	BeginPendingLogin(context.Context, string) (string, error)
+	CheckPendingLogin(context.Context, string, string) error
+}
+
+// Enrollment is what the owner needs to set up a factor: the shared secret
+// and its provisioning URI for OTP apps, or the codes themselves for
+// recovery. None of it can be retrieved again.
+type Enrollment struct {
+	Secret string   `json:"secret,omitempty"`
+	URI    string   `json:"uri,omitempty"`
+	Codes  []string `json:"codes,omitempty"`
+}
+
+// Enroller2FA is an Authenticator2FA the owner sets up ahead of time.
+type Enroller2FA interface {
+	Authenticator2FA
+	Enroll(context.Context, string, *utils.VivianLogger) (Enrollment, error)
 }
 
-type HashManager struct {
-	atomicValue atomic.Value
-	flag        uint16
+// Confirmer2FA is an Enroller2FA whose enrollment only takes effect once the
+// owner has shown, with a code, that their device holds the new secret.
+type Confirmer2FA interface {
+	Enroller2FA
+	Confirm2FA(ctx context.Context, alias, code string, s *utils.VivianLogger) error
 }
 
-var hashManagerAtomic HashManager
+// Resynchronizer2FA is an Enroller2FA whose codes are counter-based and can
+// drift ahead of the server.
+type Resynchronizer2FA interface {
+	Enroller2FA
+	Resync2FA(ctx context.Context, alias, first, second string, s *utils.VivianLogger) error
+}
 
-func init() {
-	hashManagerAtomic.flag = 1
+// Remover2FA is an Enroller2FA its owner can take away again. Enrolled
+// reports whether alias has the factor set up for login.
+type Remover2FA interface {
+	Enroller2FA
+	Enrolled(ctx context.Context, alias string) (bool, error)
+	Remove2FA(ctx context.Context, alias string, s *utils.VivianLogger) error
 }
 
-func GenerateAuthKey2FA(ctx context.Context, s *utils.VivianLogger) (string, error) {
-	var mu sync.Mutex
-	mu.Lock()
-	defer mu.Unlock()
+var (
+	ErrKeyExpired          = errors.New("2FA key has expired")
+	ErrInvalidKey          = errors.New("invalid key")
+	ErrInvalidPendingLogin = errors.New("invalid or expired pending login")
+	// ErrNotGenerated is returned by factors whose codes are never generated
+	// by the server.
+	ErrNotGenerated = errors.New("this factor does not generate keys")
+)
 
-	if hashManagerAtomic.flag == 0 {
-		return "", errors.New("2FA has already been generated")
+// challenge is the outstanding 2FA key of a single alias, kept in the
+// STATE_BUCKET_CHALLENGES bucket. A login waiting on the key keeps the hex
+// SHA-256 of its pending token in Pending.
+type challenge struct {
+	ID        string    `json:"id"`
+	Hash      string    `json:"hash"`
+	Pending   string    `json:"pending,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (c *challenge) expired(now time.Time) bool {
+	return now.After(c.ExpiresAt)
+}
+
+func newChallengeID() (string, error) {
+	id := make([]byte, CHALLENGE_ID_SIZE)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(id), nil
+}
+
+// ChallengeAuthenticator implements LoginAuthenticator2FA with one-time keys
+// that are delivered to the account and kept only as keyed hashes in a
+// StateStore, one challenge per alias.
+type ChallengeAuthenticator struct {
+	store StateStore
+	ttl   time.Duration
+}
 
-	hashManagerAtomic.flag = 0
+var _ LoginAuthenticator2FA = (*ChallengeAuthenticator)(nil)
 
+// NewChallengeAuthenticator keeps challenges in store; generated keys remain
+// valid for ttl, or AUTH_KEY_TTL when ttl is not positive.
+func NewChallengeAuthenticator(store StateStore, ttl time.Duration) *ChallengeAuthenticator {
+	if ttl <= 0 {
+		ttl = AUTH_KEY_TTL
+	}
+	return &ChallengeAuthenticator{store: store, ttl: ttl}
+}
+
+func (c *ChallengeAuthenticator) GenerateAuthKey2FA(ctx context.Context, alias string, s *utils.VivianLogger) (string, error) {
 	start := time.Now()
 
-	authKeyGeneration := func() string {
-		source := rand.New(rand.NewSource(time.Now().Unix()))
-		var authKey strings.Builder
-		for i := 0; i < AUTH_KEY_SIZE; i++ {
-			sample := source.Intn(len(CHARSET))
-			authKey.WriteString(string(CHARSET[sample]))
-		}
-		return authKey.String()
+	authKey, formatted, err := AuthKeyGenerator().Generate()
+	if err != nil {
+		s.LogError("failure generating authentication key", err)
+		return "", err
 	}
-	authKey := authKeyGeneration()
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		authKeyHash, err := HashKeyphrase(ctx, authKey)
-		if err != nil {
-			s.LogError("failure during hashing process", err)
-			return
+	authKeyHash, err := HashSecret(authKey)
+	if err != nil {
+		s.LogError("failure during hashing process", err)
+		return "", err
+	}
+
+	id, err := newChallengeID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = updateState(c.store, STATE_BUCKET_CHALLENGES, alias, func(current *challenge) (*challenge, error) {
+		if current != nil && !current.expired(now) {
+			return nil, errors.New("2FA has already been generated")
 		}
-		hashManagerAtomic.atomicValue.Store([]byte(authKeyHash))
-	}()
-	wg.Wait()
+		return &challenge{ID: id, Hash: authKeyHash, CreatedAt: now, ExpiresAt: now.Add(c.ttl)}, nil
+	})
+	if err != nil {
+		s.LogError("failure storing 2FA challenge", err)
+		return "", err
+	}
 
 	elapsed := time.Since(start)
-	hash := hashManagerAtomic.atomicValue.Load().([]byte)
+	s.LogSuccess(fmt.Sprintf("authentication key generated for %v | %v", alias, elapsed))
+	return formatted, nil
+}
 
-	if hash == nil {
-		s.LogError("failure fetching the authentication key", errors.New("no hash available"))
-		return "", nil
+func (c *ChallengeAuthenticator) VerifyAuthKey2FA(ctx context.Context, alias, key string, s *utils.VivianLogger) (bool, error) {
+	var stored challenge
+	ok, err := loadState(c.store, STATE_BUCKET_CHALLENGES, alias, &stored)
+	if err != nil {
+		s.LogError("failure loading 2FA challenge", err)
+		return false, err
+	}
+	if !ok {
+		s.LogWarning(fmt.Sprintf("2FA has not been initialized for %v", alias))
+		return false, errors.New("2FA has not been initialized")
+	}
+	if stored.expired(time.Now()) {
+		c.release(alias, stored.ID)
+		s.LogWarning(fmt.Sprintf("2FA key for %v has expired", alias))
+		return false, ErrKeyExpired
 	}
 
-	s.LogSuccess(fmt.Sprintf("authentication key generated: %v | %v", authKey, elapsed))
-	return authKey, nil
-}
+	key, valid := AuthKeyGenerator().Normalize(key)
+	if !valid {
+		s.LogWarning("invalid key")
+		return false, ErrInvalidKey
+	}
 
-func VerifyAuthKey2FA(ctx context.Context, key string, s *utils.VivianLogger) (bool, error) {
-	var mu sync.Mutex
-	mu.Lock()
-	defer mu.Unlock()
+	if !VerifySecret(stored.Hash, key) {
+		return false, ErrInvalidKey
+	}
 
-	if hashManagerAtomic.flag == 1 {
-		s.LogWarning("2FA has not been initialized")
+	// a concurrent verify or expire may have consumed the challenge while
+	// the hash was being compared; only the caller that removes it succeeds.
+	released, err := c.release(alias, stored.ID)
+	if err != nil {
+		s.LogError("failure removing 2FA challenge", err)
+		return false, err
+	}
+	if !released {
 		return false, errors.New("2FA has not been initialized")
 	}
+	s.LogSuccess(fmt.Sprintf("verified key for %v", alias))
+	return true, nil
+}
 
-	hash := hashManagerAtomic.atomicValue.Load()
-	if hash == nil {
-		s.LogWarning("failure fetching data from hashmanager")
-		return false, errors.New("HashManager failure")
+func (c *ChallengeAuthenticator) ExpireAuthentication2FA(ctx context.Context, alias string, s *utils.VivianLogger) error {
+	removed, err := c.release(alias, "")
+	if err != nil {
+		s.LogError("failure removing 2FA challenge", err)
+		return err
+	}
+	if !removed {
+		return errors.New("2FA has not been initialized")
 	}
 
-	key = sanitize(key)
-	if !ensure2FA(key) {
-		s.LogWarning("invalid key")
-		return false, errors.New("invalid key")
+	s.LogDebug(fmt.Sprintf("killed 2FA key for %v at: %v", alias, time.Now().UTC()))
+	return nil
+}
+
+// release removes the challenge of alias if its ID is id, or whatever is
+// stored when id is empty, and reports whether anything was removed.
+func (c *ChallengeAuthenticator) release(alias, id string) (bool, error) {
+	released := false
+	err := updateState(c.store, STATE_BUCKET_CHALLENGES, alias, func(current *challenge) (*challenge, error) {
+		if current == nil || len(id) > 0 && current.ID != id {
+			return nil, errKeepState
+		}
+		released = true
+		return nil, nil
+	})
+	return released, err
+}
+
+// BeginPendingLogin binds a login to the outstanding challenge of alias and
+// returns the opaque token that CheckPendingLogin will accept alongside its
+// key. The login lasts exactly as long as the challenge does.
+func (c *ChallengeAuthenticator) BeginPendingLogin(_ context.Context, alias string) (string, error) {
+	raw := make([]byte, PENDING_TOKEN_SIZE)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
 	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	hash := sha256.Sum256([]byte(token))
 
-	err := bcrypt.CompareHashAndPassword(hash.([]byte), []byte(key))
+	now := time.Now()
+	err := updateState(c.store, STATE_BUCKET_CHALLENGES, alias, func(current *challenge) (*challenge, error) {
+		if current == nil || current.expired(now) {
+			return nil, errors.New("2FA has not been initialized")
+		}
+		current.Pending = hex.EncodeToString(hash[:])
+		return current, nil
+	})
 	if err != nil {
-		return false, err
-	} else {
-		s.LogSuccess("verified key")
-		Expire2FA(ctx, s)
-		return true, nil
+		return "", err
 	}
+	return token, nil
 }
 
-func Expire2FA(ctx context.Context, s *utils.VivianLogger) error {
-	if hashManagerAtomic.atomicValue.Load() == nil {
-		err := errors.New("invalid hashmanager load")
+// CheckPendingLogin reports ErrInvalidPendingLogin unless token belongs to
+// the live challenge of alias. It consumes nothing: the login ends when the
+// challenge is verified or expired.
+func (c *ChallengeAuthenticator) CheckPendingLogin(_ context.Context, alias, token string) error {
+	var stored challenge
+	ok, err := loadState(c.store, STATE_BUCKET_CHALLENGES, alias, &stored)
+	if err != nil {
 		return err
 	}
-	hashManagerAtomic.atomicValue = atomic.Value{}
-	hashManagerAtomic.flag = 1
+	pending, err := hex.DecodeString(stored.Pending)
+	if !ok || err != nil || len(pending) != sha256.Size || stored.expired(time.Now()) {
+		return ErrInvalidPendingLogin
+	}
 
-	s.LogDebug(fmt.Sprintf("killed 2FA key at: %v}", time.Now().UTC()))
+	hash := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(hash[:], pending) != 1 {
+		return ErrInvalidPendingLogin
+	}
 	return nil
 }
+
+// Prune removes expired challenges and returns the aliases they belonged
+// to.
+func (c *ChallengeAuthenticator) Prune(now time.Time) ([]string, error) {
+	return sweepState(c.store, STATE_BUCKET_CHALLENGES, func(_ string, stored *challenge) bool {
+		return stored.expired(now)
+	})
+}
+
+// Reap2FA evicts expired challenges every interval until ctx is done, so
+// keys that are never verified or expired by their owner do not accumulate.
+// Stale lockout records are pruned alongside, as are the refresh tokens,
+// sessions, API keys and one-time tokens, which are kept in memory whatever
+// StateStore the challenges use.
+func Reap2FA(ctx context.Context, interval time.Duration, challenges *ChallengeAuthenticator, attempts *AttemptTracker, s *utils.VivianLogger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.LogDebug("stopping 2FA reaper")
+			return
+		case now := <-ticker.C:
+			reaped, err := challenges.Prune(now)
+			if err != nil {
+				s.LogError("failure reaping 2FA challenges", err)
+			}
+			for _, alias := range reaped {
+				s.LogDebug(fmt.Sprintf("reaped expired 2FA key for %v", alias))
+			}
+			if err := attempts.Prune(now); err != nil {
+				s.LogError("failure reaping lockout records", err)
+			}
+			refreshStore.pruneRefresh(now)
+			sessionStore.pruneSessions(now)
+			apiKeyStore.pruneAPIKeys(now)
+			oneTimeStore.pruneOneTime(now)
+		}
+	}
+}
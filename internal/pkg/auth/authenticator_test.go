@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// expireChallenge moves the challenge of alias age into the past.
+func expireChallenge(t *testing.T, c *ChallengeAuthenticator, alias string, age time.Duration) {
+	t.Helper()
+	err := updateState(c.store, STATE_BUCKET_CHALLENGES, alias, func(current *challenge) (*challenge, error) {
+		current.CreatedAt = current.CreatedAt.Add(-age)
+		current.ExpiresAt = current.ExpiresAt.Add(-age)
+		return current, nil
+	})
+	if err != nil {
+		t.Fatalf("expire challenge: %v", err)
+	}
+}
+
+func TestChallengeAuthenticatorTTL(t *testing.T) {
+	cases := []struct {
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{0, AUTH_KEY_TTL},
+		{-time.Minute, AUTH_KEY_TTL},
+		{time.Minute, time.Minute},
+	}
+	for _, c := range cases {
+		challenges := NewChallengeAuthenticator(NewMemoryStateStore(), c.ttl)
+		if _, err := challenges.GenerateAuthKey2FA(context.Background(), "bella", testLogger(t)); err != nil {
+			t.Fatalf("ttl %v: generate: %v", c.ttl, err)
+		}
+		var stored challenge
+		if ok, err := loadState(challenges.store, STATE_BUCKET_CHALLENGES, "bella", &stored); !ok || err != nil {
+			t.Fatalf("ttl %v: load = %v, %v", c.ttl, ok, err)
+		}
+		if got := stored.ExpiresAt.Sub(stored.CreatedAt); got != c.want {
+			t.Errorf("ttl %v: challenge lasts %v, want %v", c.ttl, got, c.want)
+		}
+	}
+}
+
+func TestChallengeExpiry(t *testing.T) {
+	ctx := context.Background()
+	s := testLogger(t)
+	challenges := NewChallengeAuthenticator(NewMemoryStateStore(), time.Minute)
+
+	key, err := challenges.GenerateAuthKey2FA(ctx, "bella", s)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if _, err := challenges.GenerateAuthKey2FA(ctx, "bella", s); err == nil {
+		t.Error("generated a second key while the first was live")
+	}
+	if _, err := challenges.BeginPendingLogin(ctx, "bella"); err != nil {
+		t.Fatalf("begin pending login: %v", err)
+	}
+
+	expireChallenge(t, challenges, "bella", 2*time.Minute)
+	if ok, err := challenges.VerifyAuthKey2FA(ctx, "bella", key, s); ok || !errors.Is(err, ErrKeyExpired) {
+		t.Errorf("verify after expiry = %v, %v, want ErrKeyExpired", ok, err)
+	}
+	if _, err := challenges.BeginPendingLogin(ctx, "bella"); err == nil {
+		t.Error("began a pending login on an expired challenge")
+	}
+
+	key, err = challenges.GenerateAuthKey2FA(ctx, "bella", s)
+	if err != nil {
+		t.Fatalf("generate after expiry: %v", err)
+	}
+	if ok, err := challenges.VerifyAuthKey2FA(ctx, "bella", key, s); !ok || err != nil {
+		t.Errorf("verify of a fresh key = %v, %v, want true", ok, err)
+	}
+}
+
+func TestReap2FA(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := testLogger(t)
+	store := NewMemoryStateStore()
+	challenges := NewChallengeAuthenticator(store, time.Minute)
+	attempts := NewAttemptTracker(store)
+
+	for _, alias := range []string{"stale", "live"} {
+		if _, err := challenges.GenerateAuthKey2FA(ctx, alias, s); err != nil {
+			t.Fatalf("generate %v: %v", alias, err)
+		}
+	}
+	expireChallenge(t, challenges, "stale", 2*time.Minute)
+	if _, err := attempts.fail(aliasAttemptKey("stale"), 0, LOCKOUT_MAX_ALIAS_FAILURES, time.Now().Add(-2*LOCKOUT_WINDOW)); err != nil {
+		t.Fatalf("fail: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Reap2FA(ctx, 10*time.Millisecond, challenges, attempts, s)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var stored challenge
+		reaped, _ := loadState(store, STATE_BUCKET_CHALLENGES, "stale", &stored)
+		var record attemptRecord
+		pruned, _ := loadState(store, STATE_BUCKET_ATTEMPTS, aliasAttemptKey("stale"), &record)
+		if !reaped && !pruned {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("reaper left the expired challenge (%v) or stale lockout record (%v)", reaped, pruned)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var stored challenge
+	if ok, _ := loadState(store, STATE_BUCKET_CHALLENGES, "live", &stored); !ok {
+		t.Error("reaper removed a live challenge")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("reaper did not stop with its context")
+	}
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	BREACH_PREFIX_LENGTH int = 5
+)
+
+var ErrEmptyBreachCorpus = errors.New("breach corpus holds no range files")
+
+// BreachCorpus looks passwords up in a local copy of a k-anonymity breach
+// corpus laid out like the Pwned Passwords range API: one file per
+// five-character SHA-1 prefix, named PREFIX or PREFIX.txt, holding
+// "SUFFIX:COUNT" lines. Nothing leaves the host.
+type BreachCorpus struct {
+	Directory string
+}
+
+func NewBreachCorpus(directory string) *BreachCorpus {
+	return &BreachCorpus{Directory: directory}
+}
+
+// OpenBreachCorpus returns the corpus in directory once it has found a range
+// file there. Count passes every password whose range file is missing, so a
+// mistyped or unmounted directory must be caught up front.
+func OpenBreachCorpus(directory string) (*BreachCorpus, error) {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	//a full corpus holds a million files, so they are read in batches and
+	//the first range file ends the search.
+	for {
+		entries, err := dir.ReadDir(256)
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && rangeFile(entry.Name()) {
+				return NewBreachCorpus(directory), nil
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %v", ErrEmptyBreachCorpus, directory)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// rangeFile reports whether name is PREFIX or PREFIX.txt.
+func rangeFile(name string) bool {
+	prefix := strings.TrimSuffix(name, ".txt")
+	if len(prefix) != BREACH_PREFIX_LENGTH {
+		return false
+	}
+	_, err := strconv.ParseUint(prefix, 16, 32)
+	return err == nil
+}
+
+// Count returns how many times password appears in the corpus. A missing
+// range file means the prefix has no known breaches.
+func (b *BreachCorpus) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:BREACH_PREFIX_LENGTH], digest[BREACH_PREFIX_LENGTH:]
+
+	var file *os.File
+	var err error
+	for _, name := range []string{prefix + ".txt", prefix} {
+		file, err = os.Open(filepath.Join(b.Directory, name))
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		candidate, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok || !strings.EqualFold(candidate, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			n = 1
+		}
+		return n, nil
+	}
+	return 0, scanner.Err()
+}
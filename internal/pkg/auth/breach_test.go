@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/breach holds three range files: 5BAA6.txt and ABF7A.txt, and F3BBB
+// without the extension and with lowercase suffixes.
+const testBreachCorpus = "testdata/breach"
+
+func TestBreachCorpusCount(t *testing.T) {
+	corpus, err := OpenBreachCorpus(testBreachCorpus)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	cases := map[string]int{
+		"password":                     9545824, // in 5BAA6.txt
+		"hunter2":                      17,      // in F3BBB, lowercase
+		"correct horse battery staple": 0,       // ABF7A.txt has other suffixes
+		"Tr0ub4dor&3":                  0,       // no 87457 range file
+	}
+	for password, want := range cases {
+		if count, err := corpus.Count(password); count != want || err != nil {
+			t.Errorf("%q: count = %v, %v, want %v", password, count, err, want)
+		}
+	}
+}
+
+func TestOpenBreachCorpus(t *testing.T) {
+	empty := t.TempDir()
+	unrelated := t.TempDir()
+	for _, name := range []string{"README", "5BAA6.bak", "5BAA", "GGGGG.txt"} {
+		if err := os.WriteFile(filepath.Join(unrelated, name), nil, 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	nested := t.TempDir()
+	if err := os.Mkdir(filepath.Join(nested, "5BAA6"), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	for name, directory := range map[string]string{"empty": empty, "unrelated files": unrelated, "range directory": nested} {
+		if _, err := OpenBreachCorpus(directory); !errors.Is(err, ErrEmptyBreachCorpus) {
+			t.Errorf("%v: open = %v, want ErrEmptyBreachCorpus", name, err)
+		}
+	}
+	if _, err := OpenBreachCorpus(filepath.Join(empty, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing directory: open = %v, want os.ErrNotExist", err)
+	}
+}
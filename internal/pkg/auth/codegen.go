@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+const (
+	ALPHABET_NUMERIC      string = "0123456789"
+	ALPHABET_CROCKFORD    string = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	ALPHABET_ALPHANUMERIC string = CHARSET
+
+	CODE_GROUP_SEPARATOR string = "-"
+)
+
+// CODE_ALPHABETS names the alphabets selectable through VIVIAN_2FA_ALPHABET.
+// Crockford base32 leaves out I, L, O and U so that codes survive being read
+// aloud or copied by hand.
+var CODE_ALPHABETS = map[string]string{
+	"numeric":      ALPHABET_NUMERIC,
+	"crockford":    ALPHABET_CROCKFORD,
+	"alphanumeric": ALPHABET_ALPHANUMERIC,
+}
+
+// CodeGenerator draws fixed-length codes from an alphabet using crypto/rand.
+// Random bytes at or above the largest multiple of the alphabet size are
+// rejected, so every symbol is exactly as likely as any other. A group size
+// splits the displayed code with CODE_GROUP_SEPARATOR; the canonical code
+// that gets hashed and compared never contains it.
+type CodeGenerator struct {
+	alphabet  string
+	length    int
+	groupSize int
+}
+
+func NewCodeGenerator(alphabet string, length, groupSize int) (*CodeGenerator, error) {
+	if len(alphabet) < 2 || len(alphabet) > 256 {
+		return nil, errors.New("alphabet must have between 2 and 256 symbols")
+	}
+	seen := make(map[rune]bool, len(alphabet))
+	for _, r := range alphabet {
+		if r > 0x7f || seen[r] || strings.ContainsRune(CODE_GROUP_SEPARATOR, r) {
+			return nil, fmt.Errorf("alphabet symbol %q is repeated, reserved or not ASCII", r)
+		}
+		seen[r] = true
+	}
+	if length <= 0 {
+		return nil, errors.New("code length must be positive")
+	}
+	if groupSize < 0 {
+		return nil, errors.New("group size cannot be negative")
+	}
+	return &CodeGenerator{alphabet: alphabet, length: length, groupSize: groupSize}, nil
+}
+
+func mustCodeGenerator(alphabet string, length, groupSize int) *CodeGenerator {
+	g, err := NewCodeGenerator(alphabet, length, groupSize)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// Generate returns a fresh code in canonical form and formatted for display.
+func (g *CodeGenerator) Generate() (string, string, error) {
+	code := make([]byte, 0, g.length)
+	buffer := make([]byte, g.length*2)
+	for len(code) < g.length {
+		if _, err := rand.Read(buffer); err != nil {
+			return "", "", err
+		}
+		code = g.draw(code, buffer)
+	}
+	return string(code), g.Format(string(code)), nil
+}
+
+// draw appends to code the symbols that the random bytes select, skipping
+// those that would bias the result, until code is full.
+func (g *CodeGenerator) draw(code, random []byte) []byte {
+	size := len(g.alphabet)
+	limit := 256 - 256%size
+	for _, b := range random {
+		if len(code) == g.length {
+			break
+		}
+		if int(b) >= limit {
+			continue
+		}
+		code = append(code, g.alphabet[int(b)%size])
+	}
+	return code
+}
+
+// Format groups a canonical code for display.
+func (g *CodeGenerator) Format(code string) string {
+	if g.groupSize <= 0 || g.groupSize >= len(code) {
+		return code
+	}
+	var formatted strings.Builder
+	for i := 0; i < len(code); i += g.groupSize {
+		if i > 0 {
+			formatted.WriteString(CODE_GROUP_SEPARATOR)
+		}
+		formatted.WriteString(code[i:min(i+g.groupSize, len(code))])
+	}
+	return formatted.String()
+}
+
+// Normalize turns user input back into a canonical code, dropping
+// separators and whitespace, folding case when the alphabet has a single
+// case and, for Crockford base32, reading O as 0 and I or L as 1. It reports
+// whether the result could have been generated.
+func (g *CodeGenerator) Normalize(input string) (string, bool) {
+	switch {
+	case strings.ToUpper(g.alphabet) == g.alphabet:
+		input = strings.ToUpper(input)
+	case strings.ToLower(g.alphabet) == g.alphabet:
+		input = strings.ToLower(input)
+	}
+
+	var code strings.Builder
+	for _, r := range input {
+		if strings.ContainsRune(CODE_GROUP_SEPARATOR+" \t", r) {
+			continue
+		}
+		if g.alphabet == ALPHABET_CROCKFORD {
+			switch r {
+			case 'O':
+				r = '0'
+			case 'I', 'L':
+				r = '1'
+			}
+		}
+		if !strings.ContainsRune(g.alphabet, r) {
+			return "", false
+		}
+		code.WriteRune(r)
+	}
+	return code.String(), code.Len() == g.length
+}
+
+// Entropy is the number of bits an attacker has to guess per code.
+func (g *CodeGenerator) Entropy() float64 {
+	return float64(g.length) * math.Log2(float64(len(g.alphabet)))
+}
+
+func (g *CodeGenerator) String() string {
+	return fmt.Sprintf("%d symbols from an alphabet of %d (%.1f bits)", g.length, len(g.alphabet), g.Entropy())
+}
+
+var (
+	authKeyGeneratorMu sync.RWMutex
+	authKeyGenerator   = mustCodeGenerator(CHARSET, AUTH_KEY_SIZE, 0)
+)
+
+// SetAuthKeyGenerator changes how emailed 2FA keys are generated. Keys that
+// are already outstanding are verified with the new generator.
+func SetAuthKeyGenerator(g *CodeGenerator) {
+	authKeyGeneratorMu.Lock()
+	defer authKeyGeneratorMu.Unlock()
+	authKeyGenerator = g
+}
+
+func AuthKeyGenerator() *CodeGenerator {
+	authKeyGeneratorMu.RLock()
+	defer authKeyGeneratorMu.RUnlock()
+	return authKeyGenerator
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestCodeGeneratorRejectsBiasedBytes(t *testing.T) {
+	cases := []struct {
+		name     string
+		alphabet string
+		length   int
+		random   []byte
+		want     string
+	}{
+		//256 is a multiple of 32, so no byte is rejected.
+		{"crockford", ALPHABET_CROCKFORD, 4, []byte{0, 31, 32, 255}, "0Z0Z"},
+		//250 is the largest multiple of 10 below 256.
+		{"numeric limit", ALPHABET_NUMERIC, 3, []byte{249, 250, 255, 0, 9}, "909"},
+		//252 is the largest multiple of 36 below 256.
+		{"alphanumeric limit", ALPHABET_ALPHANUMERIC, 2, []byte{252, 251, 36}, "9A"},
+		{"short of bytes", ALPHABET_NUMERIC, 4, []byte{1, 250, 2}, "12"},
+		{"full", ALPHABET_NUMERIC, 2, []byte{1, 2, 3}, "12"},
+	}
+	for _, c := range cases {
+		g := mustCodeGenerator(c.alphabet, c.length, 0)
+		if got := string(g.draw(nil, c.random)); got != c.want {
+			t.Errorf("%v: draw = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCodeGeneratorGenerate(t *testing.T) {
+	g := mustCodeGenerator(ALPHABET_CROCKFORD, 10, 5)
+	for i := 0; i < 100; i++ {
+		code, formatted, err := g.Generate()
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+		if len(code) != 10 || strings.Trim(code, ALPHABET_CROCKFORD) != "" {
+			t.Fatalf("code %q is not 10 symbols of the alphabet", code)
+		}
+		if formatted != code[:5]+CODE_GROUP_SEPARATOR+code[5:] {
+			t.Fatalf("formatted %q does not group %q", formatted, code)
+		}
+	}
+}
+
+func TestCodeGeneratorFormat(t *testing.T) {
+	cases := []struct {
+		groupSize int
+		code      string
+		want      string
+	}{
+		{0, "ABCDEFGH", "ABCDEFGH"},
+		{4, "ABCDEFGH", "ABCD-EFGH"},
+		{3, "ABCDEFGH", "ABC-DEF-GH"},
+		{8, "ABCDEFGH", "ABCDEFGH"},
+		{10, "ABCDEFGH", "ABCDEFGH"},
+	}
+	for _, c := range cases {
+		g := mustCodeGenerator(ALPHABET_ALPHANUMERIC, len(c.code), c.groupSize)
+		if got := g.Format(c.code); got != c.want {
+			t.Errorf("group %v: Format(%q) = %q, want %q", c.groupSize, c.code, got, c.want)
+		}
+	}
+}
+
+func TestCodeGeneratorNormalize(t *testing.T) {
+	cases := []struct {
+		name     string
+		alphabet string
+		input    string
+		want     string
+		valid    bool
+	}{
+		{"crockford canonical", ALPHABET_CROCKFORD, "0A1B2C", "0A1B2C", true},
+		{"crockford lowercase", ALPHABET_CROCKFORD, "0a1b2c", "0A1B2C", true},
+		{"crockford O as zero", ALPHABET_CROCKFORD, "OA1B2C", "0A1B2C", true},
+		{"crockford I and L as one", ALPHABET_CROCKFORD, "0AIB2l", "0A1B21", true},
+		{"crockford separators", ALPHABET_CROCKFORD, " 0A1-B2C\t", "0A1B2C", true},
+		{"crockford U", ALPHABET_CROCKFORD, "0A1B2U", "", false},
+		{"crockford too short", ALPHABET_CROCKFORD, "0A1B2", "0A1B2", false},
+		{"alphanumeric keeps O", ALPHABET_ALPHANUMERIC, "o0i1l2", "O0I1L2", true},
+		{"numeric", ALPHABET_NUMERIC, "123-456", "123456", true},
+		{"numeric letter", ALPHABET_NUMERIC, "12345O", "", false},
+		{"mixed case alphabet", "aB", "aBaBaB", "aBaBaB", true},
+		{"mixed case alphabet unfolded", "aB", "AbAbAb", "", false},
+	}
+	for _, c := range cases {
+		g := mustCodeGenerator(c.alphabet, 6, 0)
+		got, valid := g.Normalize(c.input)
+		if got != c.want || valid != c.valid {
+			t.Errorf("%v: Normalize(%q) = %q, %v, want %q, %v", c.name, c.input, got, valid, c.want, c.valid)
+		}
+	}
+}
+
+func TestCodeGeneratorEntropy(t *testing.T) {
+	cases := []struct {
+		alphabet string
+		length   int
+		want     float64
+	}{
+		{ALPHABET_NUMERIC, 6, 6 * math.Log2(10)},
+		{ALPHABET_CROCKFORD, 10, 50},
+		{ALPHABET_ALPHANUMERIC, AUTH_KEY_SIZE, float64(AUTH_KEY_SIZE) * math.Log2(36)},
+		{"01", 8, 8},
+	}
+	for _, c := range cases {
+		g := mustCodeGenerator(c.alphabet, c.length, 0)
+		if got := g.Entropy(); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%v symbols of %q: Entropy = %v, want %v", c.length, c.alphabet, got, c.want)
+		}
+	}
+}
+
+func TestNewCodeGeneratorRejectsBadConfiguration(t *testing.T) {
+	cases := []struct {
+		name      string
+		alphabet  string
+		length    int
+		groupSize int
+	}{
+		{"single symbol", "A", 6, 0},
+		{"repeated symbol", "ABCA", 6, 0},
+		{"separator", "AB-", 6, 0},
+		{"not ascii", "ABÄ", 6, 0},
+		{"no length", ALPHABET_NUMERIC, 0, 0},
+		{"negative group", ALPHABET_NUMERIC, 6, -1},
+	}
+	for _, c := range cases {
+		if _, err := NewCodeGenerator(c.alphabet, c.length, c.groupSize); err == nil {
+			t.Errorf("%v: NewCodeGenerator accepted %q, %v, %v", c.name, c.alphabet, c.length, c.groupSize)
+		}
+	}
+}
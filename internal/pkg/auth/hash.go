@@ -2,10 +2,134 @@ package auth
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
 )
 
+const (
+	HASH_SALT_SIZE   int    = 16
+	HASH_KEY_SIZE    int    = 32
+	ARGON2ID_MEMORY  uint32 = 64 * 1024
+	ARGON2ID_TIME    uint32 = 3
+	ARGON2ID_THREADS uint8  = 2
+	SCRYPT_LOG_N     int    = 15
+	SCRYPT_R         int    = 8
+	SCRYPT_P         int    = 1
+
+	// parameters read back from stored hashes are held to these bounds, so
+	// that a crafted hash cannot make verification allocate without limit
+	// or panic.
+	HASH_MIN_SALT_SIZE   int    = 8
+	HASH_MIN_KEY_SIZE    int    = 16
+	HASH_MAX_KEY_SIZE    int    = 64
+	ARGON2ID_MAX_MEMORY  uint32 = 256 * 1024
+	ARGON2ID_MAX_TIME    uint32 = 16
+	ARGON2ID_MAX_THREADS uint8  = 16
+	SCRYPT_MAX_MEMORY    int    = 256 << 20
+	SCRYPT_MAX_P         int    = 16
+	BCRYPT_MAX_COST      int    = 16
+
+	SECRET_KEY_SIZE int    = 32
+	SECRET_HASH_ID  string = "hmac-sha256"
+
+	VIVIAN_DUMMY_KEYPHRASE string = "vivian.infra"
+)
+
+var (
+	ErrUnknownHash    = errors.New("unrecognised hash format")
+	ErrHashParameters = errors.New("hash parameters out of bounds")
+)
+
+var phcEncoding = base64.RawStdEncoding
+
+// Hasher is a password hashing scheme whose output carries its own
+// parameters, so that any stored hash can be verified without configuration.
+// Argon2id and scrypt use PHC strings ($id$params$salt$hash); bcrypt keeps its
+// native $2a$cost$ form, which the PHC format adopts as-is.
+type Hasher interface {
+	Hash(password string) (string, error)
+	Verify(hash, password string) (bool, error)
+	// Identifies reports whether hash was produced by this scheme.
+	Identifies(hash string) bool
+	// NeedsRehash reports whether hash, produced by this scheme, uses
+	// parameters other than the hasher's own.
+	NeedsRehash(hash string) bool
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+type Argon2idHasher struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+type ScryptHasher struct {
+	LogN int
+	R    int
+	P    int
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+var (
+	preferredHasherMu sync.RWMutex
+	preferredHasher   Hasher = &Argon2idHasher{Memory: ARGON2ID_MEMORY, Time: ARGON2ID_TIME, Threads: ARGON2ID_THREADS}
+)
+
+// Hashers returns the default configuration of every supported scheme, keyed
+// by the name used in VIVIAN_PASSWORD_HASHER.
+func Hashers() map[string]Hasher {
+	return map[string]Hasher{
+		"bcrypt":   &BcryptHasher{Cost: HASH_COST},
+		"argon2id": &Argon2idHasher{Memory: ARGON2ID_MEMORY, Time: ARGON2ID_TIME, Threads: ARGON2ID_THREADS},
+		"scrypt":   &ScryptHasher{LogN: SCRYPT_LOG_N, R: SCRYPT_R, P: SCRYPT_P},
+	}
+}
+
+// SetPreferredHasher selects the scheme used for new hashes. Hashes made by
+// any other scheme or with other parameters are upgraded on their next
+// successful verification.
+func SetPreferredHasher(h Hasher) {
+	preferredHasherMu.Lock()
+	defer preferredHasherMu.Unlock()
+	preferredHasher = h
+}
+
+func currentHasher() Hasher {
+	preferredHasherMu.RLock()
+	defer preferredHasherMu.RUnlock()
+	return preferredHasher
+}
+
+func hasherFor(hash string) (Hasher, error) {
+	if preferred := currentHasher(); preferred.Identifies(hash) {
+		return preferred, nil
+	}
+	for _, h := range Hashers() {
+		if h.Identifies(hash) {
+			return h, nil
+		}
+	}
+	return nil, ErrUnknownHash
+}
+
 func HashKeyphrase(_ context.Context, password string) (string, error) {
 	hashChannel := make(chan struct {
 		hash string
@@ -14,11 +138,11 @@ func HashKeyphrase(_ context.Context, password string) (string, error) {
 	defer close(hashChannel)
 
 	go func() {
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), HASH_COST)
+		hash, err := currentHasher().Hash(password)
 		hashChannel <- struct {
 			hash string
 			err  error
-		}{string(hash), err}
+		}{hash, err}
 	}()
 
 	result := <-hashChannel
@@ -30,9 +154,296 @@ func VerfiyHashKeyphrase(hash, password string) bool {
 	defer close(verificationChannel)
 
 	go func() {
-		status := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-		verificationChannel <- status == nil
+		h, err := hasherFor(hash)
+		if err != nil {
+			verificationChannel <- false
+			return
+		}
+		status, err := h.Verify(hash, password)
+		verificationChannel <- err == nil && status
 	}()
 
 	return <-verificationChannel
 }
+
+// VerifyDummyKeyphrase spends the same work as verifying password against a
+// real hash, so that callers can answer identically whether or not the
+// account they were asked about exists.
+func VerifyDummyKeyphrase(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = currentHasher().Hash(VIVIAN_DUMMY_KEYPHRASE)
+	})
+	VerfiyHashKeyphrase(dummyHash, password)
+}
+
+// VerifyAndRehashKeyphrase verifies password against hash and, when it
+// matches but hash is not in the preferred scheme and parameters, returns a
+// replacement hash for the caller to store. The replacement is empty
+// otherwise.
+func VerifyAndRehashKeyphrase(ctx context.Context, hash, password string) (bool, string, error) {
+	h, err := hasherFor(hash)
+	if err != nil {
+		return false, "", err
+	}
+	ok, err := h.Verify(hash, password)
+	if err != nil || !ok {
+		return false, "", err
+	}
+
+	preferred := currentHasher()
+	if preferred.Identifies(hash) && !preferred.NeedsRehash(hash) {
+		return true, "", nil
+	}
+	rehash, err := HashKeyphrase(ctx, password)
+	if err != nil {
+		return true, "", err
+	}
+	return true, rehash, nil
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+func (h *BcryptHasher) Verify(hash, password string) (bool, error) {
+	if err := h.bounded(hash); err != nil {
+		return false, err
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BcryptHasher) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (h *BcryptHasher) bounded(hash string) error {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return ErrUnknownHash
+	}
+	if cost > BCRYPT_MAX_COST {
+		return ErrHashParameters
+	}
+	return nil
+}
+
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.Cost
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, HASH_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, uint32(HASH_KEY_SIZE))
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Verify(hash, password string) (bool, error) {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	candidate := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(candidate, key) == 1, nil
+}
+
+func (h *Argon2idHasher) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, key, err := parseArgon2id(hash)
+	return err != nil || *params != *h || len(key) != HASH_KEY_SIZE
+}
+
+func parseArgon2id(hash string) (*Argon2idHasher, []byte, []byte, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[1] != "argon2id" {
+		return nil, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errors.New("unsupported argon2 version")
+	}
+	params := &Argon2idHasher{}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, ErrUnknownHash
+	}
+
+	if params.Threads < 1 || params.Threads > ARGON2ID_MAX_THREADS || params.Time < 1 || params.Time > ARGON2ID_MAX_TIME ||
+		params.Memory < 8*uint32(params.Threads) || params.Memory > ARGON2ID_MAX_MEMORY {
+		return nil, nil, nil, ErrHashParameters
+	}
+
+	salt, err := phcEncoding.DecodeString(fields[4])
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHash
+	}
+	key, err := phcEncoding.DecodeString(fields[5])
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHash
+	}
+	if err := boundedSaltAndKey(salt, key); err != nil {
+		return nil, nil, nil, err
+	}
+	return params, salt, key, nil
+}
+
+func (h *ScryptHasher) Hash(password string) (string, error) {
+	salt := make([]byte, HASH_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.LogN, h.R, h.P, HASH_KEY_SIZE)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		h.LogN, h.R, h.P,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+func (h *ScryptHasher) Verify(hash, password string) (bool, error) {
+	params, salt, key, err := parseScrypt(hash)
+	if err != nil {
+		return false, err
+	}
+	candidate, err := scrypt.Key([]byte(password), salt, 1<<params.LogN, params.R, params.P, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(candidate, key) == 1, nil
+}
+
+func (h *ScryptHasher) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$scrypt$")
+}
+
+func (h *ScryptHasher) NeedsRehash(hash string) bool {
+	params, _, key, err := parseScrypt(hash)
+	return err != nil || *params != *h || len(key) != HASH_KEY_SIZE
+}
+
+func parseScrypt(hash string) (*ScryptHasher, []byte, []byte, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 5 || fields[1] != "scrypt" {
+		return nil, nil, nil, ErrUnknownHash
+	}
+
+	params := &ScryptHasher{}
+	if _, err := fmt.Sscanf(fields[2], "ln=%d,r=%d,p=%d", &params.LogN, &params.R, &params.P); err != nil {
+		return nil, nil, nil, ErrUnknownHash
+	}
+	if params.LogN <= 0 || params.LogN > 30 || params.R < 1 || params.P < 1 || params.P > SCRYPT_MAX_P ||
+		128*params.R > SCRYPT_MAX_MEMORY>>params.LogN {
+		return nil, nil, nil, ErrHashParameters
+	}
+
+	salt, err := phcEncoding.DecodeString(fields[3])
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHash
+	}
+	key, err := phcEncoding.DecodeString(fields[4])
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHash
+	}
+	if err := boundedSaltAndKey(salt, key); err != nil {
+		return nil, nil, nil, err
+	}
+	return params, salt, key, nil
+}
+
+func boundedSaltAndKey(salt, key []byte) error {
+	if len(salt) < HASH_MIN_SALT_SIZE || len(key) < HASH_MIN_KEY_SIZE || len(key) > HASH_MAX_KEY_SIZE {
+		return ErrHashParameters
+	}
+	return nil
+}
+
+var (
+	secretKeyMu sync.RWMutex
+	secretKey   []byte
+)
+
+// SetSecretKey sets the key HashSecret hashes under. Hashes made under any
+// other key, including the random one used until this is called, stop
+// verifying.
+func SetSecretKey(key []byte) error {
+	if len(key) < SECRET_KEY_SIZE {
+		return fmt.Errorf("secret key must be at least %d bytes", SECRET_KEY_SIZE)
+	}
+	secretKeyMu.Lock()
+	defer secretKeyMu.Unlock()
+	secretKey = append([]byte(nil), key...)
+	return nil
+}
+
+func currentSecretKey() []byte {
+	secretKeyMu.RLock()
+	key := secretKey
+	secretKeyMu.RUnlock()
+	if key != nil {
+		return key
+	}
+
+	secretKeyMu.Lock()
+	defer secretKeyMu.Unlock()
+	if secretKey == nil {
+		secretKey = make([]byte, SECRET_KEY_SIZE)
+		if _, err := rand.Read(secretKey); err != nil {
+			panic(err)
+		}
+	}
+	return secretKey
+}
+
+// HashSecret hashes a server-generated secret, such as a 2FA key or client
+// secret, with a salted HMAC-SHA-256 under the secret key. These are either
+// high in entropy or short-lived and behind lockout, so the work factor of a
+// password hash buys nothing, while costing every unauthenticated attempt to
+// verify one. Without the key the hashes cannot be attacked offline.
+func HashSecret(secret string) (string, error) {
+	salt := make([]byte, HASH_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$%s$%s$%s", SECRET_HASH_ID, phcEncoding.EncodeToString(salt),
+		phcEncoding.EncodeToString(secretMAC(salt, secret))), nil
+}
+
+// VerifySecret reports whether secret matches hash. Hashes of the password
+// schemes are still accepted, so secrets stored before HashSecret existed
+// keep working.
+func VerifySecret(hash, secret string) bool {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 4 || fields[1] != SECRET_HASH_ID {
+		return VerfiyHashKeyphrase(hash, secret)
+	}
+	salt, err := phcEncoding.DecodeString(fields[2])
+	if err != nil {
+		return false
+	}
+	mac, err := phcEncoding.DecodeString(fields[3])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(secretMAC(salt, secret), mac)
+}
+
+func secretMAC(salt []byte, secret string) []byte {
+	mac := hmac.New(sha256.New, currentSecretKey())
+	mac.Write(salt)
+	mac.Write([]byte(secret))
+	return mac.Sum(nil)
+}
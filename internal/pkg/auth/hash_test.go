@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testHashers are cheap enough to run in tests but otherwise configured like
+// the defaults.
+func testHashers() map[string]Hasher {
+	return map[string]Hasher{
+		"bcrypt":   &BcryptHasher{Cost: 4},
+		"argon2id": &Argon2idHasher{Memory: 64, Time: 1, Threads: 1},
+		"scrypt":   &ScryptHasher{LogN: 4, R: 8, P: 1},
+	}
+}
+
+// useTestHasher makes HashKeyphrase use the cheap bcrypt of testHashers
+// until t ends.
+func useTestHasher(t *testing.T) {
+	previous := currentHasher()
+	SetPreferredHasher(testHashers()["bcrypt"])
+	t.Cleanup(func() { SetPreferredHasher(previous) })
+}
+
+func TestHasherRoundTrip(t *testing.T) {
+	for name, h := range testHashers() {
+		hash, err := h.Hash("correct horse")
+		if err != nil {
+			t.Fatalf("%v: hash: %v", name, err)
+		}
+		if !h.Identifies(hash) {
+			t.Errorf("%v: does not identify its own hash %q", name, hash)
+		}
+		if ok, err := h.Verify(hash, "correct horse"); !ok || err != nil {
+			t.Errorf("%v: verify = %v, %v, want true", name, ok, err)
+		}
+		if ok, _ := h.Verify(hash, "battery staple"); ok {
+			t.Errorf("%v: verified the wrong password", name)
+		}
+		if h.NeedsRehash(hash) {
+			t.Errorf("%v: wants to rehash its own hash", name)
+		}
+	}
+}
+
+func TestVerifyAndRehashKeyphrase(t *testing.T) {
+	hashers := testHashers()
+	defer SetPreferredHasher(currentHasher())
+
+	SetPreferredHasher(hashers["bcrypt"])
+	old, err := HashKeyphrase(context.Background(), "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetPreferredHasher(hashers["argon2id"])
+	ok, rehash, err := VerifyAndRehashKeyphrase(context.Background(), old, "correct horse")
+	if !ok || err != nil {
+		t.Fatalf("verify = %v, %v, want true", ok, err)
+	}
+	if !strings.HasPrefix(rehash, "$argon2id$") {
+		t.Fatalf("rehash = %q, want an argon2id hash", rehash)
+	}
+
+	ok, again, err := VerifyAndRehashKeyphrase(context.Background(), rehash, "correct horse")
+	if !ok || err != nil || len(again) > 0 {
+		t.Errorf("verify of upgraded hash = %v, %q, %v, want true without a rehash", ok, again, err)
+	}
+	if ok, rehash, _ := VerifyAndRehashKeyphrase(context.Background(), old, "wrong"); ok || len(rehash) > 0 {
+		t.Errorf("wrong password verified or was rehashed")
+	}
+}
+
+func TestHashParametersBounded(t *testing.T) {
+	salt, key := "c2FsdHNhbHRzYWx0", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"
+	for _, hash := range []string{
+		"$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=4194304,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1000,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$" + key,
+		"$scrypt$ln=24,r=8,p=1$" + salt + "$" + key,
+		"$scrypt$ln=4,r=0,p=1$" + salt + "$" + key,
+		"$scrypt$ln=4,r=8,p=0$" + salt + "$" + key,
+	} {
+		h, err := hasherFor(hash)
+		if err != nil {
+			t.Fatalf("%q not identified: %v", hash, err)
+		}
+		if ok, err := h.Verify(hash, "password"); ok || !errors.Is(err, ErrHashParameters) {
+			t.Errorf("verify %q = %v, %v, want ErrHashParameters", hash, ok, err)
+		}
+	}
+}
+
+func TestSecretHash(t *testing.T) {
+	hash, err := HashSecret("K7Q2M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$"+SECRET_HASH_ID+"$") {
+		t.Fatalf("hash = %q", hash)
+	}
+	if !VerifySecret(hash, "K7Q2M") || VerifySecret(hash, "K7Q2N") {
+		t.Error("secret hash does not verify exactly its secret")
+	}
+	if other, _ := HashSecret("K7Q2M"); other == hash {
+		t.Error("secret hashes are not salted")
+	}
+
+	legacy, err := testHashers()["bcrypt"].Hash("K7Q2M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifySecret(legacy, "K7Q2M") {
+		t.Error("legacy password-scheme hash no longer verifies")
+	}
+
+	defer SetSecretKey(currentSecretKey())
+	if err := SetSecretKey([]byte(strings.Repeat("k", SECRET_KEY_SIZE))); err != nil {
+		t.Fatal(err)
+	}
+	if VerifySecret(hash, "K7Q2M") {
+		t.Error("hash verified under a different key")
+	}
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"vivian.infra/utils"
+)
+
+const (
+	HOTP_DEFAULT_LOOK_AHEAD uint = 10
+	HOTP_RESYNC_WINDOW      uint = 100
+)
+
+// hotpAccount holds the shared secret of a counter-based token and the next
+// counter value the server expects from it, kept in the STATE_BUCKET_HOTP
+// bucket. The account is confirmed once its owner has confirmed a code from
+// the token.
+type hotpAccount struct {
+	Secret    string    `json:"secret"`
+	Counter   uint64    `json:"counter"`
+	Confirmed bool      `json:"confirmed"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HOTPAuthenticator implements Confirmer2FA and Resynchronizer2FA with RFC
+// 4226 counter-based codes. Codes up to lookAhead counters ahead of the expected one are
+// accepted so tokens that were pressed without logging in stay usable.
+type HOTPAuthenticator struct {
+	store     StateStore
+	lookAhead uint
+}
+
+var (
+	_ Confirmer2FA      = (*HOTPAuthenticator)(nil)
+	_ Resynchronizer2FA = (*HOTPAuthenticator)(nil)
+	_ Remover2FA        = (*HOTPAuthenticator)(nil)
+)
+
+func NewHOTPAuthenticator(store StateStore, lookAhead uint) *HOTPAuthenticator {
+	return &HOTPAuthenticator{store: store, lookAhead: lookAhead}
+}
+
+// updateAccount runs fn on the enrollment of alias with its decoded secret.
+func (h *HOTPAuthenticator) updateAccount(alias string, fn func(account *hotpAccount, secret []byte) error) error {
+	return updateState(h.store, STATE_BUCKET_HOTP, alias, func(account *hotpAccount) (*hotpAccount, error) {
+		if account == nil {
+			return nil, errors.New("HOTP has not been enrolled")
+		}
+		secret, err := otpEncoding.DecodeString(account.Secret)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(account, secret); err != nil {
+			return nil, err
+		}
+		return account, nil
+	})
+}
+
+// Enroll creates a fresh secret for alias and returns it along with its
+// otpauth:// provisioning URI. The enrollment must be confirmed with
+// Confirm2FA before it can be verified; until then it may be replaced by
+// enrolling again, after that enrolling is refused so the token in use
+// cannot be silently swapped for another.
+func (h *HOTPAuthenticator) Enroll(_ context.Context, alias string, s *utils.VivianLogger) (Enrollment, error) {
+	secret := make([]byte, TOTP_SECRET_SIZE)
+	if _, err := rand.Read(secret); err != nil {
+		s.LogError("failure generating HOTP secret", err)
+		return Enrollment{}, err
+	}
+	encoded := otpEncoding.EncodeToString(secret)
+
+	err := updateState(h.store, STATE_BUCKET_HOTP, alias, func(current *hotpAccount) (*hotpAccount, error) {
+		if current != nil && current.Confirmed {
+			return nil, errors.New("HOTP has already been enrolled")
+		}
+		return &hotpAccount{Secret: encoded, Counter: 0, CreatedAt: time.Now()}, nil
+	})
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	s.LogSuccess(fmt.Sprintf("HOTP secret enrolled for %v", alias))
+	return Enrollment{Secret: encoded, URI: provisioningURI("hotp", alias, encoded, url.Values{"counter": {"0"}})}, nil
+}
+
+// GenerateAuthKey2FA returns ErrNotGenerated: HOTP codes come from the
+// token of the owner.
+func (h *HOTPAuthenticator) GenerateAuthKey2FA(context.Context, string, *utils.VivianLogger) (string, error) {
+	return "", ErrNotGenerated
+}
+
+// VerifyAuthKey2FA accepts a code from a confirmed enrollment.
+func (h *HOTPAuthenticator) VerifyAuthKey2FA(_ context.Context, alias, key string, s *utils.VivianLogger) (bool, error) {
+	accepted, err := h.verify(alias, key, false, s)
+	if err != nil {
+		return false, err
+	}
+
+	s.LogSuccess(fmt.Sprintf("verified HOTP code for %v at counter %v", alias, accepted))
+	return true, nil
+}
+
+// Confirm2FA accepts the first code of an unconfirmed enrollment, after which
+// the token can be used to log in.
+func (h *HOTPAuthenticator) Confirm2FA(_ context.Context, alias, key string, s *utils.VivianLogger) error {
+	if _, err := h.verify(alias, key, true, s); err != nil {
+		return err
+	}
+
+	s.LogSuccess(fmt.Sprintf("audit: HOTP enrollment confirmed for %v", alias))
+	return nil
+}
+
+// verify checks key against the counters of alias up to lookAhead ahead of
+// the expected one, with the enrollment unconfirmed when confirm is set and
+// confirmed otherwise, and returns the counter it matched.
+func (h *HOTPAuthenticator) verify(alias, key string, confirm bool, s *utils.VivianLogger) (uint64, error) {
+	key = sanitize(key)
+	if !ensureOTP(key) {
+		s.LogWarning("invalid HOTP code")
+		return 0, ErrInvalidCode
+	}
+
+	var accepted uint64
+	err := h.updateAccount(alias, func(account *hotpAccount, secret []byte) error {
+		if confirm && account.Confirmed {
+			return errors.New("HOTP has already been confirmed")
+		}
+		if !confirm && !account.Confirmed {
+			return errors.New("HOTP has not been confirmed")
+		}
+		for counter := account.Counter; counter <= account.Counter+uint64(h.lookAhead); counter++ {
+			if otpEqual(otpCode(secret, counter), key) {
+				account.Counter = counter + 1
+				account.Confirmed = true
+				accepted = counter
+				return nil
+			}
+		}
+		return ErrInvalidCode
+	})
+	if err != nil && !errors.Is(err, ErrInvalidCode) {
+		s.LogWarning(fmt.Sprintf("unable to verify HOTP code for %v: %v", alias, err))
+	}
+	return accepted, err
+}
+
+// ExpireAuthentication2FA moves the counter past the code the token would
+// show next, so that a code seen by someone else can no longer be used.
+func (h *HOTPAuthenticator) ExpireAuthentication2FA(_ context.Context, alias string, s *utils.VivianLogger) error {
+	var counter uint64
+	err := h.updateAccount(alias, func(account *hotpAccount, _ []byte) error {
+		account.Counter++
+		counter = account.Counter
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.LogDebug(fmt.Sprintf("expired HOTP counter for %v, now at %v", alias, counter))
+	return nil
+}
+
+// Enrolled reports whether alias has a confirmed HOTP token.
+func (h *HOTPAuthenticator) Enrolled(_ context.Context, alias string) (bool, error) {
+	var account hotpAccount
+	ok, err := loadState(h.store, STATE_BUCKET_HOTP, alias, &account)
+	return ok && account.Confirmed, err
+}
+
+// Remove2FA deletes the token of alias, confirmed or not.
+func (h *HOTPAuthenticator) Remove2FA(_ context.Context, alias string, s *utils.VivianLogger) error {
+	err := updateState(h.store, STATE_BUCKET_HOTP, alias, func(account *hotpAccount) (*hotpAccount, error) {
+		if account == nil {
+			return nil, errors.New("HOTP has not been enrolled")
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.LogWarning(fmt.Sprintf("audit: HOTP token removed for %v", alias))
+	return nil
+}
+
+// Resync2FA realigns a drifted token once it has been confirmed. Two
+// consecutive codes are required so that a single lucky guess across the
+// wide resync window is not enough, and codes that match nowhere in it are
+// ErrInvalidCode like any other wrong code.
+func (h *HOTPAuthenticator) Resync2FA(_ context.Context, alias, first, second string, s *utils.VivianLogger) error {
+	first, second = sanitize(first), sanitize(second)
+	if !ensureOTP(first) || !ensureOTP(second) {
+		s.LogWarning("invalid HOTP code")
+		return ErrInvalidCode
+	}
+
+	var counter uint64
+	err := h.updateAccount(alias, func(account *hotpAccount, secret []byte) error {
+		if !account.Confirmed {
+			return errors.New("HOTP has not been confirmed")
+		}
+		for counter = account.Counter; counter <= account.Counter+uint64(HOTP_RESYNC_WINDOW); counter++ {
+			if otpEqual(otpCode(secret, counter), first) && otpEqual(otpCode(secret, counter+1), second) {
+				account.Counter = counter + 2
+				return nil
+			}
+		}
+		return ErrInvalidCode
+	})
+	if err != nil {
+		s.LogWarning(fmt.Sprintf("HOTP resync failed for %v", alias))
+		return err
+	}
+
+	s.LogSuccess(fmt.Sprintf("resynchronised HOTP for %v, counter now %v", alias, counter+2))
+	return nil
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// rfc4226Secret is the shared secret of the RFC 4226 Appendix D test values.
+var rfc4226Secret = []byte("12345678901234567890")
+
+var rfc4226Codes = []string{
+	"755224", "287082", "359152", "969429", "338314",
+	"254676", "287922", "162583", "399871", "520489",
+}
+
+func TestOTPCodeRFC4226(t *testing.T) {
+	for counter, want := range rfc4226Codes {
+		if got := otpCode(rfc4226Secret, uint64(counter)); got != want {
+			t.Errorf("counter %v: otpCode = %v, want %v", counter, got, want)
+		}
+	}
+}
+
+// testHOTP returns an authenticator with alias enrolled on the RFC 4226
+// secret at counter, confirmed if confirmed is set.
+func testHOTP(t *testing.T, alias string, counter uint64, confirmed bool) *HOTPAuthenticator {
+	store := NewMemoryStateStore()
+	err := updateState(store, STATE_BUCKET_HOTP, alias, func(*hotpAccount) (*hotpAccount, error) {
+		return &hotpAccount{Secret: otpEncoding.EncodeToString(rfc4226Secret), Counter: counter, Confirmed: confirmed, CreatedAt: time.Now()}, nil
+	})
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	return NewHOTPAuthenticator(store, 2)
+}
+
+func TestHOTPVerifyLookAhead(t *testing.T) {
+	ctx := context.Background()
+	s := testLogger(t)
+	h := testHOTP(t, "bella", 0, true)
+
+	if ok, err := h.VerifyAuthKey2FA(ctx, "bella", rfc4226Codes[2], s); !ok || err != nil {
+		t.Fatalf("code within look-ahead = %v, %v, want true", ok, err)
+	}
+	if _, err := h.VerifyAuthKey2FA(ctx, "bella", rfc4226Codes[2], s); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("reused code = %v, want ErrInvalidCode", err)
+	}
+	if _, err := h.VerifyAuthKey2FA(ctx, "bella", rfc4226Codes[6], s); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("code beyond look-ahead = %v, want ErrInvalidCode", err)
+	}
+	if ok, err := h.VerifyAuthKey2FA(ctx, "bella", rfc4226Codes[3], s); !ok || err != nil {
+		t.Errorf("next code = %v, %v, want true", ok, err)
+	}
+}
+
+func TestHOTPConfirmBeforeVerify(t *testing.T) {
+	ctx := context.Background()
+	s := testLogger(t)
+	h := testHOTP(t, "bella", 0, false)
+
+	if ok, _ := h.VerifyAuthKey2FA(ctx, "bella", rfc4226Codes[0], s); ok {
+		t.Fatal("unconfirmed enrollment accepted for verification")
+	}
+	if err := h.Resync2FA(ctx, "bella", rfc4226Codes[0], rfc4226Codes[1], s); err == nil {
+		t.Error("resynchronised an unconfirmed enrollment")
+	}
+	if enrolled, _ := h.Enrolled(ctx, "bella"); enrolled {
+		t.Error("unconfirmed enrollment reported as enrolled")
+	}
+	if err := h.Confirm2FA(ctx, "bella", rfc4226Codes[6], s); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("confirm beyond look-ahead = %v, want ErrInvalidCode", err)
+	}
+	if err := h.Confirm2FA(ctx, "bella", rfc4226Codes[1], s); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	if err := h.Confirm2FA(ctx, "bella", rfc4226Codes[2], s); err == nil {
+		t.Error("confirmed the same enrollment twice")
+	}
+	if enrolled, err := h.Enrolled(ctx, "bella"); !enrolled || err != nil {
+		t.Errorf("enrolled after confirm = %v, %v, want true", enrolled, err)
+	}
+	if ok, _ := h.VerifyAuthKey2FA(ctx, "bella", rfc4226Codes[1], s); ok {
+		t.Error("code used to confirm accepted again")
+	}
+	if ok, err := h.VerifyAuthKey2FA(ctx, "bella", rfc4226Codes[2], s); !ok || err != nil {
+		t.Errorf("verify after confirm = %v, %v, want true", ok, err)
+	}
+}
+
+func TestHOTPDoesNotGenerate(t *testing.T) {
+	h := testHOTP(t, "bella", 0, true)
+	if code, err := h.GenerateAuthKey2FA(context.Background(), "bella", testLogger(t)); !errors.Is(err, ErrNotGenerated) || len(code) > 0 {
+		t.Errorf("generate = %q, %v, want ErrNotGenerated", code, err)
+	}
+}
+
+func TestHOTPEnrollRefusedOnceConfirmed(t *testing.T) {
+	ctx := context.Background()
+	s := testLogger(t)
+	h := testHOTP(t, "bella", 0, false)
+
+	if _, err := h.Enroll(ctx, "bella", s); err != nil {
+		t.Fatalf("replacing an unconfirmed enrollment: %v", err)
+	}
+	h = testHOTP(t, "bella", 0, false)
+	if err := h.Confirm2FA(ctx, "bella", rfc4226Codes[0], s); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	if _, err := h.Enroll(ctx, "bella", s); err == nil {
+		t.Error("replaced a confirmed enrollment")
+	}
+	if ok, err := h.VerifyAuthKey2FA(ctx, "bella", rfc4226Codes[1], s); !ok || err != nil {
+		t.Errorf("original token stopped working: %v, %v", ok, err)
+	}
+}
+
+func TestHOTPResync(t *testing.T) {
+	ctx := context.Background()
+	s := testLogger(t)
+	h := testHOTP(t, "bella", 0, true)
+
+	if err := h.Resync2FA(ctx, "bella", rfc4226Codes[7], rfc4226Codes[9], s); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("non-consecutive codes = %v, want ErrInvalidCode", err)
+	}
+	if err := h.Resync2FA(ctx, "bella", rfc4226Codes[7], rfc4226Codes[8], s); err != nil {
+		t.Fatalf("resync: %v", err)
+	}
+	if ok, err := h.VerifyAuthKey2FA(ctx, "bella", rfc4226Codes[9], s); !ok || err != nil {
+		t.Errorf("code after resync = %v, %v, want true", ok, err)
+	}
+}
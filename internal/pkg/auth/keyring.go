@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"vivian.infra/utils"
+)
+
+const (
+	KEY_STATE_PENDING  string = "pending"
+	KEY_STATE_ACTIVE   string = "active"
+	KEY_STATE_RETIRING string = "retiring"
+	KEY_STATE_RETIRED  string = "retired"
+
+	KEYRING_ROTATION_INTERVAL time.Duration = 24 * time.Hour
+	KEYRING_CHECK_INTERVAL    time.Duration = time.Minute
+	KEYRING_RETIRED_RETENTION time.Duration = 7 * 24 * time.Hour
+	KEY_ID_SIZE               int           = 16
+
+	// JWKS_MAX_AGE is how long verifiers may cache the published key set. A
+	// pending key is published for KEYRING_PUBLISH_LEAD before it signs, so
+	// every cached copy already holds it by then.
+	JWKS_MAX_AGE         time.Duration = 5 * time.Minute
+	KEYRING_PUBLISH_LEAD time.Duration = 2 * JWKS_MAX_AGE
+)
+
+// RingKey is a signing key and its place in the rotation. A pending key is
+// published but signs and verifies nothing yet; the active key signs new
+// tokens; retiring keys only verify tokens issued before the last
+// rotation until those have expired; retired keys verify nothing and are
+// kept for a while so their IDs still show up in the logs as known.
+type RingKey struct {
+	ID          string
+	Key         *SigningKey
+	State       string
+	CreatedAt   time.Time
+	ActivatedAt time.Time
+	RetiredAt   time.Time
+}
+
+// KeyRing holds every signing key of one algorithm. Tokens carry the ID of
+// the key that signed them in their kid header.
+type KeyRing struct {
+	mu        sync.RWMutex
+	algorithm string
+	interval  time.Duration
+	retention time.Duration
+	keys      []*RingKey
+}
+
+// NewKeyRing starts a ring with initial as its active key. Keys are rotated
+// every interval, but no sooner than KEYRING_PUBLISH_LEAD after their
+// successor is published, and retiring keys stay valid for retention, which
+// must be at least the longest lifetime of a token signed by the ring.
+func NewKeyRing(initial *SigningKey, interval, retention time.Duration) *KeyRing {
+	ring := &KeyRing{algorithm: initial.Algorithm, interval: interval, retention: retention}
+	now := time.Now()
+	ring.keys = append(ring.keys, &RingKey{ID: keyID(initial), Key: initial, State: KEY_STATE_ACTIVE, CreatedAt: now, ActivatedAt: now})
+	return ring
+}
+
+// Active returns the key that signs new tokens.
+func (k *KeyRing) Active() *RingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.State == KEY_STATE_ACTIVE {
+			return key
+		}
+	}
+	return nil
+}
+
+// Pending returns the key that is published to become active next, if any.
+func (k *KeyRing) Pending() *RingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.State == KEY_STATE_PENDING {
+			return key
+		}
+	}
+	return nil
+}
+
+// Lookup returns the key with id if it may still verify tokens.
+func (k *KeyRing) Lookup(id string) (*RingKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.ID == id && (key.State == KEY_STATE_ACTIVE || key.State == KEY_STATE_RETIRING) {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// Stage generates the next key and publishes it as pending. A ring holds at
+// most one pending key; staging again returns it.
+func (k *KeyRing) Stage(now time.Time) (*RingKey, error) {
+	if pending := k.Pending(); pending != nil {
+		return pending, nil
+	}
+	signingKey, err := GenerateSigningKey(k.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	next := &RingKey{ID: keyID(signingKey), Key: signingKey, State: KEY_STATE_PENDING, CreatedAt: now}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = append(k.keys, next)
+	return next, nil
+}
+
+// Rotate makes the pending key active, staging one first if there is none,
+// and moves the previous active key to retiring. Verifiers that cached the
+// key set before a key was staged reject its tokens until their copy
+// expires, so RunRotation only rotates keys published for
+// KEYRING_PUBLISH_LEAD.
+func (k *KeyRing) Rotate(now time.Time) (*RingKey, error) {
+	next, err := k.Stage(now)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, key := range k.keys {
+		if key.State == KEY_STATE_ACTIVE {
+			key.State = KEY_STATE_RETIRING
+			key.RetiredAt = now
+		}
+	}
+	next.State = KEY_STATE_ACTIVE
+	next.ActivatedAt = now
+	return next, nil
+}
+
+// advance stages the next key KEYRING_PUBLISH_LEAD before the active key is
+// due for rotation, and rotates to it once it is due and the pending key has
+// been published for that long.
+func (k *KeyRing) advance(now time.Time) (staged, rotated *RingKey, err error) {
+	active := k.Active()
+	if active != nil && now.Sub(active.ActivatedAt) < k.interval-KEYRING_PUBLISH_LEAD {
+		return nil, nil, nil
+	}
+	pending := k.Pending()
+	if pending == nil {
+		staged, err = k.Stage(now)
+		return staged, nil, err
+	}
+	if now.Sub(pending.CreatedAt) < KEYRING_PUBLISH_LEAD || (active != nil && now.Sub(active.ActivatedAt) < k.interval) {
+		return nil, nil, nil
+	}
+	rotated, err = k.Rotate(now)
+	return nil, rotated, err
+}
+
+// retire moves retiring keys past their retention to retired and forgets
+// retired keys past KEYRING_RETIRED_RETENTION, returning the IDs retired.
+func (k *KeyRing) retire(now time.Time) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var retired []string
+	keys := k.keys[:0]
+	for _, key := range k.keys {
+		if key.State == KEY_STATE_RETIRING && now.Sub(key.RetiredAt) > k.retention {
+			key.State = KEY_STATE_RETIRED
+			retired = append(retired, key.ID)
+		}
+		if key.State == KEY_STATE_RETIRED && now.Sub(key.RetiredAt) > k.retention+KEYRING_RETIRED_RETENTION {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	k.keys = keys
+	return retired
+}
+
+// RunRotation rotates the ring every interval and retires old keys until ctx
+// is done.
+func (k *KeyRing) RunRotation(ctx context.Context, s *utils.VivianLogger) {
+	ticker := time.NewTicker(KEYRING_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.LogDebug("stopping signing key rotation")
+			return
+		case now := <-ticker.C:
+			staged, rotated, err := k.advance(now)
+			switch {
+			case err != nil:
+				s.LogError("failure rotating signing key", err)
+			case staged != nil:
+				s.LogSuccess(fmt.Sprintf("published pending signing key %v", staged.ID))
+			case rotated != nil:
+				s.LogSuccess(fmt.Sprintf("rotated signing key, active kid: %v", rotated.ID))
+			}
+			for _, id := range k.retire(now) {
+				s.LogDebug(fmt.Sprintf("retired signing key %v", id))
+			}
+		}
+	}
+}
+
+// JSONWebKey is the public half of an Ed25519 signing key as published in
+// the JWKS document (RFC 8037).
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS returns the public keys that may verify current tokens, and the
+// pending key that will. Symmetric HS256 keys cannot be shared and are never
+// published.
+func (k *KeyRing) JWKS() JSONWebKeySet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range k.keys {
+		if key.State == KEY_STATE_RETIRED || key.Key.Algorithm != TOKEN_ALG_EDDSA {
+			continue
+		}
+		set.Keys = append(set.Keys, JSONWebKey{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         tokenEncoding.EncodeToString(key.Key.publicKey),
+			KeyID:     key.ID,
+			Algorithm: TOKEN_ALG_EDDSA,
+			Use:       "sig",
+		})
+	}
+	return set
+}
+
+// keyID derives the kid of key: the RFC 7638 thumbprint for Ed25519 keys,
+// and a truncated hash of the secret under a fixed prefix for HS256 keys, so
+// a configured secret keeps its kid across restarts while the kid reveals
+// nothing usable about the secret.
+func keyID(key *SigningKey) string {
+	if key.Algorithm == TOKEN_ALG_EDDSA {
+		canonical, _ := json.Marshal(struct {
+			Curve   string `json:"crv"`
+			KeyType string `json:"kty"`
+			X       string `json:"x"`
+		}{"Ed25519", "OKP", tokenEncoding.EncodeToString(key.publicKey)})
+		sum := sha256.Sum256(canonical)
+		return tokenEncoding.EncodeToString(sum[:])
+	}
+
+	sum := sha256.Sum256(append([]byte("vivian.infra kid\x00"), key.secret...))
+	return tokenEncoding.EncodeToString(sum[:KEY_ID_SIZE])
+}
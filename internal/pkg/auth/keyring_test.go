@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func published(ring *KeyRing, id string) bool {
+	for _, key := range ring.JWKS().Keys {
+		if key.KeyID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestKeyRingPublishesNextKeyAhead(t *testing.T) {
+	key, err := GenerateSigningKey(TOKEN_ALG_EDDSA)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	ring := NewKeyRing(key, KEYRING_ROTATION_INTERVAL, time.Hour)
+	first := ring.Active()
+	start := first.ActivatedAt
+
+	if staged, rotated, err := ring.advance(start.Add(time.Hour)); staged != nil || rotated != nil || err != nil {
+		t.Fatalf("advance before the lead = %v, %v, %v, want nothing", staged, rotated, err)
+	}
+
+	staged, rotated, err := ring.advance(start.Add(KEYRING_ROTATION_INTERVAL - KEYRING_PUBLISH_LEAD))
+	if err != nil || staged == nil || rotated != nil {
+		t.Fatalf("advance at the lead = %v, %v, %v, want a staged key", staged, rotated, err)
+	}
+	if !published(ring, staged.ID) || !published(ring, first.ID) {
+		t.Error("pending and active keys are not both published")
+	}
+	if ring.Active() != first {
+		t.Error("staging changed the active key")
+	}
+	if _, ok := ring.Lookup(staged.ID); ok {
+		t.Error("pending key verifies tokens")
+	}
+
+	// the active key is due, but its successor has not been out long enough
+	// for every cached key set to hold it.
+	late := start.Add(KEYRING_ROTATION_INTERVAL)
+	ring.Pending().CreatedAt = late.Add(-JWKS_MAX_AGE)
+	if _, rotated, _ := ring.advance(late); rotated != nil {
+		t.Fatalf("rotated to a key published for only %v", JWKS_MAX_AGE)
+	}
+
+	_, rotated, err = ring.advance(late.Add(KEYRING_PUBLISH_LEAD))
+	if err != nil || rotated == nil || rotated.ID != staged.ID {
+		t.Fatalf("advance once due = %v, %v, want the staged key active", rotated, err)
+	}
+	if ring.Active() != rotated || first.State != KEY_STATE_RETIRING {
+		t.Errorf("after rotation active %v, previous %v", ring.Active().ID, first.State)
+	}
+	if _, ok := ring.Lookup(first.ID); !ok {
+		t.Error("retiring key no longer verifies tokens")
+	}
+	if ring.Pending() != nil {
+		t.Error("pending key left after rotation")
+	}
+}
+
+func TestHS256KeyIDDerivedFromSecret(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, TOKEN_HS256_KEY_SIZE)
+	first, err := NewHS256Key(secret)
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	again, err := NewHS256Key(append([]byte(nil), secret...))
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	other, err := NewHS256Key(bytes.Repeat([]byte{8}, TOKEN_HS256_KEY_SIZE))
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+
+	if keyID(first) != keyID(again) {
+		t.Errorf("same secret gave kids %q and %q", keyID(first), keyID(again))
+	}
+	if keyID(first) == keyID(other) {
+		t.Error("different secrets share a kid")
+	}
+	if len(NewKeyRing(first, 0, 0).JWKS().Keys) != 0 {
+		t.Error("HS256 key published in the JWKS")
+	}
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"vivian.infra/utils"
+)
+
+const (
+	LOCKOUT_MAX_ALIAS_FAILURES uint          = 5
+	LOCKOUT_MAX_IP_FAILURES    uint          = 20
+	LOCKOUT_IP_GRACE           uint          = 5
+	LOCKOUT_BASE_DELAY         time.Duration = time.Second
+	LOCKOUT_MAX_DELAY          time.Duration = 2 * time.Minute
+	LOCKOUT_DURATION           time.Duration = 15 * time.Minute
+	LOCKOUT_WINDOW             time.Duration = 15 * time.Minute
+)
+
+// LockoutError is returned while an alias or address must wait before it may
+// attempt verification again. Locked distinguishes the hard lockout that
+// follows too many failures from the exponential backoff between attempts.
+type LockoutError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LockoutError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many failed attempts, locked for %v", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many attempts, retry in %v", e.RetryAfter.Round(time.Second))
+}
+
+type attemptRecord struct {
+	Failures     uint      `json:"failures"`
+	LastFailure  time.Time `json:"last_failure"`
+	BlockedUntil time.Time `json:"blocked_until"`
+	Locked       bool      `json:"locked"`
+}
+
+func (r *attemptRecord) stale(now time.Time) bool {
+	return now.Sub(r.LastFailure) > LOCKOUT_WINDOW && !now.Before(r.BlockedUntil)
+}
+
+// AttemptTracker counts failed verifications per alias and per client
+// address in the STATE_BUCKET_ATTEMPTS bucket of a StateStore, so a lockout
+// outlasts a restart. The two are tracked separately so that one address
+// cannot lock every alias, and one alias cannot be guessed at from many
+// addresses.
+type AttemptTracker struct {
+	store StateStore
+}
+
+func NewAttemptTracker(store StateStore) *AttemptTracker {
+	return &AttemptTracker{store: store}
+}
+
+func aliasAttemptKey(alias string) string {
+	return "alias:" + alias
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns a *LockoutError if either alias or ip is still waiting out
+// a backoff or lockout.
+func (t *AttemptTracker) Check(alias, ip string) error {
+	now := time.Now()
+	var lockout *LockoutError
+	for _, key := range []string{aliasAttemptKey(alias), ipAttemptKey(ip)} {
+		var record attemptRecord
+		ok, err := loadState(t.store, STATE_BUCKET_ATTEMPTS, key, &record)
+		if err != nil {
+			return err
+		}
+		if !ok || !now.Before(record.BlockedUntil) {
+			continue
+		}
+		wait := record.BlockedUntil.Sub(now)
+		if lockout == nil || wait > lockout.RetryAfter {
+			lockout = &LockoutError{RetryAfter: wait, Locked: record.Locked}
+		}
+	}
+
+	if lockout == nil {
+		return nil
+	}
+	return lockout
+}
+
+// RecordFailure counts a failed verification against alias and ip. Every
+// failure doubles the wait before the next attempt, though an address is
+// allowed LOCKOUT_IP_GRACE failures first since it may be shared by several
+// users. Once alias reaches
+// LOCKOUT_MAX_ALIAS_FAILURES it is locked out and its outstanding challenge
+// with authenticator is invalidated, and the resulting *LockoutError is
+// returned.
+func (t *AttemptTracker) RecordFailure(ctx context.Context, alias, ip string, authenticator Authenticator2FA, s *utils.VivianLogger) error {
+	now := time.Now()
+	aliasRecord, err := t.fail(aliasAttemptKey(alias), 0, LOCKOUT_MAX_ALIAS_FAILURES, now)
+	if err != nil {
+		s.LogError("failure recording failed attempt", err)
+		return err
+	}
+	ipRecord, err := t.fail(ipAttemptKey(ip), LOCKOUT_IP_GRACE, LOCKOUT_MAX_IP_FAILURES, now)
+	if err != nil {
+		s.LogError("failure recording failed attempt", err)
+		return err
+	}
+
+	if ipRecord.Locked {
+		s.LogWarning(fmt.Sprintf("locked out %v after %v failed attempts", ip, ipRecord.Failures))
+	}
+	if !aliasRecord.Locked {
+		return nil
+	}
+
+	s.LogWarning(fmt.Sprintf("locked out %v after %v failed attempts", alias, aliasRecord.Failures))
+	if err := authenticator.ExpireAuthentication2FA(ctx, alias, s); err == nil {
+		s.LogWarning(fmt.Sprintf("invalidated outstanding 2FA key for %v", alias))
+	}
+	return &LockoutError{RetryAfter: aliasRecord.BlockedUntil.Sub(now), Locked: true}
+}
+
+// RecordSuccess forgets the failures of alias. The address keeps its history
+// so that a valid login does not reset a spray across other aliases.
+func (t *AttemptTracker) RecordSuccess(alias string) error {
+	return updateState(t.store, STATE_BUCKET_ATTEMPTS, aliasAttemptKey(alias), func(*attemptRecord) (*attemptRecord, error) {
+		return nil, nil
+	})
+}
+
+func (t *AttemptTracker) fail(key string, grace, maxFailures uint, now time.Time) (attemptRecord, error) {
+	var result attemptRecord
+	err := updateState(t.store, STATE_BUCKET_ATTEMPTS, key, func(record *attemptRecord) (*attemptRecord, error) {
+		if record == nil || record.stale(now) {
+			record = &attemptRecord{}
+		}
+
+		record.Failures++
+		record.LastFailure = now
+		if record.Failures >= maxFailures {
+			record.Locked = true
+			record.BlockedUntil = now.Add(LOCKOUT_DURATION)
+		} else if record.Failures > grace {
+			delay := LOCKOUT_BASE_DELAY << (record.Failures - grace - 1)
+			if delay > LOCKOUT_MAX_DELAY || delay <= 0 {
+				delay = LOCKOUT_MAX_DELAY
+			}
+			record.BlockedUntil = now.Add(delay)
+		}
+		result = *record
+		return record, nil
+	})
+	return result, err
+}
+
+// Prune drops records whose lockout has passed and whose failures have
+// fallen out of LOCKOUT_WINDOW.
+func (t *AttemptTracker) Prune(now time.Time) error {
+	_, err := sweepState(t.store, STATE_BUCKET_ATTEMPTS, func(_ string, record *attemptRecord) bool {
+		return record.stale(now)
+	})
+	return err
+}
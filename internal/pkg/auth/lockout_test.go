@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAttemptTrackerBackoff(t *testing.T) {
+	cases := []struct {
+		name     string
+		grace    uint
+		max      uint
+		failures uint
+		wait     time.Duration
+		locked   bool
+	}{
+		{"alias first failure", 0, LOCKOUT_MAX_ALIAS_FAILURES, 1, LOCKOUT_BASE_DELAY, false},
+		{"alias second failure", 0, LOCKOUT_MAX_ALIAS_FAILURES, 2, 2 * LOCKOUT_BASE_DELAY, false},
+		{"alias fourth failure", 0, LOCKOUT_MAX_ALIAS_FAILURES, 4, 8 * LOCKOUT_BASE_DELAY, false},
+		{"alias locked", 0, LOCKOUT_MAX_ALIAS_FAILURES, LOCKOUT_MAX_ALIAS_FAILURES, LOCKOUT_DURATION, true},
+		{"ip within grace", LOCKOUT_IP_GRACE, LOCKOUT_MAX_IP_FAILURES, LOCKOUT_IP_GRACE, 0, false},
+		{"ip past grace", LOCKOUT_IP_GRACE, LOCKOUT_MAX_IP_FAILURES, LOCKOUT_IP_GRACE + 1, LOCKOUT_BASE_DELAY, false},
+		{"ip capped", LOCKOUT_IP_GRACE, LOCKOUT_MAX_IP_FAILURES, LOCKOUT_MAX_IP_FAILURES - 1, LOCKOUT_MAX_DELAY, false},
+		{"ip locked", LOCKOUT_IP_GRACE, LOCKOUT_MAX_IP_FAILURES, LOCKOUT_MAX_IP_FAILURES, LOCKOUT_DURATION, true},
+	}
+	for _, c := range cases {
+		tracker := NewAttemptTracker(NewMemoryStateStore())
+		now := time.Now()
+		var record attemptRecord
+		for i := uint(0); i < c.failures; i++ {
+			var err error
+			if record, err = tracker.fail("key", c.grace, c.max, now); err != nil {
+				t.Fatalf("%v: fail: %v", c.name, err)
+			}
+		}
+		if record.Failures != c.failures || record.Locked != c.locked {
+			t.Errorf("%v: record = %+v, want %v failures, locked %v", c.name, record, c.failures, c.locked)
+		}
+		wait := record.BlockedUntil.Sub(now)
+		if record.BlockedUntil.IsZero() {
+			wait = 0
+		}
+		if wait != c.wait {
+			t.Errorf("%v: wait = %v, want %v", c.name, wait, c.wait)
+		}
+	}
+}
+
+func TestAttemptTrackerForgetsStaleFailures(t *testing.T) {
+	tracker := NewAttemptTracker(NewMemoryStateStore())
+	past := time.Now().Add(-2 * LOCKOUT_WINDOW)
+	for i := 0; i < 3; i++ {
+		if _, err := tracker.fail("key", 0, LOCKOUT_MAX_ALIAS_FAILURES, past); err != nil {
+			t.Fatalf("fail: %v", err)
+		}
+	}
+
+	record, err := tracker.fail("key", 0, LOCKOUT_MAX_ALIAS_FAILURES, time.Now())
+	if err != nil {
+		t.Fatalf("fail: %v", err)
+	}
+	if record.Failures != 1 {
+		t.Errorf("failures after the window = %v, want 1", record.Failures)
+	}
+
+	if err := tracker.Prune(time.Now().Add(2 * LOCKOUT_WINDOW)); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if ok, _ := loadState(tracker.store, STATE_BUCKET_ATTEMPTS, "key", &record); ok {
+		t.Error("stale record survived prune")
+	}
+}
+
+func TestAttemptTrackerRetryAfter(t *testing.T) {
+	ctx := context.Background()
+	s := testLogger(t)
+	tracker := NewAttemptTracker(NewMemoryStateStore())
+	challenges := NewChallengeAuthenticator(NewMemoryStateStore(), 0)
+
+	if err := tracker.Check("bella", "192.0.2.1"); err != nil {
+		t.Fatalf("check before any failure = %v", err)
+	}
+	if err := tracker.RecordFailure(ctx, "bella", "192.0.2.1", challenges, s); err != nil {
+		t.Fatalf("record failure: %v", err)
+	}
+
+	var lockout *LockoutError
+	if err := tracker.Check("bella", "192.0.2.2"); !errors.As(err, &lockout) {
+		t.Fatalf("check after a failure = %v, want *LockoutError", err)
+	}
+	if lockout.Locked || lockout.RetryAfter <= 0 || lockout.RetryAfter > LOCKOUT_BASE_DELAY {
+		t.Errorf("lockout = %+v, want a backoff of at most %v", lockout, LOCKOUT_BASE_DELAY)
+	}
+	if err := tracker.Check("ethan", "192.0.2.1"); err != nil {
+		t.Errorf("address within its grace blocked another alias: %v", err)
+	}
+
+	if err := tracker.RecordSuccess("bella"); err != nil {
+		t.Fatalf("record success: %v", err)
+	}
+	if err := tracker.Check("bella", "192.0.2.1"); err != nil {
+		t.Errorf("check after success = %v, want nil", err)
+	}
+}
+
+func TestAttemptTrackerLockoutExpiresChallenge(t *testing.T) {
+	ctx := context.Background()
+	s := testLogger(t)
+	tracker := NewAttemptTracker(NewMemoryStateStore())
+	challenges := NewChallengeAuthenticator(NewMemoryStateStore(), 0)
+
+	key, err := challenges.GenerateAuthKey2FA(ctx, "bella", s)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	var lockout *LockoutError
+	for i := uint(1); i <= LOCKOUT_MAX_ALIAS_FAILURES; i++ {
+		err := tracker.RecordFailure(ctx, "bella", "192.0.2.1", challenges, s)
+		if i < LOCKOUT_MAX_ALIAS_FAILURES && err != nil {
+			t.Fatalf("failure %v: %v", i, err)
+		}
+		if i == LOCKOUT_MAX_ALIAS_FAILURES && !errors.As(err, &lockout) {
+			t.Fatalf("failure %v = %v, want *LockoutError", i, err)
+		}
+	}
+	if !lockout.Locked || lockout.RetryAfter != LOCKOUT_DURATION {
+		t.Errorf("lockout = %+v, want locked for %v", lockout, LOCKOUT_DURATION)
+	}
+	if err := tracker.Check("bella", "192.0.2.2"); !errors.As(err, &lockout) || !lockout.Locked {
+		t.Errorf("check while locked = %v, want a hard lockout", err)
+	}
+	if ok, _ := challenges.VerifyAuthKey2FA(ctx, "bella", key, s); ok {
+		t.Error("challenge outstanding at lockout still verified")
+	}
+}
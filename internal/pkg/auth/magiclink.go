@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MAGIC_LINK_LIFETIME   time.Duration = 10 * time.Minute
+	MAGIC_LINK_NONCE_SIZE int           = 32
+	// MAGIC_LINK_REISSUE_AFTER is how long a link is protected from being
+	// replaced by another request for the same alias.
+	MAGIC_LINK_REISSUE_AFTER time.Duration = time.Minute
+	// MAGIC_LINK_CONTEXT is prefixed to everything signed, so that a link
+	// signature is never valid as anything else made with the same secret.
+	MAGIC_LINK_CONTEXT string = "vivian.infra magic link\x00"
+)
+
+var ErrInvalidMagicLink = errors.New("invalid or expired login link")
+
+// RecentMagicLinkError is returned by Issue while the outstanding link of an
+// alias is too recent to be replaced.
+type RecentMagicLinkError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RecentMagicLinkError) Error() string {
+	return fmt.Sprintf("a login link was sent moments ago, retry in %v", e.RetryAfter.Round(time.Second))
+}
+
+type magicLinkClaims struct {
+	Subject   string `json:"sub"`
+	ID        string `json:"jti"`
+	ExpiresAt int64  `json:"exp"`
+	// NonceHash is the SHA-256 of the nonce held by the browser that asked
+	// for the link.
+	NonceHash string `json:"nonce_hash"`
+}
+
+type magicLinkRecord struct {
+	id        string
+	issuedAt  time.Time
+	expiresAt time.Time
+}
+
+// MagicLinks signs emailed login links. A link is bound to the browser that
+// requested it through a nonce kept in a cookie there, and only the most
+// recent link of an alias can be redeemed, once.
+type MagicLinks struct {
+	mu       sync.Mutex
+	key      *SigningKey
+	lifetime time.Duration
+	// outstanding holds the ID of the link each alias may still redeem.
+	outstanding map[string]magicLinkRecord
+}
+
+// NewMagicLinks signs links with key, which must be an HS256 key, and keeps
+// them valid for lifetime, or MAGIC_LINK_LIFETIME when lifetime is not
+// positive.
+func NewMagicLinks(key *SigningKey, lifetime time.Duration) (*MagicLinks, error) {
+	if key == nil || key.Algorithm != TOKEN_ALG_HS256 {
+		return nil, errors.New("magic links need an HS256 key")
+	}
+	if lifetime <= 0 {
+		lifetime = MAGIC_LINK_LIFETIME
+	}
+	return &MagicLinks{key: key, lifetime: lifetime, outstanding: make(map[string]magicLinkRecord)}, nil
+}
+
+func (m *MagicLinks) Lifetime() time.Duration {
+	return m.lifetime
+}
+
+// Issue returns a signed link token for alias together with the nonce the
+// requesting browser has to present when redeeming it. Earlier links of
+// alias stop working, unless the outstanding one was issued less than
+// MAGIC_LINK_REISSUE_AFTER ago, in which case it is kept and a
+// *RecentMagicLinkError returned, so that requests made by someone else
+// cannot keep invalidating the link the owner is about to open.
+func (m *MagicLinks) Issue(alias string) (string, string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	rawNonce := make([]byte, MAGIC_LINK_NONCE_SIZE)
+	if _, err := rand.Read(rawNonce); err != nil {
+		return "", "", err
+	}
+	nonce := tokenEncoding.EncodeToString(rawNonce)
+	nonceHash := sha256.Sum256([]byte(nonce))
+
+	now := time.Now()
+	expiresAt := now.Add(m.lifetime)
+	claims := magicLinkClaims{
+		Subject:   alias,
+		ID:        hex.EncodeToString(id),
+		ExpiresAt: expiresAt.Unix(),
+		NonceHash: tokenEncoding.EncodeToString(nonceHash[:]),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", "", err
+	}
+	encoded := tokenEncoding.EncodeToString(payload)
+	token := encoded + "." + tokenEncoding.EncodeToString(m.key.sign([]byte(MAGIC_LINK_CONTEXT+encoded)))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if record, ok := m.outstanding[alias]; ok && now.Sub(record.issuedAt) < MAGIC_LINK_REISSUE_AFTER && now.Before(record.expiresAt) {
+		return "", "", &RecentMagicLinkError{RetryAfter: MAGIC_LINK_REISSUE_AFTER - now.Sub(record.issuedAt)}
+	}
+	m.outstanding[alias] = magicLinkRecord{id: claims.ID, issuedAt: now, expiresAt: expiresAt}
+	return token, nonce, nil
+}
+
+// Redeem checks token and the nonce presented with it and returns the alias
+// the link was issued to. The link is consumed only once it has been
+// presented by the browser that requested it, so opening it elsewhere does
+// not burn it.
+func (m *MagicLinks) Redeem(token, nonce string) (string, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrInvalidMagicLink
+	}
+	rawSignature, err := tokenEncoding.DecodeString(signature)
+	if err != nil || !m.key.verify([]byte(MAGIC_LINK_CONTEXT+encoded), rawSignature) {
+		return "", ErrInvalidMagicLink
+	}
+	payload, err := tokenEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrInvalidMagicLink
+	}
+	var claims magicLinkClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || len(claims.Subject) <= 0 {
+		return "", ErrInvalidMagicLink
+	}
+	if time.Now().After(time.Unix(claims.ExpiresAt, 0)) {
+		return "", ErrInvalidMagicLink
+	}
+
+	nonceHash := sha256.Sum256([]byte(nonce))
+	if subtle.ConstantTimeCompare([]byte(tokenEncoding.EncodeToString(nonceHash[:])), []byte(claims.NonceHash)) != 1 {
+		return "", ErrInvalidMagicLink
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, ok := m.outstanding[claims.Subject]
+	if !ok || record.id != claims.ID {
+		return "", ErrInvalidMagicLink
+	}
+	delete(m.outstanding, claims.Subject)
+	return claims.Subject, nil
+}
+
+// RunPruner forgets links that expired unredeemed, every interval until ctx
+// is done.
+func (m *MagicLinks) RunPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for alias, record := range m.outstanding {
+				if now.After(record.expiresAt) {
+					delete(m.outstanding, alias)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
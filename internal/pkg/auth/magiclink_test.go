@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testMagicLinks(t *testing.T) *MagicLinks {
+	key, err := GenerateSigningKey(TOKEN_ALG_HS256)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	links, err := NewMagicLinks(key, 0)
+	if err != nil {
+		t.Fatalf("new magic links: %v", err)
+	}
+	return links
+}
+
+func TestMagicLinkSingleUse(t *testing.T) {
+	links := testMagicLinks(t)
+	token, nonce, err := links.Issue("bella")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+
+	// opening the link in another browser must not burn it
+	if _, err := links.Redeem(token, "another browser"); !errors.Is(err, ErrInvalidMagicLink) {
+		t.Errorf("redeem with the wrong nonce = %v, want ErrInvalidMagicLink", err)
+	}
+	alias, err := links.Redeem(token, nonce)
+	if err != nil || alias != "bella" {
+		t.Fatalf("redeem = %v, %v, want bella", alias, err)
+	}
+	if _, err := links.Redeem(token, nonce); !errors.Is(err, ErrInvalidMagicLink) {
+		t.Errorf("redeeming twice = %v, want ErrInvalidMagicLink", err)
+	}
+	if _, _, err := links.Issue("bella"); err != nil {
+		t.Errorf("issue after redeeming = %v, want a fresh link", err)
+	}
+}
+
+func TestMagicLinkRejectsForgery(t *testing.T) {
+	links := testMagicLinks(t)
+	token, nonce, err := links.Issue("bella")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+
+	encoded, signature, _ := strings.Cut(token, ".")
+	forged := []string{
+		encoded,
+		encoded + "." + signature[:len(signature)-2] + "AA",
+		tokenEncoding.EncodeToString([]byte(`{"sub":"ethan"}`)) + "." + signature,
+	}
+	for _, candidate := range forged {
+		if _, err := links.Redeem(candidate, nonce); !errors.Is(err, ErrInvalidMagicLink) {
+			t.Errorf("redeem %q = %v, want ErrInvalidMagicLink", candidate, err)
+		}
+	}
+	if _, err := testMagicLinks(t).Redeem(token, nonce); !errors.Is(err, ErrInvalidMagicLink) {
+		t.Errorf("redeem under another key = %v, want ErrInvalidMagicLink", err)
+	}
+}
+
+func TestMagicLinkNotReplacedWhileRecent(t *testing.T) {
+	links := testMagicLinks(t)
+	token, nonce, err := links.Issue("bella")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+
+	var recent *RecentMagicLinkError
+	if _, _, err := links.Issue("bella"); !errors.As(err, &recent) || recent.RetryAfter <= 0 {
+		t.Errorf("second issue = %v, want *RecentMagicLinkError", err)
+	}
+	if _, _, err := links.Issue("ethan"); err != nil {
+		t.Errorf("issue for another alias = %v", err)
+	}
+	if alias, err := links.Redeem(token, nonce); err != nil || alias != "bella" {
+		t.Errorf("first link after a second request = %v, %v, want bella", alias, err)
+	}
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	ONE_TIME_TOKEN_SIZE int = 32
+
+	PURPOSE_VERIFY_EMAIL   string = "verify-email"
+	PURPOSE_RESET_PASSWORD string = "reset-password"
+
+	VERIFY_EMAIL_LIFETIME   time.Duration = 24 * time.Hour
+	RESET_PASSWORD_LIFETIME time.Duration = 30 * time.Minute
+)
+
+var ErrInvalidOneTimeToken = errors.New("invalid or expired token")
+
+// OneTimeToken is an emailed, single-use token bound to one alias and one
+// purpose. Only its SHA-256 is kept, so a copy of the store cannot be used to
+// redeem anything.
+type OneTimeToken struct {
+	Purpose   string
+	Alias     string
+	ExpiresAt time.Time
+}
+
+type OneTimeStore struct {
+	mu     sync.Mutex
+	tokens map[[sha256.Size]byte]*OneTimeToken
+}
+
+var oneTimeStore = OneTimeStore{tokens: make(map[[sha256.Size]byte]*OneTimeToken)}
+
+// IssueOneTimeToken returns a token for alias that RedeemOneTimeToken will
+// accept once for purpose within lifetime. Earlier tokens of alias for the
+// same purpose are invalidated, so only the most recent email works.
+func IssueOneTimeToken(purpose, alias string, lifetime time.Duration) (string, error) {
+	raw := make([]byte, ONE_TIME_TOKEN_SIZE)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	oneTimeStore.mu.Lock()
+	defer oneTimeStore.mu.Unlock()
+
+	oneTimeStore.revoke(purpose, alias)
+	oneTimeStore.tokens[sha256.Sum256([]byte(token))] = &OneTimeToken{
+		Purpose:   purpose,
+		Alias:     alias,
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+	return token, nil
+}
+
+// RedeemOneTimeToken consumes token and returns the alias it was issued to.
+func RedeemOneTimeToken(purpose, token string) (string, error) {
+	hash := sha256.Sum256([]byte(token))
+
+	oneTimeStore.mu.Lock()
+	defer oneTimeStore.mu.Unlock()
+
+	record, ok := oneTimeStore.tokens[hash]
+	if !ok || record.Purpose != purpose {
+		return "", ErrInvalidOneTimeToken
+	}
+	delete(oneTimeStore.tokens, hash)
+	if time.Now().After(record.ExpiresAt) {
+		return "", ErrInvalidOneTimeToken
+	}
+	return record.Alias, nil
+}
+
+// PeekOneTimeToken returns the alias token was issued to without consuming
+// it, so that a request can be validated before the token is spent.
+func PeekOneTimeToken(purpose, token string) (string, error) {
+	hash := sha256.Sum256([]byte(token))
+
+	oneTimeStore.mu.Lock()
+	defer oneTimeStore.mu.Unlock()
+
+	record, ok := oneTimeStore.tokens[hash]
+	if !ok || record.Purpose != purpose || time.Now().After(record.ExpiresAt) {
+		return "", ErrInvalidOneTimeToken
+	}
+	return record.Alias, nil
+}
+
+// RevokeOneTimeTokens invalidates every outstanding token of alias for
+// purpose.
+func RevokeOneTimeTokens(purpose, alias string) {
+	oneTimeStore.mu.Lock()
+	defer oneTimeStore.mu.Unlock()
+	oneTimeStore.revoke(purpose, alias)
+}
+
+// revoke must be called with the store locked.
+func (o *OneTimeStore) revoke(purpose, alias string) {
+	for hash, record := range o.tokens {
+		if record.Purpose == purpose && record.Alias == alias {
+			delete(o.tokens, hash)
+		}
+	}
+}
+
+func (o *OneTimeStore) pruneOneTime(now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for hash, record := range o.tokens {
+		if now.After(record.ExpiresAt) {
+			delete(o.tokens, hash)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	PASSWORD_MIN_LENGTH   int = 8
+	PASSWORD_MAX_LENGTH   int = 256
+	PASSWORD_MIN_STRENGTH int = 2
+	PASSWORD_SIMILARITY   int = 2
+
+	POLICY_TOO_SHORT         string = "too_short"
+	POLICY_TOO_LONG          string = "too_long"
+	POLICY_CHARACTER_CLASSES string = "character_classes"
+	POLICY_SIMILAR           string = "similar_to_identity"
+	POLICY_TOO_WEAK          string = "too_weak"
+	POLICY_BREACHED          string = "breached"
+)
+
+// PolicyViolation is one reason a password was refused. Code is stable for
+// clients to match on; Message is for people.
+type PolicyViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicy decides which passwords may be set. MinClasses counts
+// lowercase, uppercase, digits and everything else. Breaches may be nil to
+// skip the breach check.
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	MinClasses    int
+	MinStrength   int
+	RejectSimilar bool
+	Breaches      *BreachCorpus
+}
+
+var (
+	passwordPolicyMu sync.RWMutex
+	passwordPolicy   = PasswordPolicy{
+		MinLength:     PASSWORD_MIN_LENGTH,
+		MaxLength:     PASSWORD_MAX_LENGTH,
+		MinClasses:    1,
+		MinStrength:   PASSWORD_MIN_STRENGTH,
+		RejectSimilar: true,
+	}
+)
+
+func SetPasswordPolicy(policy PasswordPolicy) {
+	passwordPolicyMu.Lock()
+	defer passwordPolicyMu.Unlock()
+	passwordPolicy = policy
+}
+
+func CurrentPasswordPolicy() PasswordPolicy {
+	passwordPolicyMu.RLock()
+	defer passwordPolicyMu.RUnlock()
+	return passwordPolicy
+}
+
+// CheckPassword applies the current policy to password for the account
+// identified by alias and email.
+func CheckPassword(password, alias, email string) ([]PolicyViolation, error) {
+	return CurrentPasswordPolicy().Check(password, alias, email)
+}
+
+// Check returns every rule password breaks. An error means the breach corpus
+// could not be read; the other rules have still been applied.
+func (p PasswordPolicy) Check(password, alias, email string) ([]PolicyViolation, error) {
+	violations := []PolicyViolation{}
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, PolicyViolation{POLICY_TOO_SHORT, fmt.Sprintf("password must be at least %d characters", p.MinLength)})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, PolicyViolation{POLICY_TOO_LONG, fmt.Sprintf("password must be at most %d characters", p.MaxLength)})
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		violations = append(violations, PolicyViolation{POLICY_CHARACTER_CLASSES, fmt.Sprintf("password must mix at least %d of lowercase, uppercase, digits and symbols", p.MinClasses)})
+	}
+
+	identity := identityTokens(alias, email)
+	if p.RejectSimilar && similarToIdentity(password, identity) {
+		violations = append(violations, PolicyViolation{POLICY_SIMILAR, "password is too similar to the alias or email address"})
+	}
+	if strength := EstimateStrength(password, identity...); strength < p.MinStrength {
+		violations = append(violations, PolicyViolation{POLICY_TOO_WEAK, fmt.Sprintf("password is too easy to guess (strength %d of 4, %d required)", strength, p.MinStrength)})
+	}
+
+	if p.Breaches == nil {
+		return violations, nil
+	}
+	count, err := p.Breaches.Count(password)
+	if err != nil {
+		return violations, err
+	}
+	if count > 0 {
+		violations = append(violations, PolicyViolation{POLICY_BREACHED, fmt.Sprintf("password has appeared in %d known breaches", count)})
+	}
+	return violations, nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// identityTokens are the parts of alias and email an attacker would try.
+func identityTokens(alias, email string) []string {
+	var tokens []string
+	for _, token := range []string{alias, email} {
+		if len(token) > 0 {
+			tokens = append(tokens, strings.ToLower(token))
+		}
+	}
+	if local, domain, ok := strings.Cut(strings.ToLower(email), "@"); ok {
+		tokens = append(tokens, local)
+		if name, _, ok := strings.Cut(domain, "."); ok {
+			tokens = append(tokens, name)
+		}
+	}
+	return tokens
+}
+
+// similarToIdentity reports whether password, stripped to letters and
+// digits, contains an identity token of at least ALIAS_MIN_LENGTH characters
+// or is within PASSWORD_SIMILARITY edits of one.
+func similarToIdentity(password string, identity []string) bool {
+	normalized := sanitize(strings.ToLower(password))
+	for _, token := range identity {
+		token = sanitize(token)
+		if len(token) < ALIAS_MIN_LENGTH {
+			continue
+		}
+		if strings.Contains(normalized, token) || levenshtein(normalized, token) <= PASSWORD_SIMILARITY {
+			return true
+		}
+	}
+	return false
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPasswordPolicyViolations(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:     8,
+		MaxLength:     16,
+		MinClasses:    3,
+		MinStrength:   PASSWORD_MIN_STRENGTH,
+		RejectSimilar: true,
+		Breaches:      NewBreachCorpus(testBreachCorpus),
+	}
+
+	cases := []struct {
+		password string
+		want     []string
+	}{
+		{"kT9#vQ2!mZ", nil},
+		{"kT9#", []string{POLICY_TOO_SHORT, POLICY_TOO_WEAK}},
+		{"kT9#vQ2!mZkT9#vQ2!", []string{POLICY_TOO_LONG}},
+		{"kqtpvwzxmr", []string{POLICY_CHARACTER_CLASSES}},
+		{"Bella#2024", []string{POLICY_SIMILAR, POLICY_TOO_WEAK}},
+		{"Q7!xio-b.ella", []string{POLICY_SIMILAR}},
+		{"password", []string{POLICY_CHARACTER_CLASSES, POLICY_TOO_WEAK, POLICY_BREACHED}},
+		{"hunter2", []string{POLICY_TOO_SHORT, POLICY_CHARACTER_CLASSES, POLICY_TOO_WEAK, POLICY_BREACHED}},
+	}
+	for _, c := range cases {
+		violations, err := policy.Check(c.password, "bella", "b.ella@x.io")
+		if err != nil {
+			t.Errorf("%q: check: %v", c.password, err)
+		}
+		if violations == nil {
+			t.Errorf("%q: nil violations, which encode as null", c.password)
+		}
+		var codes []string
+		for _, violation := range violations {
+			codes = append(codes, violation.Code)
+			if len(violation.Message) <= 0 {
+				t.Errorf("%q: %v has no message", c.password, violation.Code)
+			}
+		}
+		if !slices.Equal(codes, c.want) {
+			t.Errorf("%q: violations %v, want %v", c.password, codes, c.want)
+		}
+	}
+}
+
+func TestPasswordPolicyUnreadableCorpus(t *testing.T) {
+	// a directory in place of the range file of "password" cannot be read.
+	directory := t.TempDir()
+	if err := os.Mkdir(filepath.Join(directory, "5BAA6.txt"), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	policy := CurrentPasswordPolicy()
+	policy.Breaches = NewBreachCorpus(directory)
+
+	violations, err := policy.Check("password", "bella", "b@x.io")
+	if err == nil {
+		t.Error("unreadable corpus reported no error")
+	}
+	if len(violations) <= 0 {
+		t.Error("the other rules were not applied")
+	}
+}
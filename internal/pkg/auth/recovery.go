@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"vivian.infra/utils"
+)
+
+const (
+	RECOVERY_CODE_COUNT int    = 10
+	RECOVERY_CODE_SIZE  int    = 10
+	RECOVERY_CHARSET    string = "ABCDEFGHJKMNPQRSTVWXYZ23456789"
+)
+
+var ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+
+// recoveryCodes are split in two halves for readability.
+var recoveryCodes = mustCodeGenerator(RECOVERY_CHARSET, RECOVERY_CODE_SIZE, RECOVERY_CODE_SIZE/2)
+
+// recoveryBatch is the set of single-use recovery codes issued to an alias,
+// kept in the STATE_BUCKET_RECOVERY bucket. Only the hashes are kept; a used
+// code has its slot cleared.
+type recoveryBatch struct {
+	ID        string    `json:"id"`
+	Hashes    []string  `json:"hashes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (b *recoveryBatch) remaining() int {
+	count := 0
+	for _, hash := range b.Hashes {
+		if len(hash) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// RecoveryAuthenticator implements Enroller2FA with batches of single-use
+// codes the owner keeps for when their other factors are unavailable.
+type RecoveryAuthenticator struct {
+	store StateStore
+}
+
+var _ Remover2FA = (*RecoveryAuthenticator)(nil)
+
+func NewRecoveryAuthenticator(store StateStore) *RecoveryAuthenticator {
+	return &RecoveryAuthenticator{store: store}
+}
+
+// Enroll issues a fresh batch of codes for alias, invalidating any earlier
+// batch, and returns the plaintext codes. They are not retained and cannot
+// be shown again. Codes are hashed with HashKeyphrase rather than under the
+// secret key, so a batch outlives any change of key; VerifySecret still
+// accepts batches hashed under it.
+func (r *RecoveryAuthenticator) Enroll(ctx context.Context, alias string, s *utils.VivianLogger) (Enrollment, error) {
+	codes := make([]string, RECOVERY_CODE_COUNT)
+	hashes := make([]string, RECOVERY_CODE_COUNT)
+	for i := range codes {
+		code, formatted, err := recoveryCodes.Generate()
+		if err != nil {
+			s.LogError("failure generating recovery code", err)
+			return Enrollment{}, err
+		}
+		hash, err := HashKeyphrase(ctx, code)
+		if err != nil {
+			s.LogError("failure during hashing process", err)
+			return Enrollment{}, err
+		}
+		codes[i], hashes[i] = formatted, hash
+	}
+	id, err := newChallengeID()
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	replaced := false
+	err = updateState(r.store, STATE_BUCKET_RECOVERY, alias, func(current *recoveryBatch) (*recoveryBatch, error) {
+		replaced = current != nil
+		return &recoveryBatch{ID: id, Hashes: hashes, CreatedAt: time.Now()}, nil
+	})
+	if err != nil {
+		s.LogError("failure storing recovery codes", err)
+		return Enrollment{}, err
+	}
+
+	if replaced {
+		s.LogWarning(fmt.Sprintf("audit: recovery codes regenerated for %v, previous batch invalidated", alias))
+	} else {
+		s.LogSuccess(fmt.Sprintf("audit: recovery codes generated for %v", alias))
+	}
+	return Enrollment{Codes: codes}, nil
+}
+
+// GenerateAuthKey2FA returns ErrNotGenerated: recovery codes are only ever
+// shown when their batch is enrolled.
+func (r *RecoveryAuthenticator) GenerateAuthKey2FA(context.Context, string, *utils.VivianLogger) (string, error) {
+	return "", ErrNotGenerated
+}
+
+// VerifyAuthKey2FA consumes exactly one matching code from the batch of
+// alias.
+func (r *RecoveryAuthenticator) VerifyAuthKey2FA(_ context.Context, alias, code string, s *utils.VivianLogger) (bool, error) {
+	code, valid := recoveryCodes.Normalize(code)
+	if !valid {
+		s.LogWarning(fmt.Sprintf("audit: malformed recovery code submitted for %v", alias))
+		return false, ErrInvalidRecoveryCode
+	}
+
+	var batch recoveryBatch
+	ok, err := loadState(r.store, STATE_BUCKET_RECOVERY, alias, &batch)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		s.LogWarning(fmt.Sprintf("audit: recovery attempted for %v without issued codes", alias))
+		return false, errors.New("no recovery codes have been generated")
+	}
+
+	for i, hash := range batch.Hashes {
+		if len(hash) <= 0 || !VerifySecret(hash, code) {
+			continue
+		}
+
+		// the batch may have been regenerated, or the code redeemed by a
+		// concurrent request, while the hashes were being compared.
+		remaining := 0
+		err := updateState(r.store, STATE_BUCKET_RECOVERY, alias, func(current *recoveryBatch) (*recoveryBatch, error) {
+			if current == nil || current.ID != batch.ID || current.Hashes[i] != hash {
+				return nil, ErrInvalidRecoveryCode
+			}
+			current.Hashes[i] = ""
+			remaining = current.remaining()
+			return current, nil
+		})
+		if errors.Is(err, ErrInvalidRecoveryCode) {
+			break
+		}
+		if err != nil {
+			s.LogError("failure storing recovery codes", err)
+			return false, err
+		}
+
+		s.LogSuccess(fmt.Sprintf("audit: recovery code used for %v, %v remaining", alias, remaining))
+		return true, nil
+	}
+
+	s.LogWarning(fmt.Sprintf("audit: invalid recovery code submitted for %v", alias))
+	return false, ErrInvalidRecoveryCode
+}
+
+// Enrolled reports whether alias has unused recovery codes left.
+func (r *RecoveryAuthenticator) Enrolled(_ context.Context, alias string) (bool, error) {
+	var batch recoveryBatch
+	ok, err := loadState(r.store, STATE_BUCKET_RECOVERY, alias, &batch)
+	return ok && batch.remaining() > 0, err
+}
+
+// Remove2FA invalidates the whole batch of alias.
+func (r *RecoveryAuthenticator) Remove2FA(ctx context.Context, alias string, s *utils.VivianLogger) error {
+	return r.ExpireAuthentication2FA(ctx, alias, s)
+}
+
+// ExpireAuthentication2FA invalidates the whole batch of alias.
+func (r *RecoveryAuthenticator) ExpireAuthentication2FA(_ context.Context, alias string, s *utils.VivianLogger) error {
+	err := updateState(r.store, STATE_BUCKET_RECOVERY, alias, func(current *recoveryBatch) (*recoveryBatch, error) {
+		if current == nil {
+			return nil, errors.New("no recovery codes have been generated")
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.LogWarning(fmt.Sprintf("audit: recovery codes of %v invalidated", alias))
+	return nil
+}
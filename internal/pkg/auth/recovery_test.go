@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	useTestHasher(t)
+	ctx := context.Background()
+	s := testLogger(t)
+	recovery := NewRecoveryAuthenticator(NewMemoryStateStore())
+
+	enrollment, err := recovery.Enroll(ctx, "bella", s)
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if len(enrollment.Codes) != RECOVERY_CODE_COUNT {
+		t.Fatalf("enrolled %v codes, want %v", len(enrollment.Codes), RECOVERY_CODE_COUNT)
+	}
+
+	code := enrollment.Codes[3]
+	if ok, err := recovery.VerifyAuthKey2FA(ctx, "bella", strings.ToLower(code), s); !ok || err != nil {
+		t.Fatalf("redeem = %v, %v, want true", ok, err)
+	}
+	if _, err := recovery.VerifyAuthKey2FA(ctx, "bella", code, s); !errors.Is(err, ErrInvalidRecoveryCode) {
+		t.Errorf("redeeming twice = %v, want ErrInvalidRecoveryCode", err)
+	}
+	if _, err := recovery.VerifyAuthKey2FA(ctx, "ethan", enrollment.Codes[4], s); err == nil {
+		t.Error("redeemed a code of another alias")
+	}
+}
+
+func TestRecoveryRegenerationInvalidatesBatch(t *testing.T) {
+	useTestHasher(t)
+	ctx := context.Background()
+	s := testLogger(t)
+	recovery := NewRecoveryAuthenticator(NewMemoryStateStore())
+
+	first, err := recovery.Enroll(ctx, "bella", s)
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	second, err := recovery.Enroll(ctx, "bella", s)
+	if err != nil {
+		t.Fatalf("regenerate: %v", err)
+	}
+	if _, err := recovery.VerifyAuthKey2FA(ctx, "bella", first.Codes[0], s); !errors.Is(err, ErrInvalidRecoveryCode) {
+		t.Errorf("code of replaced batch = %v, want ErrInvalidRecoveryCode", err)
+	}
+	if ok, err := recovery.VerifyAuthKey2FA(ctx, "bella", second.Codes[0], s); !ok || err != nil {
+		t.Errorf("code of current batch = %v, %v, want true", ok, err)
+	}
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	REFRESH_TOKEN_SIZE     int           = 32
+	REFRESH_TOKEN_LIFETIME time.Duration = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token has already been used")
+)
+
+// RefreshToken is the server-side record of one opaque refresh token, keyed
+// by the SHA-256 of the token. A token is single use: rotating it marks it
+// used and issues its successor in the same family.
+type RefreshToken struct {
+	FamilyID  string
+	Alias     string
+	used      bool
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// RefreshFamily groups every token descended from one login. Presenting a
+// token that was already rotated means it was copied, so the whole family is
+// revoked and the legitimate holder has to log in again.
+type RefreshFamily struct {
+	ID        string
+	Alias     string
+	revoked   bool
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type RefreshStore struct {
+	mu       sync.Mutex
+	tokens   map[[sha256.Size]byte]*RefreshToken
+	families map[string]*RefreshFamily
+}
+
+var refreshStore = RefreshStore{
+	tokens:   make(map[[sha256.Size]byte]*RefreshToken),
+	families: make(map[string]*RefreshFamily),
+}
+
+// IssueRefreshToken starts a new family for alias and returns its first
+// token along with the family ID.
+func IssueRefreshToken(alias string) (string, string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	family := &RefreshFamily{ID: hex.EncodeToString(id), Alias: alias, CreatedAt: now, ExpiresAt: now.Add(REFRESH_TOKEN_LIFETIME)}
+
+	refreshStore.mu.Lock()
+	defer refreshStore.mu.Unlock()
+
+	refreshStore.families[family.ID] = family
+	token, err := refreshStore.issue(family, now)
+	return token, family.ID, err
+}
+
+// RotateRefreshToken consumes token and returns its alias and family along
+// with the token that replaces it. Reuse of a consumed token revokes the
+// family and returns ErrRefreshTokenReused with the alias and family filled
+// in for logging.
+func RotateRefreshToken(token string) (string, string, string, error) {
+	hash := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	refreshStore.mu.Lock()
+	defer refreshStore.mu.Unlock()
+
+	record, ok := refreshStore.tokens[hash]
+	if !ok {
+		return "", "", "", ErrInvalidRefreshToken
+	}
+	family, ok := refreshStore.families[record.FamilyID]
+	if !ok || family.revoked {
+		return record.Alias, record.FamilyID, "", ErrInvalidRefreshToken
+	}
+	if record.used {
+		family.revoked = true
+		return record.Alias, record.FamilyID, "", ErrRefreshTokenReused
+	}
+	if now.After(record.ExpiresAt) {
+		return record.Alias, record.FamilyID, "", ErrInvalidRefreshToken
+	}
+
+	record.used = true
+	next, err := refreshStore.issue(family, now)
+	if err != nil {
+		return "", "", "", err
+	}
+	return record.Alias, record.FamilyID, next, nil
+}
+
+// RevokeRefreshFamily revokes a single family, as on logout.
+func RevokeRefreshFamily(familyID string) {
+	refreshStore.mu.Lock()
+	defer refreshStore.mu.Unlock()
+
+	if family, ok := refreshStore.families[familyID]; ok {
+		family.revoked = true
+	}
+}
+
+// RevokeRefreshFamilies revokes every family belonging to alias and returns
+// how many were still live.
+func RevokeRefreshFamilies(alias string) int {
+	refreshStore.mu.Lock()
+	defer refreshStore.mu.Unlock()
+
+	count := 0
+	for _, family := range refreshStore.families {
+		if family.Alias == alias && !family.revoked {
+			family.revoked = true
+			count++
+		}
+	}
+	return count
+}
+
+// familyActive reports whether family id exists, is not revoked and has not
+// expired.
+func (r *RefreshStore) familyActive(id string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	family, ok := r.families[id]
+	return ok && !family.revoked && !now.After(family.ExpiresAt)
+}
+
+// issue must be called with the store locked. A token never outlives its
+// family.
+func (r *RefreshStore) issue(family *RefreshFamily, now time.Time) (string, error) {
+	raw := make([]byte, REFRESH_TOKEN_SIZE)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	r.tokens[sha256.Sum256([]byte(token))] = &RefreshToken{
+		FamilyID:  family.ID,
+		Alias:     family.Alias,
+		CreatedAt: now,
+		ExpiresAt: family.ExpiresAt,
+	}
+	return token, nil
+}
+
+// pruneRefresh forgets expired families and their tokens. Used tokens of
+// live families are kept, since they are what reuse is detected by.
+func (r *RefreshStore) pruneRefresh(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for hash, token := range r.tokens {
+		if now.After(token.ExpiresAt) {
+			delete(r.tokens, hash)
+		}
+	}
+	for id, family := range r.families {
+		if now.After(family.ExpiresAt) {
+			delete(r.families, id)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	first, familyID, err := IssueRefreshToken("reuse")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	other, otherID, err := IssueRefreshToken("reuse")
+	if err != nil {
+		t.Fatalf("issue second family: %v", err)
+	}
+
+	alias, rotatedFamily, second, err := RotateRefreshToken(first)
+	if err != nil || alias != "reuse" || rotatedFamily != familyID {
+		t.Fatalf("rotate = %v, %v, %v, want the issued family", alias, rotatedFamily, err)
+	}
+
+	// the first token was copied; whoever presents it second gives it away.
+	alias, reusedFamily, next, err := RotateRefreshToken(first)
+	if !errors.Is(err, ErrRefreshTokenReused) || alias != "reuse" || reusedFamily != familyID || len(next) > 0 {
+		t.Fatalf("reuse = %v, %v, %q, %v, want ErrRefreshTokenReused for the family", alias, reusedFamily, next, err)
+	}
+	if _, _, _, err := RotateRefreshToken(second); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("successor after reuse = %v, want ErrInvalidRefreshToken", err)
+	}
+	if refreshStore.familyActive(familyID, time.Now()) {
+		t.Error("family still active after reuse")
+	}
+
+	if !refreshStore.familyActive(otherID, time.Now()) {
+		t.Error("reuse revoked another family of the alias")
+	}
+	if _, _, _, err := RotateRefreshToken(other); err != nil {
+		t.Errorf("rotate another family = %v", err)
+	}
+}
+
+func TestRefreshRevokeFamilies(t *testing.T) {
+	first, _, err := IssueRefreshToken("revoked")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	second, _, err := IssueRefreshToken("revoked")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	bystander, _, err := IssueRefreshToken("bystander")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+
+	if count := RevokeRefreshFamilies("revoked"); count != 2 {
+		t.Errorf("revoked %v families, want 2", count)
+	}
+	for _, token := range []string{first, second} {
+		if _, _, _, err := RotateRefreshToken(token); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("rotate revoked token = %v, want ErrInvalidRefreshToken", err)
+		}
+	}
+	if _, _, _, err := RotateRefreshToken(bystander); err != nil {
+		t.Errorf("rotate token of another alias = %v", err)
+	}
+}
+
+func TestRefreshPruneKeepsUsedTokens(t *testing.T) {
+	first, _, err := IssueRefreshToken("pruned")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	if _, _, _, err := RotateRefreshToken(first); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+
+	// a live family keeps its used tokens, or reuse would go unnoticed.
+	refreshStore.pruneRefresh(time.Now())
+	if _, _, _, err := RotateRefreshToken(first); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("reuse after pruning = %v, want ErrRefreshTokenReused", err)
+	}
+
+	refreshStore.pruneRefresh(time.Now().Add(REFRESH_TOKEN_LIFETIME + time.Minute))
+	if _, _, _, err := RotateRefreshToken(first); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("token of an expired family = %v, want ErrInvalidRefreshToken", err)
+	}
+}
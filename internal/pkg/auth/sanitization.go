@@ -1,7 +1,17 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
+	"net/mail"
 	"regexp"
+	"strings"
+)
+
+const (
+	ALIAS_MIN_LENGTH int = 3
+	ALIAS_MAX_LENGTH int = 32
+	EMAIL_MAX_LENGTH int = 254
 )
 
 var WHITELIST *regexp.Regexp = regexp.MustCompile("[^a-zA-Z0-9]+")
@@ -18,7 +28,40 @@ func ensureLength(input string, target int) bool {
 	return len(input) == target
 }
 
-func ensure2FA(input string) bool {
-	return ensureLength(input, AUTH_KEY_SIZE) && sanitizeCheck(input)
+func ensureNumeric(input string) bool {
+	for _, r := range input {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func ensureOTP(input string) bool {
+	return ensureLength(input, TOTP_DIGITS) && ensureNumeric(input)
 }
 
+// ValidateAlias accepts aliases of ALIAS_MIN_LENGTH to ALIAS_MAX_LENGTH
+// characters that pass the same whitelist as every other input.
+func ValidateAlias(alias string) error {
+	if len(alias) < ALIAS_MIN_LENGTH || len(alias) > ALIAS_MAX_LENGTH {
+		return fmt.Errorf("alias must be %d to %d characters", ALIAS_MIN_LENGTH, ALIAS_MAX_LENGTH)
+	}
+	if !sanitizeCheck(alias) {
+		return errors.New("alias may only contain letters and digits")
+	}
+	return nil
+}
+
+// ValidateEmail accepts a bare address, without a display name or
+// surrounding whitespace.
+func ValidateEmail(email string) error {
+	if len(email) <= 0 || len(email) > EMAIL_MAX_LENGTH {
+		return errors.New("email address is missing or too long")
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return errors.New("email address is invalid")
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SESSION_TOUCH_INTERVAL time.Duration = time.Minute
+)
+
+var (
+	ErrSessionRevoked  = errors.New("session has been revoked")
+	ErrSessionNotFound = errors.New("no such session")
+)
+
+// Session describes one login: where it came from and when it was last
+// used. It lives exactly as long as its refresh family, whose ID it shares,
+// so revoking either revokes both.
+type Session struct {
+	ID         string    `json:"id"`
+	Alias      string    `json:"alias"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// VerifiedAt is when the session last completed a second factor, nil
+	// if it never has.
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+var sessionStore = SessionStore{sessions: make(map[string]*Session)}
+
+// StartSession opens a session for alias with a new refresh family and
+// returns it along with the family's first refresh token.
+func StartSession(alias, ip, userAgent string) (*Session, string, error) {
+	refresh, family, err := IssueRefreshToken(alias)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:         family,
+		Alias:      alias,
+		Device:     describeDevice(userAgent),
+		IP:         ip,
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(REFRESH_TOKEN_LIFETIME),
+	}
+
+	sessionStore.mu.Lock()
+	defer sessionStore.mu.Unlock()
+
+	sessionStore.sessions[session.ID] = session
+	copied := *session
+	return &copied, refresh, nil
+}
+
+// StepUpSession records that session id has just completed a second factor.
+func StepUpSession(id string) error {
+	now := time.Now()
+
+	sessionStore.mu.Lock()
+	defer sessionStore.mu.Unlock()
+
+	session, ok := sessionStore.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	session.VerifiedAt = &now
+	return nil
+}
+
+// SessionVerifiedAt returns when session id last completed a second factor,
+// reporting false if it never has or no longer exists.
+func SessionVerifiedAt(id string) (time.Time, bool) {
+	sessionStore.mu.Lock()
+	defer sessionStore.mu.Unlock()
+
+	session, ok := sessionStore.sessions[id]
+	if !ok || session.VerifiedAt == nil {
+		return time.Time{}, false
+	}
+	return *session.VerifiedAt, true
+}
+
+// TouchSession returns ErrSessionRevoked unless session id is still live,
+// and otherwise records it as seen from ip. Last-seen times are only
+// updated every SESSION_TOUCH_INTERVAL.
+func TouchSession(id, ip string) error {
+	now := time.Now()
+	if !refreshStore.familyActive(id, now) {
+		return ErrSessionRevoked
+	}
+
+	sessionStore.mu.Lock()
+	defer sessionStore.mu.Unlock()
+
+	session, ok := sessionStore.sessions[id]
+	if !ok {
+		return ErrSessionRevoked
+	}
+	if now.Sub(session.LastSeenAt) >= SESSION_TOUCH_INTERVAL || session.IP != ip {
+		session.LastSeenAt, session.IP = now, ip
+	}
+	return nil
+}
+
+// ListSessions returns the live sessions of alias, most recently seen first.
+func ListSessions(alias string) []Session {
+	now := time.Now()
+
+	sessionStore.mu.Lock()
+	var candidates []Session
+	for _, session := range sessionStore.sessions {
+		if session.Alias == alias {
+			candidates = append(candidates, *session)
+		}
+	}
+	sessionStore.mu.Unlock()
+
+	sessions := []Session{}
+	for _, session := range candidates {
+		if refreshStore.familyActive(session.ID, now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions
+}
+
+// RevokeSession ends session id of alias, its refresh tokens and the access
+// tokens issued under it.
+func RevokeSession(alias, id string) error {
+	sessionStore.mu.Lock()
+	session, ok := sessionStore.sessions[id]
+	if !ok || session.Alias != alias {
+		sessionStore.mu.Unlock()
+		return ErrSessionNotFound
+	}
+	delete(sessionStore.sessions, id)
+	sessionStore.mu.Unlock()
+
+	RevokeRefreshFamily(id)
+	return nil
+}
+
+// RevokeSessions logs alias out everywhere and returns how many sessions
+// were still live.
+func RevokeSessions(alias string) int {
+	sessionStore.mu.Lock()
+	for id, session := range sessionStore.sessions {
+		if session.Alias == alias {
+			delete(sessionStore.sessions, id)
+		}
+	}
+	sessionStore.mu.Unlock()
+
+	return RevokeRefreshFamilies(alias)
+}
+
+// pruneSessions forgets sessions whose refresh family is gone.
+func (s *SessionStore) pruneSessions(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range s.sessions {
+		if !refreshStore.familyActive(id, now) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// describeDevice gives a rough "browser on platform" label for a user
+// agent, good enough for someone to recognise their own devices.
+func describeDevice(userAgent string) string {
+	browsers := []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"},
+		{"Safari/", "Safari"}, {"curl/", "curl"}, {"Go-http-client", "Go client"},
+	}
+	platforms := []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	}
+
+	browser, platform := "unknown client", ""
+	for _, candidate := range browsers {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+	for _, candidate := range platforms {
+		if strings.Contains(userAgent, candidate.token) {
+			platform = candidate.name
+			break
+		}
+	}
+	if len(platform) <= 0 {
+		return browser
+	}
+	return browser + " on " + platform
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func setLastSeen(id string, at time.Time) {
+	sessionStore.mu.Lock()
+	defer sessionStore.mu.Unlock()
+	sessionStore.sessions[id].LastSeenAt = at
+}
+
+func lastSeen(id string) (time.Time, string) {
+	sessionStore.mu.Lock()
+	defer sessionStore.mu.Unlock()
+	return sessionStore.sessions[id].LastSeenAt, sessionStore.sessions[id].IP
+}
+
+func TestTouchSessionThrottled(t *testing.T) {
+	session, _, err := StartSession("touchy", "192.0.2.1", "curl/8.0")
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	recent := time.Now().Add(-SESSION_TOUCH_INTERVAL / 2)
+	stale := time.Now().Add(-2 * SESSION_TOUCH_INTERVAL)
+	cases := []struct {
+		name    string
+		seen    time.Time
+		ip      string
+		updated bool
+	}{
+		{"within interval", recent, "192.0.2.1", false},
+		{"new address", recent, "192.0.2.2", true},
+		{"past interval", stale, "192.0.2.2", true},
+	}
+	for _, c := range cases {
+		setLastSeen(session.ID, c.seen)
+		if err := TouchSession(session.ID, c.ip); err != nil {
+			t.Fatalf("%v: touch: %v", c.name, err)
+		}
+		seen, ip := lastSeen(session.ID)
+		if updated := !seen.Equal(c.seen); updated != c.updated {
+			t.Errorf("%v: last seen updated = %v, want %v", c.name, updated, c.updated)
+		}
+		if ip != c.ip {
+			t.Errorf("%v: ip = %v, want %v", c.name, ip, c.ip)
+		}
+	}
+
+	RevokeRefreshFamily(session.ID)
+	if err := TouchSession(session.ID, "192.0.2.1"); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("touch after revocation = %v, want ErrSessionRevoked", err)
+	}
+}
+
+func TestRevokeSessionChecksOwner(t *testing.T) {
+	session, _, err := StartSession("owner", "192.0.2.1", "curl/8.0")
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	if err := RevokeSession("intruder", session.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("revoke by another alias = %v, want ErrSessionNotFound", err)
+	}
+	if err := TouchSession(session.ID, "192.0.2.1"); err != nil {
+		t.Errorf("touch after a refused revocation = %v", err)
+	}
+	if err := RevokeSession("owner", session.ID); err != nil {
+		t.Fatalf("revoke by owner: %v", err)
+	}
+	if err := TouchSession(session.ID, "192.0.2.1"); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("touch after revocation = %v, want ErrSessionRevoked", err)
+	}
+	if err := RevokeSession("owner", session.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("revoking twice = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestListSessionsOrder(t *testing.T) {
+	t.Cleanup(func() { RevokeSessions("lister") })
+	now := time.Now()
+	var ids []string
+	for _, seen := range []time.Duration{-time.Hour, -time.Minute, -24 * time.Hour} {
+		session, _, err := StartSession("lister", "192.0.2.1", "curl/8.0")
+		if err != nil {
+			t.Fatalf("start: %v", err)
+		}
+		setLastSeen(session.ID, now.Add(seen))
+		ids = append(ids, session.ID)
+	}
+	revoked, _, err := StartSession("lister", "192.0.2.1", "curl/8.0")
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	RevokeRefreshFamily(revoked.ID)
+	if _, _, err := StartSession("someone else", "192.0.2.1", "curl/8.0"); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	sessions := ListSessions("lister")
+	want := []string{ids[1], ids[0], ids[2]}
+	if len(sessions) != len(want) {
+		t.Fatalf("listed %v sessions, want %v", len(sessions), len(want))
+	}
+	for i, session := range sessions {
+		if session.ID != want[i] {
+			t.Errorf("session %v = %v, want %v", i, session.ID, want[i])
+		}
+	}
+	if sessions := ListSessions("nobody"); sessions == nil || len(sessions) != 0 {
+		t.Errorf("sessions of an unknown alias = %#v, want an empty list", sessions)
+	}
+}
+
+func TestDescribeDevice(t *testing.T) {
+	cases := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36 Edg/120.0": "Edge on Windows",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Safari/604.1":          "Safari on iOS",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0":                                                "Firefox on Linux",
+		"curl/8.0":       "curl",
+		"something else": "unknown client",
+	}
+	for userAgent, want := range cases {
+		if got := describeDevice(userAgent); got != want {
+			t.Errorf("describeDevice(%q) = %q, want %q", userAgent, got, want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	STATE_FILE_MODE os.FileMode = 0o600
+
+	STATE_BUCKET_CHALLENGES string = "challenges"
+	STATE_BUCKET_TOTP       string = "totp"
+	STATE_BUCKET_HOTP       string = "hotp"
+	STATE_BUCKET_RECOVERY   string = "recovery"
+	STATE_BUCKET_ATTEMPTS   string = "attempts"
+)
+
+// errKeepState is returned by an Update function to leave the value as it
+// is; Update then returns nil without writing anything.
+var errKeepState = errors.New("keep state")
+
+// StateStore keeps the 2FA state of every alias: outstanding challenges,
+// TOTP and HOTP enrollments, recovery codes and lockout counters. Values are
+// JSON documents grouped in buckets, one per kind of state, and keyed by
+// alias or address.
+type StateStore interface {
+	// Get returns the value of key in bucket.
+	Get(bucket, key string) ([]byte, bool, error)
+	// Update replaces the value of key in bucket with what fn returns given
+	// the current one, nil when there is none. Returning nil removes the key.
+	// fn runs with the store locked, so a read-modify-write of one key
+	// cannot race another; it must not call back into the store.
+	Update(bucket, key string, fn func(current []byte) ([]byte, error)) error
+	// Sweep removes the values of bucket for which fn returns true and
+	// returns their keys.
+	Sweep(bucket string, fn func(key string, value []byte) bool) ([]string, error)
+}
+
+// loadState decodes the value of key in bucket into v and reports whether
+// there was one.
+func loadState(store StateStore, bucket, key string, v any) (bool, error) {
+	bytes, ok, err := store.Get(bucket, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, json.Unmarshal(bytes, v)
+}
+
+// updateState is Update on decoded values. fn receives nil when key has no
+// value and returns nil to remove it, or errKeepState to leave it alone.
+func updateState[T any](store StateStore, bucket, key string, fn func(current *T) (*T, error)) error {
+	return store.Update(bucket, key, func(bytes []byte) ([]byte, error) {
+		var current *T
+		if bytes != nil {
+			current = new(T)
+			if err := json.Unmarshal(bytes, current); err != nil {
+				return nil, err
+			}
+		}
+		next, err := fn(current)
+		if err != nil || next == nil {
+			return nil, err
+		}
+		return json.Marshal(next)
+	})
+}
+
+// sweepState is Sweep on decoded values. Values that no longer decode are
+// swept as well.
+func sweepState[T any](store StateStore, bucket string, fn func(key string, value *T) bool) ([]string, error) {
+	return store.Sweep(bucket, func(key string, bytes []byte) bool {
+		value := new(T)
+		if err := json.Unmarshal(bytes, value); err != nil {
+			return true
+		}
+		return fn(key, value)
+	})
+}
+
+// MemoryStateStore is a StateStore that lives and dies with the process.
+type MemoryStateStore struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+var _ StateStore = (*MemoryStateStore)(nil)
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (m *MemoryStateStore) Get(bucket, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.buckets[bucket][key]
+	return append([]byte(nil), value...), ok, nil
+}
+
+func (m *MemoryStateStore) Update(bucket, key string, fn func([]byte) ([]byte, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.update(bucket, key, fn)
+	return err
+}
+
+func (m *MemoryStateStore) Sweep(bucket string, fn func(string, []byte) bool) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sweep(bucket, fn), nil
+}
+
+// update and sweep must be called with the store locked. update reports
+// whether anything changed.
+func (m *MemoryStateStore) update(bucket, key string, fn func([]byte) ([]byte, error)) (bool, error) {
+	current, ok := m.buckets[bucket][key]
+	next, err := fn(append([]byte(nil), current...))
+	if errors.Is(err, errKeepState) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if next == nil {
+		if !ok {
+			return false, nil
+		}
+		delete(m.buckets[bucket], key)
+		return true, nil
+	}
+	if m.buckets[bucket] == nil {
+		m.buckets[bucket] = make(map[string][]byte)
+	}
+	m.buckets[bucket][key] = next
+	return true, nil
+}
+
+func (m *MemoryStateStore) sweep(bucket string, fn func(string, []byte) bool) []string {
+	var swept []string
+	for key, value := range m.buckets[bucket] {
+		if fn(key, value) {
+			delete(m.buckets[bucket], key)
+			swept = append(swept, key)
+		}
+	}
+	return swept
+}
+
+// FileStateStore is a StateStore kept in memory and written through to a
+// JSON file after every change, so 2FA enrollments, recovery codes, lockouts
+// and the logins waiting on a challenge survive a restart. The file is
+// replaced by rename, so a crash mid-write leaves the previous contents
+// intact, and a change that could not be written is rolled back so memory
+// never runs ahead of the file. It holds OTP secrets and is only readable by
+// its owner.
+//
+// Refresh tokens, sessions, API keys and one-time tokens are not StateStore
+// state: they stay in the package-level stores that Reap2FA prunes, and are
+// lost on restart whichever StateStore is used.
+type FileStateStore struct {
+	memory MemoryStateStore
+	path   string
+}
+
+var _ StateStore = (*FileStateStore)(nil)
+
+// OpenFileStateStore loads the state in path. A missing file is created on
+// the first change. Expired entries are left for the reaper to remove.
+func OpenFileStateStore(path string) (*FileStateStore, error) {
+	store := &FileStateStore{memory: MemoryStateStore{buckets: make(map[string]map[string][]byte)}, path: path}
+
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(bytes, &buckets); err != nil {
+		return nil, err
+	}
+	for bucket, values := range buckets {
+		store.memory.buckets[bucket] = make(map[string][]byte, len(values))
+		for key, value := range values {
+			store.memory.buckets[bucket][key] = value
+		}
+	}
+	return store, nil
+}
+
+func (f *FileStateStore) Get(bucket, key string) ([]byte, bool, error) {
+	return f.memory.Get(bucket, key)
+}
+
+func (f *FileStateStore) Update(bucket, key string, fn func([]byte) ([]byte, error)) error {
+	f.memory.mu.Lock()
+	defer f.memory.mu.Unlock()
+
+	previous, existed := f.memory.buckets[bucket][key]
+	changed, err := f.memory.update(bucket, key, fn)
+	if err != nil || !changed {
+		return err
+	}
+	if err := f.save(); err != nil {
+		if existed {
+			f.memory.buckets[bucket][key] = previous
+		} else {
+			delete(f.memory.buckets[bucket], key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStateStore) Sweep(bucket string, fn func(string, []byte) bool) ([]string, error) {
+	f.memory.mu.Lock()
+	defer f.memory.mu.Unlock()
+
+	previous := maps.Clone(f.memory.buckets[bucket])
+	swept := f.memory.sweep(bucket, fn)
+	if len(swept) <= 0 {
+		return nil, nil
+	}
+	if err := f.save(); err != nil {
+		f.memory.buckets[bucket] = previous
+		return nil, err
+	}
+	return swept, nil
+}
+
+// save must be called with the store locked.
+func (f *FileStateStore) save() error {
+	buckets := make(map[string]map[string]json.RawMessage, len(f.memory.buckets))
+	for bucket, values := range f.memory.buckets {
+		if len(values) <= 0 {
+			continue
+		}
+		buckets[bucket] = make(map[string]json.RawMessage, len(values))
+		for key, value := range values {
+			buckets[bucket][key] = value
+		}
+	}
+	bytes, err := json.Marshal(buckets)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if err := temp.Chmod(STATE_FILE_MODE); err != nil {
+		temp.Close()
+		return err
+	}
+	if _, err := temp.Write(bytes); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), f.path)
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vivian.infra/utils"
+)
+
+// testLogger discards everything it is given.
+func testLogger(t *testing.T) *utils.VivianLogger {
+	return &utils.VivianLogger{
+		Logger:       log.New(io.Discard, "", 0),
+		LogFile:      filepath.Join(t.TempDir(), "test.log"),
+		DeploymentID: "testtesttest",
+	}
+}
+
+func TestFileStateStoreSurvivesReopen(t *testing.T) {
+	useTestHasher(t)
+	ctx := context.Background()
+	s := testLogger(t)
+	path := filepath.Join(t.TempDir(), "2fa.json")
+
+	store, err := OpenFileStateStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	challenges := NewChallengeAuthenticator(store, time.Minute)
+	key, err := challenges.GenerateAuthKey2FA(ctx, "bella", s)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	pending, err := challenges.BeginPendingLogin(ctx, "bella")
+	if err != nil {
+		t.Fatalf("begin pending login: %v", err)
+	}
+	recovery, err := NewRecoveryAuthenticator(store).Enroll(ctx, "bella", s)
+	if err != nil {
+		t.Fatalf("enroll recovery: %v", err)
+	}
+	attempts := NewAttemptTracker(store)
+	for i := uint(0); i < LOCKOUT_MAX_ALIAS_FAILURES; i++ {
+		attempts.RecordFailure(ctx, "ethan", "192.0.2.1", challenges, s)
+	}
+
+	reopened, err := OpenFileStateStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	challenges = NewChallengeAuthenticator(reopened, time.Minute)
+	if err := challenges.CheckPendingLogin(ctx, "bella", pending); err != nil {
+		t.Errorf("pending login lost across reopen: %v", err)
+	}
+	if ok, err := challenges.VerifyAuthKey2FA(ctx, "bella", key, s); !ok || err != nil {
+		t.Errorf("verify after reopen = %v, %v, want true", ok, err)
+	}
+	if ok, err := NewRecoveryAuthenticator(reopened).VerifyAuthKey2FA(ctx, "bella", recovery.Codes[0], s); !ok || err != nil {
+		t.Errorf("recovery code after reopen = %v, %v, want true", ok, err)
+	}
+	var lockout *LockoutError
+	if err := NewAttemptTracker(reopened).Check("ethan", "198.51.100.1"); !errors.As(err, &lockout) || !lockout.Locked {
+		t.Errorf("lockout lost across reopen: %v", err)
+	}
+}
+
+func TestTOTPReplayRejectedAcrossReopen(t *testing.T) {
+	ctx := context.Background()
+	s := testLogger(t)
+	path := filepath.Join(t.TempDir(), "2fa.json")
+
+	store, err := OpenFileStateStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	enrollment, err := NewTOTPAuthenticator(store, 0).Enroll(ctx, "bella", s)
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	secret, err := otpEncoding.DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	code := otpCode(secret, uint64(totpStep(time.Now())))
+	if err := NewTOTPAuthenticator(store, 1).Confirm2FA(ctx, "bella", code, s); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+
+	reopened, err := OpenFileStateStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if ok, _ := NewTOTPAuthenticator(reopened, 1).VerifyAuthKey2FA(ctx, "bella", code, s); ok {
+		t.Error("replayed code accepted after reopen")
+	}
+}
+
+func TestStateStoreSweep(t *testing.T) {
+	store := NewMemoryStateStore()
+	now := time.Now()
+	challenges := NewChallengeAuthenticator(store, time.Minute)
+	for alias, expiresAt := range map[string]time.Time{"bella": now.Add(-time.Second), "ethan": now.Add(time.Minute)} {
+		expiresAt := expiresAt
+		err := updateState(store, STATE_BUCKET_CHALLENGES, alias, func(*challenge) (*challenge, error) {
+			return &challenge{ID: alias, ExpiresAt: expiresAt}, nil
+		})
+		if err != nil {
+			t.Fatalf("store %v: %v", alias, err)
+		}
+	}
+
+	pruned, err := challenges.Prune(now)
+	if err != nil || len(pruned) != 1 || pruned[0] != "bella" {
+		t.Errorf("prune = %v, %v, want [bella]", pruned, err)
+	}
+	if _, ok, _ := store.Get(STATE_BUCKET_CHALLENGES, "ethan"); !ok {
+		t.Error("live challenge was pruned")
+	}
+}
+
+func TestFileStateStoreRollsBackUnsavedChanges(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "state")
+	if err := os.Mkdir(directory, 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	store, err := OpenFileStateStore(filepath.Join(directory, "2fa.json"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for _, key := range []string{"bella", "ethan"} {
+		if err := store.Update(STATE_BUCKET_ATTEMPTS, key, func([]byte) ([]byte, error) { return []byte(`1`), nil }); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+
+	// with its directory gone the store can no longer be saved.
+	if err := os.RemoveAll(directory); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	cases := map[string]func() error{
+		"change": func() error {
+			return store.Update(STATE_BUCKET_ATTEMPTS, "bella", func([]byte) ([]byte, error) { return []byte(`2`), nil })
+		},
+		"removal": func() error {
+			return store.Update(STATE_BUCKET_ATTEMPTS, "bella", func([]byte) ([]byte, error) { return nil, nil })
+		},
+		"addition": func() error {
+			return store.Update(STATE_BUCKET_ATTEMPTS, "zoe", func([]byte) ([]byte, error) { return []byte(`1`), nil })
+		},
+		"sweep": func() error {
+			_, err := store.Sweep(STATE_BUCKET_ATTEMPTS, func(string, []byte) bool { return true })
+			return err
+		},
+	}
+	for name, change := range cases {
+		if err := change(); err == nil {
+			t.Fatalf("%v: saved without a directory", name)
+		}
+		for key, want := range map[string]string{"bella": "1", "ethan": "1"} {
+			if value, ok, _ := store.Get(STATE_BUCKET_ATTEMPTS, key); !ok || string(value) != want {
+				t.Errorf("%v: %v = %q, %v after a failed save, want %q", name, key, value, ok, want)
+			}
+		}
+		if _, ok, _ := store.Get(STATE_BUCKET_ATTEMPTS, "zoe"); ok {
+			t.Errorf("%v: unsaved key kept", name)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+const (
+	STRENGTH_MAX_INPUT int = 100
+)
+
+// STRENGTH_THRESHOLDS are the log10 guess counts a password must reach for
+// each score past 0, following zxcvbn: under 10^3 guesses is score 0, 10^10
+// or more is score 4.
+var STRENGTH_THRESHOLDS = []float64{3, 6, 8, 10}
+
+// commonPasswords are ranked by how early an attacker would try them.
+var commonPasswords = []string{
+	"password", "123456", "12345678", "qwerty", "123456789", "12345", "1234", "111111", "1234567", "dragon",
+	"123123", "baseball", "abc123", "football", "monkey", "letmein", "696969", "shadow", "master", "666666",
+	"qwertyuiop", "123321", "mustang", "1234567890", "michael", "654321", "superman", "1qaz2wsx", "7777777", "121212",
+	"000000", "qazwsx", "123qwe", "killer", "trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter",
+	"buster", "soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou", "2000", "charlie",
+	"robert", "thomas", "hockey", "ranger", "daniel", "starwars", "klaster", "112233", "george", "computer",
+	"michelle", "jessica", "pepper", "1111", "zxcvbn", "555555", "11111111", "131313", "freedom", "777777",
+	"pass", "maggie", "159753", "aaaaaa", "ginger", "princess", "joshua", "cheese", "amanda", "summer",
+	"love", "ashley", "nicole", "chelsea", "biteme", "matthew", "access", "yankees", "987654321", "dallas",
+	"austin", "thunder", "taylor", "matrix", "welcome", "admin", "login", "passw0rd", "secret", "changeme",
+	"hello", "whatever", "trustme", "qwerty123", "password1", "letmein1", "football1", "monkey1", "welcome1", "admin123",
+	"vivian", "infra", "winter", "spring", "autumn", "january", "october", "december", "purple", "orange",
+	"correct", "horse", "battery", "staple", "apple", "banana", "flower", "secure", "dog", "cat",
+	"god", "sex", "money", "baby", "house", "summer1", "family", "friend", "black", "white",
+}
+
+var passwordRanks = func() map[string]int {
+	ranks := make(map[string]int, len(commonPasswords))
+	for i, word := range commonPasswords {
+		if _, ok := ranks[word]; !ok {
+			ranks[word] = i + 1
+		}
+	}
+	return ranks
+}()
+
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./", "1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik9ol0p"}
+
+var leetSubstitutions = map[rune]rune{'4': 'a', '@': 'a', '3': 'e', '1': 'i', '!': 'i', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't'}
+
+// strengthMatch is a guessable span [start, end) of the password and the
+// number of guesses an attacker trying that pattern needs to hit it.
+type strengthMatch struct {
+	start   int
+	end     int
+	guesses float64
+}
+
+// EstimateGuesses approximates, in the manner of zxcvbn, how many guesses an
+// attacker needs: the password is split into dictionary words, repeats,
+// sequences, keyboard runs, years and brute-forced characters, and the
+// cheapest split wins. userInputs such as the alias and email are treated
+// as the first words an attacker tries.
+func EstimateGuesses(password string, userInputs ...string) float64 {
+	runes := []rune(password)
+	if len(runes) > STRENGTH_MAX_INPUT {
+		runes = runes[:STRENGTH_MAX_INPUT]
+	}
+	if len(runes) <= 0 {
+		return 1
+	}
+
+	ranks := passwordRanks
+	if len(userInputs) > 0 {
+		ranks = make(map[string]int, len(passwordRanks)+len(userInputs))
+		for word, rank := range passwordRanks {
+			ranks[word] = rank
+		}
+		for _, input := range userInputs {
+			if input = strings.ToLower(input); len(input) > 0 {
+				ranks[input] = 1
+			}
+		}
+	}
+
+	var matches []strengthMatch
+	matches = append(matches, dictionaryMatches(runes, ranks)...)
+	matches = append(matches, repeatMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, yearMatches(runes)...)
+
+	//best[k] is the fewest guesses for the first k characters; a
+	//character not covered by any match is brute forced.
+	best := make([]float64, len(runes)+1)
+	best[0] = 1
+	for k := 1; k <= len(runes); k++ {
+		best[k] = best[k-1] * characterCardinality(runes[k-1])
+		for _, match := range matches {
+			if match.end == k {
+				best[k] = math.Min(best[k], best[match.start]*match.guesses)
+			}
+		}
+	}
+	return best[len(runes)]
+}
+
+// EstimateStrength maps EstimateGuesses onto a score from 0 to 4.
+func EstimateStrength(password string, userInputs ...string) int {
+	magnitude := math.Log10(EstimateGuesses(password, userInputs...))
+	score := 0
+	for _, threshold := range STRENGTH_THRESHOLDS {
+		if magnitude >= threshold {
+			score++
+		}
+	}
+	return score
+}
+
+func characterCardinality(r rune) float64 {
+	switch {
+	case unicode.IsDigit(r):
+		return 10
+	case unicode.IsLower(r), unicode.IsUpper(r):
+		return 26
+	default:
+		return 33
+	}
+}
+
+func dictionaryMatches(runes []rune, ranks map[string]int) []strengthMatch {
+	var matches []strengthMatch
+	for i := range runes {
+		for j := i + 3; j <= len(runes); j++ {
+			word := runes[i:j]
+			lower, substituted := unleet(word)
+			rank, ok := ranks[lower]
+			if !ok {
+				continue
+			}
+			guesses := float64(rank) * uppercaseVariations(word)
+			if substituted {
+				guesses *= 2
+			}
+			matches = append(matches, strengthMatch{start: i, end: j, guesses: guesses})
+		}
+	}
+	return matches
+}
+
+func unleet(word []rune) (string, bool) {
+	var builder strings.Builder
+	substituted := false
+	for _, r := range word {
+		if plain, ok := leetSubstitutions[r]; ok {
+			r, substituted = plain, true
+		}
+		builder.WriteRune(unicode.ToLower(r))
+	}
+	return builder.String(), substituted
+}
+
+// uppercaseVariations is the factor an attacker pays for capitalisation: a
+// leading capital or all capitals are tried first.
+func uppercaseVariations(word []rune) float64 {
+	upper := 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 1
+	case upper == len(word), upper == 1 && unicode.IsUpper(word[0]):
+		return 2
+	default:
+		return math.Pow(2, float64(upper))
+	}
+}
+
+func repeatMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for i := 0; i < len(runes); {
+		j := i + 1
+		for j < len(runes) && runes[j] == runes[i] {
+			j++
+		}
+		if j-i >= 3 {
+			matches = append(matches, strengthMatch{start: i, end: j, guesses: characterCardinality(runes[i]) * float64(j-i)})
+		}
+		i = j
+	}
+	return matches
+}
+
+func sequenceMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for i := 0; i+2 < len(runes); {
+		delta := runes[i+1] - runes[i]
+		if delta != 1 && delta != -1 {
+			i++
+			continue
+		}
+		j := i + 2
+		for j < len(runes) && runes[j]-runes[j-1] == delta {
+			j++
+		}
+		if j-i >= 3 {
+			guesses := characterCardinality(runes[i]) * float64(j-i)
+			if runes[i] == 'a' || runes[i] == '1' || runes[i] == '0' {
+				guesses = 4 * float64(j-i)
+			}
+			if delta < 0 {
+				guesses *= 2
+			}
+			matches = append(matches, strengthMatch{start: i, end: j, guesses: guesses})
+		}
+		i = j - 1
+	}
+	return matches
+}
+
+func keyboardMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for i := range runes {
+		for j := i + 4; j <= len(runes); j++ {
+			run := strings.ToLower(string(runes[i:j]))
+			reversed := []rune(run)
+			for a, b := 0, len(reversed)-1; a < b; a, b = a+1, b-1 {
+				reversed[a], reversed[b] = reversed[b], reversed[a]
+			}
+			for _, row := range keyboardRows {
+				if strings.Contains(row, run) || strings.Contains(row, string(reversed)) {
+					matches = append(matches, strengthMatch{start: i, end: j, guesses: 40 * float64(j-i)})
+					break
+				}
+			}
+		}
+	}
+	return matches
+}
+
+func yearMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for i := 0; i+4 <= len(runes); i++ {
+		year := string(runes[i : i+4])
+		if (strings.HasPrefix(year, "19") || strings.HasPrefix(year, "20")) && unicode.IsDigit(runes[i+2]) && unicode.IsDigit(runes[i+3]) {
+			matches = append(matches, strengthMatch{start: i, end: i + 4, guesses: 120})
+		}
+	}
+	return matches
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimateStrength(t *testing.T) {
+	cases := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"password", 0},
+		{"P@ssw0rd", 0},   // leet
+		{"qwertyuiop", 0}, // keyboard row
+		{"abcdefgh", 0},   // sequence
+		{"aaaaaaaa", 0},   // repeat
+		{"zxcvbnm123", 0},
+		{"iloveyou1990", 1}, // words and a year
+		{"bella2024", 3},
+		{"Tr0ub4dor&3", 4},
+		{"kT9#vQ2!mZ", 4},
+		{"correct horse battery staple", 4},
+	}
+	for _, c := range cases {
+		if got := EstimateStrength(c.password); got != c.want {
+			t.Errorf("%q: strength %v, want %v", c.password, got, c.want)
+		}
+	}
+}
+
+func TestEstimateStrengthUserInputs(t *testing.T) {
+	cases := []struct {
+		password string
+		without  int
+	}{
+		{"bella2024", 3},
+		{"bellabella", 4},
+	}
+	for _, c := range cases {
+		if got := EstimateStrength(c.password); got != c.without {
+			t.Errorf("%q: strength %v, want %v", c.password, got, c.without)
+		}
+		if got := EstimateStrength(c.password, "Bella"); got != 0 {
+			t.Errorf("%q with the alias as input: strength %v, want 0", c.password, got)
+		}
+	}
+}
+
+func TestEstimateGuessesBoundsInput(t *testing.T) {
+	long := strings.Repeat("kT9#vQ2!mZ", 1000)
+	if EstimateGuesses(long) != EstimateGuesses(long[:STRENGTH_MAX_INPUT]) {
+		t.Errorf("input past %v characters changed the estimate", STRENGTH_MAX_INPUT)
+	}
+	if EstimateGuesses("") != 1 {
+		t.Error("the empty password takes more than one guess")
+	}
+}
@@ -0,0 +1,312 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	TOKEN_ALG_HS256        string        = "HS256"
+	TOKEN_ALG_EDDSA        string        = "EdDSA"
+	TOKEN_ISSUER           string        = "vivian.infra"
+	TOKEN_DEFAULT_LIFETIME time.Duration = 15 * time.Minute
+	TOKEN_LEEWAY           time.Duration = 30 * time.Second
+	TOKEN_HS256_KEY_SIZE   int           = 32
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token has expired")
+)
+
+var tokenEncoding = base64.RawURLEncoding
+
+// Claims are the registered JWT claims the server relies on, plus any
+// custom claims configured on the issuer or passed at issuance.
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  string
+	ID        string
+	IssuedAt  time.Time
+	NotBefore time.Time
+	ExpiresAt time.Time
+	Custom    map[string]any
+}
+
+var registeredClaims = []string{"iss", "sub", "aud", "jti", "iat", "nbf", "exp"}
+
+func (c Claims) MarshalJSON() ([]byte, error) {
+	claims := make(map[string]any, len(c.Custom)+len(registeredClaims))
+	for key, value := range c.Custom {
+		claims[key] = value
+	}
+	for _, key := range registeredClaims {
+		delete(claims, key)
+	}
+
+	claims["sub"] = c.Subject
+	claims["iat"] = c.IssuedAt.Unix()
+	claims["exp"] = c.ExpiresAt.Unix()
+	if len(c.Issuer) > 0 {
+		claims["iss"] = c.Issuer
+	}
+	if len(c.Audience) > 0 {
+		claims["aud"] = c.Audience
+	}
+	if len(c.ID) > 0 {
+		claims["jti"] = c.ID
+	}
+	if !c.NotBefore.IsZero() {
+		claims["nbf"] = c.NotBefore.Unix()
+	}
+	return json.Marshal(claims)
+}
+
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var claims map[string]any
+	if err := decoder.Decode(&claims); err != nil {
+		return err
+	}
+
+	str := func(key string) string {
+		value, _ := claims[key].(string)
+		return value
+	}
+	unix := func(key string) time.Time {
+		number, ok := claims[key].(json.Number)
+		if !ok {
+			return time.Time{}
+		}
+		seconds, err := number.Int64()
+		if err != nil {
+			return time.Time{}
+		}
+		return time.Unix(seconds, 0)
+	}
+
+	c.Issuer, c.Subject, c.Audience, c.ID = str("iss"), str("sub"), str("aud"), str("jti")
+	c.IssuedAt, c.NotBefore, c.ExpiresAt = unix("iat"), unix("nbf"), unix("exp")
+	for _, key := range registeredClaims {
+		delete(claims, key)
+	}
+	c.Custom = claims
+	return nil
+}
+
+// SigningKey is a single token signing key: a shared secret for HS256 or an
+// Ed25519 key pair for EdDSA.
+type SigningKey struct {
+	Algorithm  string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+func NewHS256Key(secret []byte) (*SigningKey, error) {
+	if len(secret) < TOKEN_HS256_KEY_SIZE {
+		return nil, fmt.Errorf("HS256 secret must be at least %d bytes", TOKEN_HS256_KEY_SIZE)
+	}
+	return &SigningKey{Algorithm: TOKEN_ALG_HS256, secret: secret}, nil
+}
+
+func NewEdDSAKey(privateKey ed25519.PrivateKey) *SigningKey {
+	return &SigningKey{
+		Algorithm:  TOKEN_ALG_EDDSA,
+		privateKey: privateKey,
+		publicKey:  privateKey.Public().(ed25519.PublicKey),
+	}
+}
+
+// GenerateSigningKey creates a random key for algorithm.
+func GenerateSigningKey(algorithm string) (*SigningKey, error) {
+	switch algorithm {
+	case TOKEN_ALG_HS256:
+		secret := make([]byte, TOKEN_HS256_KEY_SIZE)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		return NewHS256Key(secret)
+	case TOKEN_ALG_EDDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewEdDSAKey(privateKey), nil
+	default:
+		return nil, fmt.Errorf("unsupported token algorithm %q", algorithm)
+	}
+}
+
+func (k *SigningKey) sign(input []byte) []byte {
+	if k.Algorithm == TOKEN_ALG_EDDSA {
+		return ed25519.Sign(k.privateKey, input)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func (k *SigningKey) verify(input, signature []byte) bool {
+	if k.Algorithm == TOKEN_ALG_EDDSA {
+		return ed25519.Verify(k.publicKey, input, signature)
+	}
+	return hmac.Equal(k.sign(input), signature)
+}
+
+type TokenConfig struct {
+	Issuer   string
+	Audience string
+	Lifetime time.Duration
+	// Claims are added to every token issued; values passed at issuance
+	// take precedence over them.
+	Claims map[string]any
+}
+
+type TokenIssuer struct {
+	ring   *KeyRing
+	config TokenConfig
+}
+
+func NewTokenIssuer(ring *KeyRing, config TokenConfig) *TokenIssuer {
+	if len(config.Issuer) <= 0 {
+		config.Issuer = TOKEN_ISSUER
+	}
+	if config.Lifetime <= 0 {
+		config.Lifetime = TOKEN_DEFAULT_LIFETIME
+	}
+	return &TokenIssuer{ring: ring, config: config}
+}
+
+func (t *TokenIssuer) Lifetime() time.Duration {
+	return t.config.Lifetime
+}
+
+func (t *TokenIssuer) KeyRing() *KeyRing {
+	return t.ring
+}
+
+// Issue signs an access token for subject carrying the configured claims and
+// any extra ones given.
+func (t *TokenIssuer) Issue(subject string, extra map[string]any) (string, Claims, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", Claims{}, err
+	}
+
+	now := time.Now()
+	claims := Claims{
+		Issuer:    t.config.Issuer,
+		Subject:   subject,
+		Audience:  t.config.Audience,
+		ID:        hex.EncodeToString(id),
+		IssuedAt:  now,
+		NotBefore: now,
+		ExpiresAt: now.Add(t.config.Lifetime),
+		Custom:    make(map[string]any, len(t.config.Claims)+len(extra)),
+	}
+	for key, value := range t.config.Claims {
+		claims.Custom[key] = value
+	}
+	for key, value := range extra {
+		claims.Custom[key] = value
+	}
+
+	token, err := signToken(t.ring.Active(), claims)
+	return token, claims, err
+}
+
+// Validate checks the signature, algorithm, lifetime, issuer and audience of
+// token and returns its claims.
+func (t *TokenIssuer) Validate(token string) (*Claims, error) {
+	claims, err := verifyToken(t.ring, token)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if now.After(claims.ExpiresAt.Add(TOKEN_LEEWAY)) {
+		return nil, ErrTokenExpired
+	}
+	if !claims.NotBefore.IsZero() && now.Add(TOKEN_LEEWAY).Before(claims.NotBefore) {
+		return nil, ErrInvalidToken
+	}
+	if claims.Issuer != t.config.Issuer || claims.Audience != t.config.Audience || len(claims.Subject) <= 0 {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+func signToken(key *RingKey, claims Claims) (string, error) {
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+	header, err := json.Marshal(tokenHeader{Algorithm: key.Key.Algorithm, Type: "JWT", KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := tokenEncoding.EncodeToString(header) + "." + tokenEncoding.EncodeToString(payload)
+	return input + "." + tokenEncoding.EncodeToString(key.Key.sign([]byte(input))), nil
+}
+
+// verifyToken checks the signature of token against the ring key named by
+// its kid header. The algorithm is taken from the key, never from the token,
+// so a token cannot choose a weaker scheme than the one it was issued under.
+func verifyToken(ring *KeyRing, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	headerBytes, err := tokenEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var header tokenHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, ok := ring.Lookup(header.KeyID)
+	if !ok || header.Algorithm != key.Key.Algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := tokenEncoding.DecodeString(parts[2])
+	if err != nil || !key.Key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := tokenEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIssuer signs with a fresh EdDSA key ring.
+func testIssuer(t *testing.T) *TokenIssuer {
+	key, err := GenerateSigningKey(TOKEN_ALG_EDDSA)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return NewTokenIssuer(NewKeyRing(key, 0, 0), TokenConfig{Audience: "vivian.test"})
+}
+
+// forgeToken encodes header and claims and signs them with sign.
+func forgeToken(t *testing.T, header map[string]any, claims Claims, sign func([]byte) []byte) string {
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("marshal header: %v", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	input := tokenEncoding.EncodeToString(headerBytes) + "." + tokenEncoding.EncodeToString(payload)
+	return input + "." + tokenEncoding.EncodeToString(sign([]byte(input)))
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	issuer := testIssuer(t)
+	token, issued, err := issuer.Issue("bella", map[string]any{"sid": "abc"})
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	claims, err := issuer.Validate(token)
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if claims.Subject != "bella" || claims.ID != issued.ID || claims.Custom["sid"] != "abc" {
+		t.Errorf("validated claims %+v, want those issued %+v", claims, issued)
+	}
+}
+
+func TestTokenRejectsAlgorithmConfusion(t *testing.T) {
+	issuer := testIssuer(t)
+	active := issuer.KeyRing().Active()
+	_, claims, err := issuer.Issue("bella", nil)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+
+	// the public key is published in the JWKS, so anyone can compute an
+	// HS256 MAC keyed with it.
+	public := []byte(active.Key.publicKey)
+	hs256 := func(input []byte) []byte {
+		mac := hmac.New(sha256.New, public)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+	cases := map[string]string{
+		"none":             forgeToken(t, map[string]any{"alg": "none", "kid": active.ID}, claims, func([]byte) []byte { return nil }),
+		"HS256 public key": forgeToken(t, map[string]any{"alg": TOKEN_ALG_HS256, "kid": active.ID}, claims, hs256),
+		"no alg":           forgeToken(t, map[string]any{"kid": active.ID}, claims, active.Key.sign),
+	}
+	for name, token := range cases {
+		if _, err := issuer.Validate(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%v: validate = %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
+
+func TestTokenRejectsUnknownKeyID(t *testing.T) {
+	issuer := testIssuer(t)
+	_, claims, err := issuer.Issue("bella", nil)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+
+	// a key of the right algorithm that the ring does not hold
+	stranger, err := GenerateSigningKey(TOKEN_ALG_EDDSA)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	for _, kid := range []string{"", keyID(stranger)} {
+		token := forgeToken(t, map[string]any{"alg": TOKEN_ALG_EDDSA, "kid": kid}, claims, stranger.sign)
+		if _, err := issuer.Validate(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("kid %q: validate = %v, want ErrInvalidToken", kid, err)
+		}
+	}
+}
+
+func TestTokenRejectsTamperingAndExpiry(t *testing.T) {
+	issuer := testIssuer(t)
+	active := issuer.KeyRing().Active()
+	token, claims, err := issuer.Issue("bella", nil)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	claims.Subject = "ethan"
+	forged, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	if _, err := issuer.Validate(parts[0] + "." + tokenEncoding.EncodeToString(forged) + "." + parts[2]); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("tampered subject: validate = %v, want ErrInvalidToken", err)
+	}
+
+	header := map[string]any{"alg": active.Key.Algorithm, "kid": active.ID}
+	expired := claims
+	expired.ExpiresAt = time.Now().Add(-2 * TOKEN_LEEWAY)
+	if _, err := issuer.Validate(forgeToken(t, header, expired, active.Key.sign)); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("expired: validate = %v, want ErrTokenExpired", err)
+	}
+	audience := claims
+	audience.Audience = "elsewhere"
+	if _, err := issuer.Validate(forgeToken(t, header, audience, active.Key.sign)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("wrong audience: validate = %v, want ErrInvalidToken", err)
+	}
+}
@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"vivian.infra/utils"
+)
+
+const (
+	TOTP_ISSUER       string        = "vivian.infra"
+	TOTP_DIGITS       int           = 6
+	TOTP_PERIOD       time.Duration = 30 * time.Second
+	TOTP_SECRET_SIZE  int           = 20
+	TOTP_DEFAULT_SKEW uint          = 1
+)
+
+var otpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var ErrInvalidCode = errors.New("invalid code")
+
+// totpEnrollment is the authenticator-app state of a single alias, kept in
+// the STATE_BUCKET_TOTP bucket. LastStep holds the most recently accepted
+// time step so a code cannot be replayed.
+type totpEnrollment struct {
+	Secret    string    `json:"secret"`
+	LastStep  int64     `json:"last_step"`
+	Confirmed bool      `json:"confirmed"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TOTPAuthenticator implements Confirmer2FA with RFC 6238 time-based codes
+// from an authenticator app. Codes up to skew time steps either side of the
+// current one are accepted.
+type TOTPAuthenticator struct {
+	store StateStore
+	skew  uint
+}
+
+var (
+	_ Confirmer2FA = (*TOTPAuthenticator)(nil)
+	_ Remover2FA   = (*TOTPAuthenticator)(nil)
+)
+
+func NewTOTPAuthenticator(store StateStore, skew uint) *TOTPAuthenticator {
+	return &TOTPAuthenticator{store: store, skew: skew}
+}
+
+func totpStep(now time.Time) int64 {
+	return now.Unix() / int64(TOTP_PERIOD/time.Second)
+}
+
+// Enroll creates a fresh secret for alias and returns it along with its
+// otpauth:// provisioning URI. The enrollment is not accepted for login
+// until Confirm2FA; until then it may be replaced by enrolling again.
+func (t *TOTPAuthenticator) Enroll(_ context.Context, alias string, s *utils.VivianLogger) (Enrollment, error) {
+	secret := make([]byte, TOTP_SECRET_SIZE)
+	if _, err := rand.Read(secret); err != nil {
+		s.LogError("failure generating TOTP secret", err)
+		return Enrollment{}, err
+	}
+	encoded := otpEncoding.EncodeToString(secret)
+
+	err := updateState(t.store, STATE_BUCKET_TOTP, alias, func(current *totpEnrollment) (*totpEnrollment, error) {
+		if current != nil && current.Confirmed {
+			return nil, errors.New("TOTP has already been enrolled")
+		}
+		return &totpEnrollment{Secret: encoded, LastStep: -1, CreatedAt: time.Now()}, nil
+	})
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	s.LogSuccess(fmt.Sprintf("TOTP secret enrolled for %v", alias))
+	return Enrollment{Secret: encoded, URI: provisioningURI("totp", alias, encoded, nil)}, nil
+}
+
+// GenerateAuthKey2FA returns ErrNotGenerated: TOTP codes come from the
+// authenticator app of the owner.
+func (t *TOTPAuthenticator) GenerateAuthKey2FA(context.Context, string, *utils.VivianLogger) (string, error) {
+	return "", ErrNotGenerated
+}
+
+// VerifyAuthKey2FA accepts a code from a confirmed enrollment.
+func (t *TOTPAuthenticator) VerifyAuthKey2FA(_ context.Context, alias, code string, s *utils.VivianLogger) (bool, error) {
+	step, err := t.verify(alias, code, false, s)
+	if err != nil {
+		return false, err
+	}
+
+	s.LogSuccess(fmt.Sprintf("verified TOTP code for %v at step %v", alias, step))
+	return true, nil
+}
+
+// Confirm2FA accepts a code from the unconfirmed enrollment of alias, which
+// confirms it.
+func (t *TOTPAuthenticator) Confirm2FA(_ context.Context, alias, code string, s *utils.VivianLogger) error {
+	if _, err := t.verify(alias, code, true, s); err != nil {
+		return err
+	}
+
+	s.LogSuccess(fmt.Sprintf("audit: TOTP enrollment confirmed for %v", alias))
+	return nil
+}
+
+// verify checks code against the enrollment of alias, which must be
+// unconfirmed when confirm is set and confirmed otherwise, and returns the
+// time step it matched.
+func (t *TOTPAuthenticator) verify(alias, code string, confirm bool, s *utils.VivianLogger) (int64, error) {
+	code = sanitize(code)
+	if !ensureOTP(code) {
+		s.LogWarning("invalid TOTP code")
+		return 0, ErrInvalidCode
+	}
+
+	current := totpStep(time.Now())
+	skew := int64(t.skew)
+	var accepted int64
+	err := updateState(t.store, STATE_BUCKET_TOTP, alias, func(enrollment *totpEnrollment) (*totpEnrollment, error) {
+		if enrollment == nil {
+			s.LogWarning(fmt.Sprintf("TOTP has not been enrolled for %v", alias))
+			return nil, errors.New("TOTP has not been enrolled")
+		}
+		if confirm && enrollment.Confirmed {
+			return nil, errors.New("TOTP has already been confirmed")
+		}
+		if !confirm && !enrollment.Confirmed {
+			s.LogWarning(fmt.Sprintf("TOTP has not been confirmed for %v", alias))
+			return nil, errors.New("TOTP has not been confirmed")
+		}
+		secret, err := otpEncoding.DecodeString(enrollment.Secret)
+		if err != nil {
+			return nil, err
+		}
+
+		for step := current - skew; step <= current+skew; step++ {
+			if step < 0 || !otpEqual(otpCode(secret, uint64(step)), code) {
+				continue
+			}
+			if step <= enrollment.LastStep {
+				s.LogWarning(fmt.Sprintf("replayed TOTP code for %v", alias))
+				return nil, errors.New("code has already been used")
+			}
+			enrollment.LastStep = step
+			enrollment.Confirmed = true
+			accepted = step
+			return enrollment, nil
+		}
+		return nil, ErrInvalidCode
+	})
+	return accepted, err
+}
+
+// ExpireAuthentication2FA marks every time step that would be accepted now
+// as used, so no code currently shown by the app can be verified.
+func (t *TOTPAuthenticator) ExpireAuthentication2FA(_ context.Context, alias string, s *utils.VivianLogger) error {
+	last := totpStep(time.Now()) + int64(t.skew)
+	err := updateState(t.store, STATE_BUCKET_TOTP, alias, func(enrollment *totpEnrollment) (*totpEnrollment, error) {
+		if enrollment == nil {
+			return nil, errors.New("TOTP has not been enrolled")
+		}
+		if enrollment.LastStep < last {
+			enrollment.LastStep = last
+		}
+		return enrollment, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.LogDebug(fmt.Sprintf("expired TOTP codes for %v up to step %v", alias, last))
+	return nil
+}
+
+// Enrolled reports whether alias has a confirmed TOTP enrollment.
+func (t *TOTPAuthenticator) Enrolled(_ context.Context, alias string) (bool, error) {
+	var enrollment totpEnrollment
+	ok, err := loadState(t.store, STATE_BUCKET_TOTP, alias, &enrollment)
+	return ok && enrollment.Confirmed, err
+}
+
+// Remove2FA deletes the enrollment of alias, confirmed or not.
+func (t *TOTPAuthenticator) Remove2FA(_ context.Context, alias string, s *utils.VivianLogger) error {
+	err := updateState(t.store, STATE_BUCKET_TOTP, alias, func(enrollment *totpEnrollment) (*totpEnrollment, error) {
+		if enrollment == nil {
+			return nil, errors.New("TOTP has not been enrolled")
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.LogWarning(fmt.Sprintf("audit: TOTP enrollment removed for %v", alias))
+	return nil
+}
+
+// otpCode computes the RFC 4226 HOTP value of secret at counter, truncated to
+// TOTP_DIGITS decimal digits.
+func otpCode(secret []byte, counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulo)
+}
+
+func otpEqual(expected, actual string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
+
+// provisioningURI builds the otpauth:// URI understood by authenticator apps.
+func provisioningURI(kind, alias, secret string, extra url.Values) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", TOTP_ISSUER)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(TOTP_DIGITS))
+	if kind == "totp" {
+		query.Set("period", strconv.Itoa(int(TOTP_PERIOD/time.Second)))
+	}
+	for key, values := range extra {
+		query[key] = values
+	}
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     kind,
+		Path:     "/" + TOTP_ISSUER + ":" + alias,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
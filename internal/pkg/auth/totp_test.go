@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// rfc6238Codes are the SHA-1 values of RFC 6238 Appendix B by Unix time,
+// cut to the TOTP_DIGITS this server uses from the eight printed there. The
+// secret is the one of RFC 4226.
+var rfc6238Codes = map[int64]string{
+	59:          "287082", // 94287082
+	1111111109:  "081804", // 07081804
+	1111111111:  "050471", // 14050471
+	1234567890:  "005924", // 89005924
+	2000000000:  "279037", // 69279037
+	20000000000: "353130", // 65353130
+}
+
+func TestOTPCodeRFC6238(t *testing.T) {
+	for unix, want := range rfc6238Codes {
+		step := totpStep(time.Unix(unix, 0))
+		if got := otpCode(rfc4226Secret, uint64(step)); got != want {
+			t.Errorf("time %v: otpCode = %v, want %v", unix, got, want)
+		}
+	}
+}
+
+func TestTOTPConfirmBeforeVerify(t *testing.T) {
+	ctx := context.Background()
+	s := testLogger(t)
+	totp := NewTOTPAuthenticator(NewMemoryStateStore(), 1)
+
+	enrollment, err := totp.Enroll(ctx, "bella", s)
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	secret, err := otpEncoding.DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	step := totpStep(time.Now())
+
+	if ok, _ := totp.VerifyAuthKey2FA(ctx, "bella", otpCode(secret, uint64(step)), s); ok {
+		t.Fatal("unconfirmed enrollment accepted for verification")
+	}
+	if err := totp.Confirm2FA(ctx, "bella", otpCode(secret, uint64(step)), s); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	if err := totp.Confirm2FA(ctx, "bella", otpCode(secret, uint64(step+1)), s); err == nil {
+		t.Error("confirmed the same enrollment twice")
+	}
+	if _, err := totp.Enroll(ctx, "bella", s); err == nil {
+		t.Error("replaced a confirmed enrollment")
+	}
+	if ok, err := totp.VerifyAuthKey2FA(ctx, "bella", otpCode(secret, uint64(step+1)), s); !ok || err != nil {
+		t.Errorf("verify after confirm = %v, %v, want true", ok, err)
+	}
+	if ok, _ := totp.VerifyAuthKey2FA(ctx, "bella", otpCode(secret, uint64(step)), s); ok {
+		t.Error("accepted a step older than the last one used")
+	}
+}
+
+func TestTOTPRemove(t *testing.T) {
+	ctx := context.Background()
+	s := testLogger(t)
+	totp := NewTOTPAuthenticator(NewMemoryStateStore(), 1)
+
+	enrollment, err := totp.Enroll(ctx, "bella", s)
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if enrolled, err := totp.Enrolled(ctx, "bella"); enrolled || err != nil {
+		t.Errorf("unconfirmed enrollment reported as enrolled: %v, %v", enrolled, err)
+	}
+	secret, _ := otpEncoding.DecodeString(enrollment.Secret)
+	if err := totp.Confirm2FA(ctx, "bella", otpCode(secret, uint64(totpStep(time.Now()))), s); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	if enrolled, err := totp.Enrolled(ctx, "bella"); !enrolled || err != nil {
+		t.Errorf("confirmed enrollment = %v, %v, want enrolled", enrolled, err)
+	}
+
+	if err := totp.Remove2FA(ctx, "bella", s); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if enrolled, _ := totp.Enrolled(ctx, "bella"); enrolled {
+		t.Error("enrolled after removal")
+	}
+	if err := totp.Remove2FA(ctx, "bella", s); err == nil {
+		t.Error("removed an enrollment twice")
+	}
+	if _, err := totp.Enroll(ctx, "bella", s); err != nil {
+		t.Errorf("enroll after removal: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	NOTIFY_CHANNEL_EMAIL   string = "email"
+	NOTIFY_CHANNEL_WEBHOOK string = "webhook"
+	NOTIFY_CHANNEL_OUTBOX  string = "outbox"
+)
+
+// Message is a single notification. Address is channel specific: an email
+// address for SMTP and unused by the webhook and outbox backends.
+type Message struct {
+	Alias   string
+	Address string
+	Subject string
+	Body    string
+}
+
+type Notifier interface {
+	Notify(context.Context, Message) error
+}
+
+// Route is the delivery channel chosen for one account.
+type Route struct {
+	Channel string
+	Address string
+}
+
+// Registry holds the configured backends and which of them each alias uses.
+// Aliases without a route of their own fall back to the default channel.
+type Registry struct {
+	mu        sync.RWMutex
+	notifiers map[string]Notifier
+	routes    map[string]Route
+	fallback  string
+}
+
+func NewRegistry(fallback string) *Registry {
+	return &Registry{
+		notifiers: make(map[string]Notifier),
+		routes:    make(map[string]Route),
+		fallback:  fallback,
+	}
+}
+
+func (r *Registry) Register(channel string, notifier Notifier) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifiers[channel] = notifier
+}
+
+func (r *Registry) Assign(alias, channel, address string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.notifiers[channel]; !ok {
+		return fmt.Errorf("unknown notification channel %q", channel)
+	}
+	r.routes[alias] = Route{Channel: channel, Address: address}
+	return nil
+}
+
+// Route reports the channel and address that alias is delivered through.
+func (r *Registry) Route(alias string) Route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if route, ok := r.routes[alias]; ok {
+		return route
+	}
+	return Route{Channel: r.fallback}
+}
+
+// Notify delivers msg through the channel assigned to msg.Alias and returns
+// the name of the channel used.
+func (r *Registry) Notify(ctx context.Context, msg Message) (string, error) {
+	route := r.Route(msg.Alias)
+
+	r.mu.RLock()
+	notifier, ok := r.notifiers[route.Channel]
+	r.mu.RUnlock()
+	if !ok {
+		return route.Channel, fmt.Errorf("no notifier registered for channel %q", route.Channel)
+	}
+
+	if len(msg.Address) <= 0 {
+		msg.Address = route.Address
+	}
+	return route.Channel, notifier.Notify(ctx, msg)
+}
+
+// LoadRoutes parses assignments of the form "alias=channel[:address]",
+// separated by semicolons, as found in VIVIAN_NOTIFY_ROUTES.
+func (r *Registry) LoadRoutes(routes string) error {
+	for _, entry := range strings.Split(routes, ";") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) <= 0 {
+			continue
+		}
+
+		alias, target, ok := strings.Cut(entry, "=")
+		if !ok {
+			return errors.New("malformed notification route: " + entry)
+		}
+		channel, address, _ := strings.Cut(target, ":")
+		if err := r.Assign(strings.TrimSpace(alias), strings.TrimSpace(channel), strings.TrimSpace(address)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
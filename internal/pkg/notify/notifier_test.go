@@ -0,0 +1,79 @@
+package notify
+
+import (
+	"context"
+	"testing"
+)
+
+// recorder keeps the messages it is asked to deliver.
+type recorder struct {
+	messages []Message
+}
+
+func (r *recorder) Notify(_ context.Context, msg Message) error {
+	r.messages = append(r.messages, msg)
+	return nil
+}
+
+func TestRegistryFallback(t *testing.T) {
+	outbox, webhook := &recorder{}, &recorder{}
+	registry := NewRegistry(NOTIFY_CHANNEL_OUTBOX)
+	registry.Register(NOTIFY_CHANNEL_OUTBOX, outbox)
+	registry.Register(NOTIFY_CHANNEL_WEBHOOK, webhook)
+	if err := registry.LoadRoutes(" bella = webhook ; ethan=outbox:e@x.io;"); err != nil {
+		t.Fatalf("load routes: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		msg     Message
+		channel string
+		address string
+		sent    *recorder
+	}{
+		{"routed", Message{Alias: "bella"}, NOTIFY_CHANNEL_WEBHOOK, "", webhook},
+		{"route address", Message{Alias: "ethan"}, NOTIFY_CHANNEL_OUTBOX, "e@x.io", outbox},
+		{"explicit address", Message{Alias: "ethan", Address: "other@x.io"}, NOTIFY_CHANNEL_OUTBOX, "other@x.io", outbox},
+		{"unrouted", Message{Alias: "dana", Address: "d@x.io"}, NOTIFY_CHANNEL_OUTBOX, "d@x.io", outbox},
+	}
+	for _, c := range cases {
+		sent := len(c.sent.messages)
+		channel, err := registry.Notify(context.Background(), c.msg)
+		if err != nil || channel != c.channel {
+			t.Errorf("%v: Notify = %v, %v, want %v", c.name, channel, err, c.channel)
+			continue
+		}
+		if len(c.sent.messages) != sent+1 {
+			t.Errorf("%v: not delivered through %v", c.name, c.channel)
+			continue
+		}
+		if got := c.sent.messages[sent].Address; got != c.address {
+			t.Errorf("%v: address = %q, want %q", c.name, got, c.address)
+		}
+	}
+}
+
+func TestRegistryUnregisteredChannel(t *testing.T) {
+	registry := NewRegistry(NOTIFY_CHANNEL_EMAIL)
+	registry.Register(NOTIFY_CHANNEL_OUTBOX, &recorder{})
+
+	if channel, err := registry.Notify(context.Background(), Message{Alias: "dana"}); err == nil || channel != NOTIFY_CHANNEL_EMAIL {
+		t.Errorf("notify through an unregistered fallback = %v, %v, want an error", channel, err)
+	}
+	if err := registry.Assign("bella", NOTIFY_CHANNEL_WEBHOOK, ""); err == nil {
+		t.Error("assigned an unregistered channel")
+	}
+	if route := registry.Route("bella"); route.Channel != NOTIFY_CHANNEL_EMAIL {
+		t.Errorf("route after a refused assignment = %+v, want the fallback", route)
+	}
+}
+
+func TestLoadRoutesRejectsMalformedEntries(t *testing.T) {
+	for _, routes := range []string{"bella", "bella=sms", "bella=outbox;ethan"} {
+		registry := NewRegistry(NOTIFY_CHANNEL_OUTBOX)
+		registry.Register(NOTIFY_CHANNEL_OUTBOX, &recorder{})
+		if err := registry.LoadRoutes(routes); err == nil {
+			t.Errorf("LoadRoutes(%q) accepted", routes)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OutboxNotifier writes each message into a maildir under Directory, for
+// development setups without a mail relay. Messages are written to tmp/ and
+// renamed into new/ so readers never observe a partial file.
+type OutboxNotifier struct {
+	Directory string
+}
+
+func NewOutboxNotifier(directory string) *OutboxNotifier {
+	return &OutboxNotifier{Directory: directory}
+}
+
+func (n *OutboxNotifier) Notify(_ context.Context, msg Message) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(n.Directory, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%d.%s", now.UnixNano(), uuid.NewString())
+	body := fmt.Sprintf("To: %s <%s>\nSubject: %s\nDate: %s\n\n%s\n",
+		msg.Alias, msg.Address, msg.Subject, now.Format(time.RFC1123Z), msg.Body)
+
+	tmp := filepath.Join(n.Directory, "tmp", name)
+	if err := os.WriteFile(tmp, []byte(body), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(n.Directory, "new", name))
+}
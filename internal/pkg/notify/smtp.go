@@ -0,0 +1,52 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPNotifier sends messages as plain text email through a relay. Auth is
+// optional; net/smtp refuses PLAIN auth over unencrypted remote connections.
+type SMTPNotifier struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func NewSMTPNotifier(addr, from, username, password string) *SMTPNotifier {
+	notifier := &SMTPNotifier{Addr: addr, From: from}
+	if len(username) > 0 {
+		host, _, _ := net.SplitHostPort(addr)
+		notifier.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return notifier
+}
+
+func (n *SMTPNotifier) Notify(ctx context.Context, msg Message) error {
+	if len(msg.Address) <= 0 {
+		return errors.New("no email address for " + msg.Alias)
+	}
+	if strings.ContainsAny(msg.Address, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return errors.New("invalid email header")
+	}
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		n.From, msg.Address, msg.Subject, time.Now().Format(time.RFC1123Z), msg.Body)
+
+	errorChan := make(chan error, 1)
+	go func() {
+		errorChan <- smtp.SendMail(n.Addr, n.Auth, n.From, []string{msg.Address}, []byte(body))
+	}()
+
+	select {
+	case err := <-errorChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	WEBHOOK_SIGNATURE_HEADER string        = "X-Vivian-Signature"
+	WEBHOOK_TIMESTAMP_HEADER string        = "X-Vivian-Timestamp"
+	WEBHOOK_TIMEOUT          time.Duration = 5 * time.Second
+)
+
+// WebhookNotifier POSTs messages as JSON to URL. The signature header carries
+// "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<body>" under
+// Secret, so receivers can authenticate the payload and reject stale replays.
+type WebhookNotifier struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+}
+
+func NewWebhookNotifier(url string, secret []byte) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, Secret: secret, Client: &http.Client{Timeout: WEBHOOK_TIMEOUT}}
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, msg Message) error {
+	payload, err := json.Marshal(struct {
+		Alias   string `json:"alias"`
+		Subject string `json:"subject"`
+		Body    string `json:"body"`
+	}{msg.Alias, msg.Subject, msg.Body})
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WEBHOOK_TIMESTAMP_HEADER, timestamp)
+	request.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+SignWebhook(n.Secret, timestamp, payload))
+
+	response, err := n.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %v", response.StatusCode)
+	}
+	return nil
+}
+
+func SignWebhook(secret []byte, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
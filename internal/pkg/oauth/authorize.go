@@ -0,0 +1,170 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	PKCE_METHOD_S256 string = "S256"
+)
+
+// AuthorizationRequest is a validated authorization request. Once one has
+// been returned its redirect URI is known to belong to the client, so errors
+// from then on are reported to the client through it.
+type AuthorizationRequest struct {
+	Client        *Client
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+	// redirectGiven records whether the request named its redirect URI
+	// rather than falling back to the only registered one, in which case
+	// the token request has to repeat it (RFC 6749 section 4.1.3).
+	redirectGiven bool
+}
+
+type authorizationCode struct {
+	clientID      string
+	alias         string
+	redirectURI   string
+	redirectGiven bool
+	scopes        []string
+	codeChallenge string
+	expiresAt     time.Time
+}
+
+// ParseAuthorization validates the query of an authorization request. A nil
+// request alongside the error means the client or redirect URI could not be
+// trusted and the error must be shown to the user instead of redirected.
+func (s *Server) ParseAuthorization(query url.Values) (*AuthorizationRequest, *Error) {
+	client, ok := s.Client(query.Get("client_id"))
+	if !ok {
+		return nil, oauthError("invalid_request", "unknown client_id")
+	}
+
+	redirectURI := query.Get("redirect_uri")
+	if len(redirectURI) <= 0 && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !client.allowsRedirect(redirectURI) {
+		return nil, oauthError("invalid_request", "redirect_uri is not registered for this client")
+	}
+
+	request := &AuthorizationRequest{Client: client, RedirectURI: redirectURI, State: query.Get("state"), redirectGiven: query.Has("redirect_uri")}
+
+	if query.Get("response_type") != "code" {
+		return request, oauthError("unsupported_response_type", "only the code response type is supported")
+	}
+	if query.Get("code_challenge_method") != PKCE_METHOD_S256 {
+		return request, oauthError("invalid_request", "code_challenge_method must be S256")
+	}
+	request.CodeChallenge = query.Get("code_challenge")
+	if len(request.CodeChallenge) != base64.RawURLEncoding.EncodedLen(sha256.Size) {
+		return request, oauthError("invalid_request", "code_challenge is required")
+	}
+
+	request.Scopes = strings.Fields(query.Get("scope"))
+	if len(request.Scopes) <= 0 {
+		return request, oauthError("invalid_scope", "scope is required")
+	}
+	for _, scope := range request.Scopes {
+		if !client.allowsScope(scope) {
+			return request, oauthError("invalid_scope", "scope "+scope+" is not allowed for this client")
+		}
+	}
+	sort.Strings(request.Scopes)
+	return request, nil
+}
+
+func consentKey(alias, clientID string) string {
+	return alias + "\x00" + clientID
+}
+
+// HasConsent reports whether alias has already approved every scope of
+// request for its client.
+func (s *Server) HasConsent(alias string, request *AuthorizationRequest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	granted := s.consents[consentKey(alias, request.Client.ID)]
+	for _, scope := range request.Scopes {
+		if !granted[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) GrantConsent(alias string, request *AuthorizationRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := consentKey(alias, request.Client.ID)
+	if s.consents[key] == nil {
+		s.consents[key] = make(map[string]bool)
+	}
+	for _, scope := range request.Scopes {
+		s.consents[key][scope] = true
+	}
+}
+
+// RevokeConsent withdraws every scope alias granted to clientID.
+func (s *Server) RevokeConsent(alias, clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.consents, consentKey(alias, clientID))
+}
+
+// IssueCode returns a single-use authorization code for alias bound to the
+// client, redirect URI, scopes and PKCE challenge of request.
+func (s *Server) IssueCode(alias string, request *AuthorizationRequest) (string, *Error) {
+	raw := make([]byte, OAUTH_CODE_SIZE)
+	if _, err := rand.Read(raw); err != nil {
+		return "", oauthError("server_error", err.Error())
+	}
+	code := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.codes[sha256.Sum256([]byte(code))] = &authorizationCode{
+		clientID:      request.Client.ID,
+		alias:         alias,
+		redirectURI:   request.RedirectURI,
+		redirectGiven: request.redirectGiven,
+		scopes:        request.Scopes,
+		codeChallenge: request.CodeChallenge,
+		expiresAt:     time.Now().Add(OAUTH_CODE_LIFETIME),
+	}
+	return code, nil
+}
+
+// RedirectURL returns the redirect URI of request with params and the state
+// added to its query.
+func (r *AuthorizationRequest) RedirectURL(params url.Values) string {
+	target, _ := url.Parse(r.RedirectURI)
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if len(r.State) > 0 {
+		query.Set("state", r.State)
+	}
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+// ErrorRedirectURL returns the redirect carrying err back to the client.
+func (r *AuthorizationRequest) ErrorRedirectURL(err *Error) string {
+	params := url.Values{"error": {err.Code}}
+	if len(err.Description) > 0 {
+		params.Set("error_description", err.Description)
+	}
+	return r.RedirectURL(params)
+}
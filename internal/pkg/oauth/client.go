@@ -0,0 +1,138 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"vivian.infra/internal/pkg/auth"
+)
+
+// Client is a registered relying application. Confidential clients also
+// authenticate to the token endpoint with a secret; public clients rely on
+// PKCE alone.
+type Client struct {
+	ID           string    `json:"client_id"`
+	Name         string    `json:"client_name"`
+	Owner        string    `json:"owner"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+	secretHash   string
+}
+
+// RegisterClient validates and stores a new client for owner. The returned
+// secret is only set for confidential clients and is not retained.
+func (s *Server) RegisterClient(ctx context.Context, owner, name string, redirectURIs, scopes []string, confidential bool) (*Client, string, *Error) {
+	if len(strings.TrimSpace(name)) <= 0 {
+		return nil, "", oauthError("invalid_client_metadata", "client_name is required")
+	}
+	if len(redirectURIs) <= 0 {
+		return nil, "", oauthError("invalid_redirect_uri", "at least one redirect_uri is required")
+	}
+	for _, uri := range redirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(scopes) <= 0 {
+		return nil, "", oauthError("invalid_client_metadata", "at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if _, ok := SCOPES[scope]; !ok {
+			return nil, "", oauthError("invalid_client_metadata", "unknown scope "+scope)
+		}
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", oauthError("server_error", err.Error())
+	}
+	client := &Client{
+		ID:           hex.EncodeToString(id),
+		Name:         name,
+		Owner:        owner,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+		Confidential: confidential,
+		CreatedAt:    time.Now(),
+	}
+
+	var secret string
+	if confidential {
+		raw := make([]byte, OAUTH_SECRET_SIZE)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, "", oauthError("server_error", err.Error())
+		}
+		secret = base64.RawURLEncoding.EncodeToString(raw)
+		hash, err := auth.HashSecret(secret)
+		if err != nil {
+			return nil, "", oauthError("server_error", err.Error())
+		}
+		client.secretHash = hash
+	}
+
+	s.mu.Lock()
+	s.clients[client.ID] = client
+	s.mu.Unlock()
+	return client, secret, nil
+}
+
+func (s *Server) Client(id string) (*Client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, ok := s.clients[id]
+	return client, ok
+}
+
+func (c *Client) allowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) allowsScope(scope string) bool {
+	for _, allowed := range c.Scopes {
+		if allowed == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRedirectURI accepts absolute https URIs without fragments, and
+// plain http only towards the loopback interface for native and local
+// clients (RFC 8252 section 7.3).
+func validateRedirectURI(uri string) *Error {
+	parsed, err := url.Parse(uri)
+	if err != nil || !parsed.IsAbs() || len(parsed.Host) <= 0 {
+		return oauthError("invalid_redirect_uri", "redirect_uri must be an absolute URI")
+	}
+	if len(parsed.Fragment) > 0 || strings.Contains(uri, "#") {
+		return oauthError("invalid_redirect_uri", "redirect_uri must not contain a fragment")
+	}
+	if len(parsed.User.String()) > 0 {
+		return oauthError("invalid_redirect_uri", "redirect_uri must not contain credentials")
+	}
+
+	switch parsed.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := parsed.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+			return nil
+		}
+	}
+	return oauthError("invalid_redirect_uri", "redirect_uri must use https or target the loopback interface")
+}
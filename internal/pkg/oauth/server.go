@@ -0,0 +1,83 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"vivian.infra/internal/pkg/auth"
+)
+
+const (
+	OAUTH_CODE_SIZE     int           = 32
+	OAUTH_CODE_LIFETIME time.Duration = time.Minute
+	OAUTH_SECRET_SIZE   int           = 32
+)
+
+// SCOPES lists every scope a client may ask for, with the description shown
+// to the user on the consent prompt.
+var SCOPES = map[string]string{
+	"profile":     "read your alias",
+	"email":       "read your email address",
+	"bucket:read": "list the contents of your bucket",
+}
+
+// Error is an OAuth2 error response (RFC 6749 sections 4.1.2.1 and 5.2).
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Description) <= 0 {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(code, description string) *Error {
+	return &Error{Code: code, Description: description}
+}
+
+// Server is an OAuth2 authorization server for the authorization code grant
+// with PKCE. It holds no HTTP state of its own, so the same methods back the
+// routes and can be driven directly by an in-process client.
+type Server struct {
+	mu       sync.Mutex
+	issuer   *auth.TokenIssuer
+	clients  map[string]*Client
+	codes    map[[sha256.Size]byte]*authorizationCode
+	consents map[string]map[string]bool
+}
+
+func NewServer(issuer *auth.TokenIssuer) *Server {
+	return &Server{
+		issuer:   issuer,
+		clients:  make(map[string]*Client),
+		codes:    make(map[[sha256.Size]byte]*authorizationCode),
+		consents: make(map[string]map[string]bool),
+	}
+}
+
+// RunPruner forgets authorization codes that can no longer be exchanged,
+// every interval until ctx is done.
+func (s *Server) RunPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for hash, code := range s.codes {
+				if now.After(code.expiresAt) {
+					delete(s.codes, hash)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"vivian.infra/internal/pkg/auth"
+)
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+// testFlow serves the authorization and token endpoints of a Server on an
+// httptest server, with every authorization approved for bella, and drives
+// them the way a public client would.
+type testFlow struct {
+	t      *testing.T
+	issuer *auth.TokenIssuer
+	client *Client
+	http   *httptest.Server
+}
+
+func newTestFlow(t *testing.T, redirectURIs ...string) *testFlow {
+	key, err := auth.GenerateSigningKey(auth.TOKEN_ALG_EDDSA)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	issuer := auth.NewTokenIssuer(auth.NewKeyRing(key, 0, 0), auth.TokenConfig{Audience: "vivian.test"})
+	server := NewServer(issuer)
+	client, _, oerr := server.RegisterClient(context.Background(), "ethan", "test client", redirectURIs, []string{"profile", "email"}, false)
+	if oerr != nil {
+		t.Fatalf("register client: %v", oerr)
+	}
+
+	writeJSON := func(w http.ResponseWriter, status int, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		request, oerr := server.ParseAuthorization(r.URL.Query())
+		if request == nil {
+			writeJSON(w, http.StatusBadRequest, oerr)
+			return
+		}
+		if oerr != nil {
+			http.Redirect(w, r, request.ErrorRedirectURL(oerr), http.StatusFound)
+			return
+		}
+		server.GrantConsent("bella", request)
+		code, oerr := server.IssueCode("bella", request)
+		if oerr != nil {
+			http.Redirect(w, r, request.ErrorRedirectURL(oerr), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, request.RedirectURL(url.Values{"code": {code}}), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeJSON(w, http.StatusBadRequest, oauthError("invalid_request", "malformed request"))
+			return
+		}
+		response, oerr := server.Exchange(r.PostForm, r.PostForm.Get("client_id"), "")
+		if oerr != nil {
+			writeJSON(w, http.StatusBadRequest, oerr)
+			return
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+
+	flow := &testFlow{t: t, issuer: issuer, client: client, http: httptest.NewServer(mux)}
+	t.Cleanup(flow.http.Close)
+	return flow
+}
+
+func challengeOf(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorize requests a code with query, which is completed with the client
+// and an S256 challenge of testVerifier, and returns the redirect.
+func (f *testFlow) authorize(query url.Values) *url.URL {
+	f.t.Helper()
+	query.Set("client_id", f.client.ID)
+	query.Set("response_type", "code")
+	if !query.Has("code_challenge_method") {
+		query.Set("code_challenge_method", PKCE_METHOD_S256)
+		query.Set("code_challenge", challengeOf(testVerifier))
+	}
+	if !query.Has("scope") {
+		query.Set("scope", "profile")
+	}
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := noFollow.Get(f.http.URL + "/authorize?" + query.Encode())
+	if err != nil {
+		f.t.Fatalf("authorize: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusFound {
+		f.t.Fatalf("authorize answered %v, want a redirect", response.Status)
+	}
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		f.t.Fatalf("parse redirect: %v", err)
+	}
+	return location
+}
+
+// token exchanges code with form added and returns the decoded response and
+// its error code, if any.
+func (f *testFlow) token(code string, form url.Values) (TokenResponse, string) {
+	f.t.Helper()
+	form.Set("grant_type", "authorization_code")
+	form.Set("client_id", f.client.ID)
+	form.Set("code", code)
+
+	response, err := http.PostForm(f.http.URL+"/token", form)
+	if err != nil {
+		f.t.Fatalf("token: %v", err)
+	}
+	defer response.Body.Close()
+	var body struct {
+		TokenResponse
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		f.t.Fatalf("decode token response: %v", err)
+	}
+	return body.TokenResponse, body.Error
+}
+
+func TestAuthorizationCodeFlowWithPKCE(t *testing.T) {
+	redirect := "https://app.test/callback"
+	flow := newTestFlow(t, redirect)
+
+	location := flow.authorize(url.Values{"redirect_uri": {redirect}, "state": {"xyz"}, "scope": {"email profile"}})
+	if !strings.HasPrefix(location.String(), redirect+"?") || location.Query().Get("state") != "xyz" {
+		t.Fatalf("redirected to %v, want %v with the state", location, redirect)
+	}
+	code := location.Query().Get("code")
+	if len(code) <= 0 {
+		t.Fatalf("redirect %v carries no code", location)
+	}
+
+	response, oerr := flow.token(code, url.Values{"redirect_uri": {redirect}, "code_verifier": {testVerifier}})
+	if len(oerr) > 0 {
+		t.Fatalf("token request failed: %v", oerr)
+	}
+	if response.TokenType != "Bearer" || response.Scope != "email profile" {
+		t.Errorf("token response %+v", response)
+	}
+	claims, err := flow.issuer.Validate(response.AccessToken)
+	if err != nil {
+		t.Fatalf("validate access token: %v", err)
+	}
+	if claims.Subject != "bella" || claims.Custom["client_id"] != flow.client.ID || claims.Custom["scope"] != "email profile" {
+		t.Errorf("access token claims %+v", claims)
+	}
+}
+
+func TestAuthorizationRequiresS256(t *testing.T) {
+	redirect := "https://app.test/callback"
+	flow := newTestFlow(t, redirect)
+
+	location := flow.authorize(url.Values{"code_challenge_method": {"plain"}, "code_challenge": {testVerifier}})
+	if location.Query().Get("error") != "invalid_request" || location.Query().Has("code") {
+		t.Errorf("plain challenge redirected to %v, want invalid_request", location)
+	}
+}
+
+func TestTokenRejectsWrongVerifier(t *testing.T) {
+	redirect := "https://app.test/callback"
+	flow := newTestFlow(t, redirect)
+
+	code := flow.authorize(url.Values{}).Query().Get("code")
+	wrong := strings.Repeat("a", len(testVerifier))
+	if _, oerr := flow.token(code, url.Values{"code_verifier": {wrong}}); oerr != "invalid_grant" {
+		t.Errorf("wrong verifier = %q, want invalid_grant", oerr)
+	}
+	// a failed exchange burns the code, so the verifier cannot be guessed.
+	if _, oerr := flow.token(code, url.Values{"code_verifier": {testVerifier}}); oerr != "invalid_grant" {
+		t.Errorf("right verifier after a wrong one = %q, want invalid_grant", oerr)
+	}
+}
+
+func TestTokenRejectsReusedCode(t *testing.T) {
+	redirect := "https://app.test/callback"
+	flow := newTestFlow(t, redirect)
+
+	code := flow.authorize(url.Values{}).Query().Get("code")
+	if _, oerr := flow.token(code, url.Values{"code_verifier": {testVerifier}}); len(oerr) > 0 {
+		t.Fatalf("first exchange failed: %v", oerr)
+	}
+	if _, oerr := flow.token(code, url.Values{"code_verifier": {testVerifier}}); oerr != "invalid_grant" {
+		t.Errorf("second exchange = %q, want invalid_grant", oerr)
+	}
+}
+
+func TestTokenRedirectURIMatching(t *testing.T) {
+	redirect := "https://app.test/callback"
+	other := "https://app.test/other"
+
+	cases := []struct {
+		name      string
+		authorize url.Values
+		token     url.Values
+		want      string
+	}{
+		{"named and repeated", url.Values{"redirect_uri": {redirect}}, url.Values{"redirect_uri": {redirect}}, ""},
+		{"named and omitted", url.Values{"redirect_uri": {redirect}}, url.Values{}, "invalid_grant"},
+		{"named and changed", url.Values{"redirect_uri": {redirect}}, url.Values{"redirect_uri": {other}}, "invalid_grant"},
+		{"defaulted and omitted", url.Values{}, url.Values{}, ""},
+		{"defaulted and sent", url.Values{}, url.Values{"redirect_uri": {redirect}}, ""},
+		{"defaulted and changed", url.Values{}, url.Values{"redirect_uri": {other}}, "invalid_grant"},
+	}
+	for _, c := range cases {
+		flow := newTestFlow(t, redirect)
+		code := flow.authorize(c.authorize).Query().Get("code")
+		c.token.Set("code_verifier", testVerifier)
+		if _, oerr := flow.token(code, c.token); oerr != c.want {
+			t.Errorf("%v: token error %q, want %q", c.name, oerr, c.want)
+		}
+	}
+}
+
+func TestAuthorizationRejectsUnregisteredRedirect(t *testing.T) {
+	flow := newTestFlow(t, "https://app.test/callback", "https://app.test/other")
+
+	query := url.Values{
+		"client_id":             {flow.client.ID},
+		"response_type":         {"code"},
+		"redirect_uri":          {"https://evil.test/callback"},
+		"code_challenge_method": {PKCE_METHOD_S256},
+		"code_challenge":        {challengeOf(testVerifier)},
+		"scope":                 {"profile"},
+	}
+	for _, redirect := range []string{"https://evil.test/callback", ""} {
+		query.Set("redirect_uri", redirect)
+		if redirect == "" {
+			query.Del("redirect_uri")
+		}
+		response, err := http.Get(flow.http.URL + "/authorize?" + query.Encode())
+		if err != nil {
+			t.Fatalf("authorize: %v", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("redirect_uri %q answered %v, want 400 without redirecting", redirect, response.Status)
+		}
+	}
+}
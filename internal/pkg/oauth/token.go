@@ -0,0 +1,81 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"vivian.infra/internal/pkg/auth"
+)
+
+var codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// Exchange redeems an authorization code from a token request form.
+// clientID and clientSecret are the credentials the client presented, from
+// HTTP basic authentication or the form body.
+func (s *Server) Exchange(form url.Values, clientID, clientSecret string) (*TokenResponse, *Error) {
+	if form.Get("grant_type") != "authorization_code" {
+		return nil, oauthError("unsupported_grant_type", "only authorization_code is supported")
+	}
+
+	client, ok := s.Client(clientID)
+	if !ok {
+		return nil, oauthError("invalid_client", "unknown client")
+	}
+	if client.Confidential && !auth.VerifySecret(client.secretHash, clientSecret) {
+		return nil, oauthError("invalid_client", "client authentication failed")
+	}
+
+	hash := sha256.Sum256([]byte(form.Get("code")))
+	s.mu.Lock()
+	code, ok := s.codes[hash]
+	//codes are single use whether or not the exchange goes on to succeed.
+	delete(s.codes, hash)
+	s.mu.Unlock()
+
+	if !ok || time.Now().After(code.expiresAt) {
+		return nil, oauthError("invalid_grant", "authorization code is invalid or expired")
+	}
+	if code.clientID != client.ID {
+		return nil, oauthError("invalid_grant", "authorization code was issued to another client")
+	}
+	//the redirect URI must be repeated if the authorization request named
+	//one, and must match if it is sent at all.
+	if (code.redirectGiven || form.Has("redirect_uri")) && form.Get("redirect_uri") != code.redirectURI {
+		return nil, oauthError("invalid_grant", "redirect_uri does not match the authorization request")
+	}
+
+	verifier := form.Get("code_verifier")
+	if !codeVerifierPattern.MatchString(verifier) {
+		return nil, oauthError("invalid_grant", "code_verifier is malformed")
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(code.codeChallenge)) != 1 {
+		return nil, oauthError("invalid_grant", "code_verifier does not match the code_challenge")
+	}
+
+	scope := strings.Join(code.scopes, " ")
+	token, claims, err := s.issuer.Issue(code.alias, map[string]any{"client_id": client.ID, "scope": scope})
+	if err != nil {
+		return nil, oauthError("server_error", err.Error())
+	}
+
+	return &TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(claims.ExpiresAt.Sub(claims.IssuedAt).Seconds()),
+		Scope:       scope,
+	}, nil
+}
@@ -0,0 +1,58 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	OIDC_DISCOVERY_PATH string = "/.well-known/openid-configuration"
+)
+
+// Discovery is the subset of the provider metadata (OpenID Connect Discovery
+// 1.0 section 3) the relying party needs.
+type Discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	SigningAlgorithms     []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// Discover fetches the provider metadata for issuer and checks that it
+// describes that same issuer, as a mismatch would let one provider mint
+// tokens in the name of another.
+func Discover(ctx context.Context, client *http.Client, issuer string) (*Discovery, error) {
+	endpoint := strings.TrimSuffix(issuer, "/") + OIDC_DISCOVERY_PATH
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery responded with status %v", response.StatusCode)
+	}
+
+	var discovery Discovery
+	if err := json.NewDecoder(response.Body).Decode(&discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", discovery.Issuer, issuer)
+	}
+	if len(discovery.AuthorizationEndpoint) <= 0 || len(discovery.TokenEndpoint) <= 0 || len(discovery.JWKSURI) <= 0 {
+		return nil, errors.New("discovery document is missing required endpoints")
+	}
+	return &discovery, nil
+}
@@ -0,0 +1,118 @@
+package oidc
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	ID_TOKEN_LEEWAY time.Duration = time.Minute
+)
+
+var ErrInvalidIDToken = errors.New("invalid id token")
+
+// audience accepts both forms of the aud claim, a single string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(value string) bool {
+	for _, entry := range a {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+type IDTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AuthorizedBy  string   `json:"azp"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// validateIDToken checks an ID token as required by OpenID Connect Core 1.0
+// section 3.1.3.7: signature against the provider keys, issuer, audience,
+// authorized party, lifetime and the nonce of the originating request.
+func validateIDToken(ctx context.Context, keys *KeySet, token, issuer, clientID, nonce string) (*IDTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	headerBytes, err := jwkEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := keys.lookup(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	//the key decides the algorithm; "none" or a mismatched alg never verifies.
+	if header.Algorithm != key.algorithm {
+		return nil, ErrInvalidIDToken
+	}
+	signature, err := jwkEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidIDToken
+	}
+
+	payload, err := jwkEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	var claims IDTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != issuer:
+		return nil, errors.New("id token issuer mismatch")
+	case len(claims.Subject) <= 0:
+		return nil, errors.New("id token has no subject")
+	case !claims.Audience.contains(clientID):
+		return nil, errors.New("id token audience mismatch")
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != clientID:
+		return nil, errors.New("id token authorized party mismatch")
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(ID_TOKEN_LEEWAY)):
+		return nil, errors.New("id token has expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(ID_TOKEN_LEEWAY)):
+		return nil, errors.New("id token was issued in the future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("id token nonce mismatch")
+	}
+	return &claims, nil
+}
@@ -0,0 +1,184 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	JWKS_MIN_REFRESH_INTERVAL time.Duration = time.Minute
+)
+
+var jwkEncoding = base64.RawURLEncoding
+
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+}
+
+// verificationKey is a provider key together with the one JWS algorithm it
+// may be used with.
+type verificationKey struct {
+	algorithm string
+	key       crypto.PublicKey
+}
+
+// KeySet caches the provider's JWKS. An unknown kid triggers a refetch, so
+// provider key rotation is picked up, but no more than once per
+// JWKS_MIN_REFRESH_INTERVAL so that forged kids cannot hammer the provider.
+type KeySet struct {
+	mu          sync.Mutex
+	uri         string
+	client      *http.Client
+	keys        map[string]verificationKey
+	lastRefresh time.Time
+}
+
+func NewKeySet(client *http.Client, uri string) *KeySet {
+	return &KeySet{uri: uri, client: client, keys: make(map[string]verificationKey)}
+}
+
+func (k *KeySet) lookup(ctx context.Context, id string) (verificationKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	if time.Since(k.lastRefresh) < JWKS_MIN_REFRESH_INTERVAL {
+		return verificationKey{}, fmt.Errorf("unknown signing key %q", id)
+	}
+	if err := k.refresh(ctx); err != nil {
+		return verificationKey{}, err
+	}
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	return verificationKey{}, fmt.Errorf("unknown signing key %q", id)
+}
+
+// refresh must be called with the set locked.
+func (k *KeySet) refresh(ctx context.Context) error {
+	k.lastRefresh = time.Now()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, k.uri, nil)
+	if err != nil {
+		return err
+	}
+	response, err := k.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks responded with status %v", response.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]verificationKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if len(jwk.Use) > 0 && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.verificationKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	k.keys = keys
+	return nil
+}
+
+func (j jsonWebKey) verificationKey() (verificationKey, error) {
+	switch j.KeyType {
+	case "RSA":
+		n, err := jwkEncoding.DecodeString(j.N)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		e, err := jwkEncoding.DecodeString(j.E)
+		if err != nil || len(e) > 4 {
+			return verificationKey{}, errors.New("invalid RSA exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return verificationKey{}, errors.New("RSA key is too short")
+		}
+		return verificationKey{algorithm: "RS256", key: key}, nil
+	case "EC":
+		if j.Curve != "P-256" {
+			return verificationKey{}, errors.New("unsupported curve " + j.Curve)
+		}
+		x, err := jwkEncoding.DecodeString(j.X)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		y, err := jwkEncoding.DecodeString(j.Y)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return verificationKey{}, errors.New("EC point is not on the curve")
+		}
+		return verificationKey{algorithm: "ES256", key: key}, nil
+	case "OKP":
+		if j.Curve != "Ed25519" {
+			return verificationKey{}, errors.New("unsupported curve " + j.Curve)
+		}
+		x, err := jwkEncoding.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return verificationKey{}, errors.New("invalid Ed25519 key")
+		}
+		return verificationKey{algorithm: "EdDSA", key: ed25519.PublicKey(x)}, nil
+	default:
+		return verificationKey{}, errors.New("unsupported key type " + j.KeyType)
+	}
+}
+
+func (v verificationKey) verify(input, signature []byte) bool {
+	switch key := v.key.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(input)
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, input, signature)
+	default:
+		return false
+	}
+}
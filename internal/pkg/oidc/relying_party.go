@@ -0,0 +1,231 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OIDC_STATE_LIFETIME time.Duration = 10 * time.Minute
+	OIDC_HTTP_TIMEOUT   time.Duration = 10 * time.Second
+)
+
+var ErrInvalidState = errors.New("invalid or expired login state")
+
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	Scopes       []string
+}
+
+// loginAttempt is what the relying party remembers between redirecting to
+// the provider and the callback: the nonce the ID token must echo, the PKCE
+// verifier, and the alias to link to when an existing user started it.
+type loginAttempt struct {
+	nonce     string
+	verifier  string
+	alias     string
+	expiresAt time.Time
+}
+
+// RelyingParty runs the authorization code flow against one external
+// provider. The provider is discovered on first use.
+type RelyingParty struct {
+	config    Config
+	client    *http.Client
+	mu        sync.Mutex
+	discovery *Discovery
+	keys      *KeySet
+	attempts  map[string]*loginAttempt
+}
+
+// NewRelyingParty returns a relying party using client for every request to
+// the provider, or a client with OIDC_HTTP_TIMEOUT if client is nil.
+func NewRelyingParty(config Config, client *http.Client) *RelyingParty {
+	if client == nil {
+		client = &http.Client{Timeout: OIDC_HTTP_TIMEOUT}
+	}
+	if len(config.Scopes) <= 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &RelyingParty{config: config, client: client, attempts: make(map[string]*loginAttempt)}
+}
+
+func (rp *RelyingParty) provider(ctx context.Context) (*Discovery, *KeySet, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if rp.discovery == nil {
+		discovery, err := Discover(ctx, rp.client, rp.config.Issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		rp.discovery, rp.keys = discovery, NewKeySet(rp.client, discovery.JWKSURI)
+	}
+	return rp.discovery, rp.keys, nil
+}
+
+// AuthCodeURL starts a login and returns the provider URL to send the
+// browser to, along with the state that the callback must present. A
+// non-empty alias links the external identity to that account instead of
+// logging in with it.
+func (rp *RelyingParty) AuthCodeURL(ctx context.Context, alias string) (string, string, error) {
+	discovery, _, err := rp.provider(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	rp.mu.Lock()
+	rp.attempts[state] = &loginAttempt{nonce: nonce, verifier: verifier, alias: alias, expiresAt: time.Now().Add(OIDC_STATE_LIFETIME)}
+	rp.mu.Unlock()
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {rp.config.ClientID},
+		"redirect_uri":          {rp.config.RedirectURI},
+		"scope":                 {strings.Join(rp.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), state, nil
+}
+
+// LinkAlias returns the alias that the outstanding attempt identified by
+// state was started to link, or the empty string for a login or a state
+// that is unknown or expired. The attempt is left for Exchange.
+func (rp *RelyingParty) LinkAlias(state string) string {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	attempt, ok := rp.attempts[state]
+	if !ok || time.Now().After(attempt.expiresAt) {
+		return ""
+	}
+	return attempt.alias
+}
+
+// Exchange completes the login identified by state: it redeems code at the
+// token endpoint and validates the returned ID token. The alias passed to
+// AuthCodeURL is returned with the claims.
+func (rp *RelyingParty) Exchange(ctx context.Context, state, code string) (*IDTokenClaims, string, error) {
+	rp.mu.Lock()
+	attempt, ok := rp.attempts[state]
+	delete(rp.attempts, state)
+	rp.mu.Unlock()
+
+	if !ok || time.Now().After(attempt.expiresAt) {
+		return nil, "", ErrInvalidState
+	}
+
+	discovery, keys, err := rp.provider(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {rp.config.RedirectURI},
+		"code_verifier": {attempt.verifier},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(rp.config.ClientID), url.QueryEscape(rp.config.ClientSecret))
+
+	response, err := rp.client.Do(request)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	var tokens struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return nil, "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("token endpoint responded %v: %v %v", response.StatusCode, tokens.Error, tokens.Description)
+	}
+	if len(tokens.IDToken) <= 0 {
+		return nil, "", errors.New("token response has no id_token")
+	}
+
+	claims, err := validateIDToken(ctx, keys, tokens.IDToken, discovery.Issuer, rp.config.ClientID, attempt.nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	return claims, attempt.alias, nil
+}
+
+// RunPruner forgets logins that were started but never completed, every
+// interval until ctx is done.
+func (rp *RelyingParty) RunPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			rp.mu.Lock()
+			for state, attempt := range rp.attempts {
+				if now.After(attempt.expiresAt) {
+					delete(rp.attempts, state)
+				}
+			}
+			rp.mu.Unlock()
+		}
+	}
+}
+
+func (rp *RelyingParty) Issuer() string {
+	return rp.config.Issuer
+}
+
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,347 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientID = "vivian-test"
+
+type testKey struct {
+	id      string
+	private ed25519.PrivateKey
+}
+
+// testProvider is an identity provider serving discovery, its JWKS and a
+// token endpoint that answers every code with the ID token mint returns.
+type testProvider struct {
+	t          *testing.T
+	server     *httptest.Server
+	mu         sync.Mutex
+	keys       []testKey
+	jwksServed int
+	mint       func() string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	provider := &testProvider{t: t}
+	provider.addKey("first")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(OIDC_DISCOVERY_PATH, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Discovery{
+			Issuer:                provider.server.URL,
+			AuthorizationEndpoint: provider.server.URL + "/authorize",
+			TokenEndpoint:         provider.server.URL + "/token",
+			JWKSURI:               provider.server.URL + "/jwks",
+			SigningAlgorithms:     []string{"EdDSA"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		provider.mu.Lock()
+		defer provider.mu.Unlock()
+
+		provider.jwksServed++
+		set := struct {
+			Keys []jsonWebKey `json:"keys"`
+		}{}
+		for _, key := range provider.keys {
+			set.Keys = append(set.Keys, jsonWebKey{
+				KeyType:   "OKP",
+				KeyID:     key.id,
+				Algorithm: "EdDSA",
+				Use:       "sig",
+				Curve:     "Ed25519",
+				X:         jwkEncoding.EncodeToString(key.private.Public().(ed25519.PublicKey)),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || len(r.PostForm.Get("code_verifier")) <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+			return
+		}
+		provider.mu.Lock()
+		mint := provider.mint
+		provider.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id_token": mint()})
+	})
+
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func newTestKey(t *testing.T, id string) testKey {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return testKey{id: id, private: private}
+}
+
+func (p *testProvider) addKey(id string) testKey {
+	key := newTestKey(p.t, id)
+	p.mu.Lock()
+	p.keys = append(p.keys, key)
+	p.mu.Unlock()
+	return key
+}
+
+func (p *testProvider) served() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.jwksServed
+}
+
+// claims returns valid claims for bella issued to testClientID.
+func (p *testProvider) claims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":   p.server.URL,
+		"sub":   "bella-at-idp",
+		"aud":   testClientID,
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"nonce": nonce,
+		"email": "b@x.io",
+	}
+}
+
+// sign encodes header and claims and signs them with signer.
+func sign(t *testing.T, header, claims map[string]any, signer func([]byte) []byte) string {
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("marshal header: %v", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	input := jwkEncoding.EncodeToString(headerBytes) + "." + jwkEncoding.EncodeToString(payload)
+	return input + "." + jwkEncoding.EncodeToString(signer([]byte(input)))
+}
+
+func (k testKey) signed(t *testing.T, claims map[string]any) string {
+	return sign(t, map[string]any{"alg": "EdDSA", "kid": k.id}, claims, func(input []byte) []byte {
+		return ed25519.Sign(k.private, input)
+	})
+}
+
+// login runs a login against the provider, whose token endpoint answers with
+// the token mint makes from the claims of this login's nonce.
+func (p *testProvider) login(rp *RelyingParty, mint func(claims map[string]any) string) (*IDTokenClaims, error) {
+	p.t.Helper()
+	ctx := context.Background()
+	location, state, err := rp.AuthCodeURL(ctx, "")
+	if err != nil {
+		p.t.Fatalf("auth code url: %v", err)
+	}
+	redirect, err := url.Parse(location)
+	if err != nil {
+		p.t.Fatalf("parse auth code url: %v", err)
+	}
+	nonce := redirect.Query().Get("nonce")
+
+	p.mu.Lock()
+	p.mint = func() string { return mint(p.claims(nonce)) }
+	p.mu.Unlock()
+
+	claims, _, err := rp.Exchange(ctx, state, "code")
+	return claims, err
+}
+
+func (p *testProvider) relyingParty() *RelyingParty {
+	return NewRelyingParty(Config{Issuer: p.server.URL, ClientID: testClientID, ClientSecret: "secret", RedirectURI: "https://vivian.test/oidc/callback"}, p.server.Client())
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newTestProvider(t)
+	rp := provider.relyingParty()
+	key := provider.keys[0]
+
+	claims, err := provider.login(rp, func(claims map[string]any) string { return key.signed(t, claims) })
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if claims.Subject != "bella-at-idp" || claims.Issuer != provider.server.URL || claims.Email != "b@x.io" {
+		t.Errorf("claims %+v", claims)
+	}
+}
+
+func TestOIDCRejectsInvalidClaims(t *testing.T) {
+	provider := newTestProvider(t)
+	rp := provider.relyingParty()
+	key := provider.keys[0]
+
+	cases := map[string]func(claims map[string]any){
+		"issuer":         func(claims map[string]any) { claims["iss"] = "https://evil.test" },
+		"audience":       func(claims map[string]any) { claims["aud"] = "another-client" },
+		"azp":            func(claims map[string]any) { claims["aud"] = []string{testClientID, "another-client"} },
+		"expired":        func(claims map[string]any) { claims["exp"] = time.Now().Add(-2 * ID_TOKEN_LEEWAY).Unix() },
+		"issued later":   func(claims map[string]any) { claims["iat"] = time.Now().Add(2 * ID_TOKEN_LEEWAY).Unix() },
+		"nonce":          func(claims map[string]any) { claims["nonce"] = "replayed" },
+		"no nonce":       func(claims map[string]any) { delete(claims, "nonce") },
+		"no subject":     func(claims map[string]any) { delete(claims, "sub") },
+		"string expires": func(claims map[string]any) { claims["exp"] = "never" },
+	}
+	for name, tamper := range cases {
+		_, err := provider.login(rp, func(claims map[string]any) string {
+			tamper(claims)
+			return key.signed(t, claims)
+		})
+		if err == nil {
+			t.Errorf("%v: login succeeded", name)
+		}
+	}
+}
+
+func TestOIDCRejectsAlgorithmConfusion(t *testing.T) {
+	provider := newTestProvider(t)
+	rp := provider.relyingParty()
+	key := provider.keys[0]
+
+	// the public key is in the JWKS, so anyone can key an HMAC with it.
+	public := []byte(key.private.Public().(ed25519.PublicKey))
+	hs256 := func(input []byte) []byte {
+		mac := hmac.New(sha256.New, public)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+	ed := func(input []byte) []byte { return ed25519.Sign(key.private, input) }
+	cases := map[string]func(claims map[string]any) string{
+		"none": func(claims map[string]any) string {
+			return sign(t, map[string]any{"alg": "none", "kid": key.id}, claims, func([]byte) []byte { return nil })
+		},
+		"HS256 public key": func(claims map[string]any) string {
+			return sign(t, map[string]any{"alg": "HS256", "kid": key.id}, claims, hs256)
+		},
+		"RS256 header": func(claims map[string]any) string {
+			return sign(t, map[string]any{"alg": "RS256", "kid": key.id}, claims, ed)
+		},
+		"no signature": func(claims map[string]any) string {
+			token := key.signed(t, claims)
+			return token[:strings.LastIndex(token, ".")+1]
+		},
+	}
+	for name, mint := range cases {
+		if _, err := provider.login(rp, mint); err == nil {
+			t.Errorf("%v: login succeeded", name)
+		}
+	}
+}
+
+func TestOIDCRefetchesKeysForUnknownKeyID(t *testing.T) {
+	provider := newTestProvider(t)
+	rp := provider.relyingParty()
+	first := provider.keys[0]
+
+	if _, err := provider.login(rp, func(claims map[string]any) string { return first.signed(t, claims) }); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	fetched := provider.served()
+
+	// a kid the provider never published does not get to refetch right
+	// after the last fetch.
+	stranger := newTestKey(t, "stranger")
+	if _, err := provider.login(rp, func(claims map[string]any) string { return stranger.signed(t, claims) }); err == nil {
+		t.Error("login with an unpublished key succeeded")
+	}
+	if provider.served() != fetched {
+		t.Errorf("unknown kid refetched the JWKS within %v", JWKS_MIN_REFRESH_INTERVAL)
+	}
+
+	// once the interval has passed, a rotated key is picked up.
+	rotated := provider.addKey("second")
+	rp.keys.mu.Lock()
+	rp.keys.lastRefresh = time.Now().Add(-JWKS_MIN_REFRESH_INTERVAL)
+	rp.keys.mu.Unlock()
+	if _, err := provider.login(rp, func(claims map[string]any) string { return rotated.signed(t, claims) }); err != nil {
+		t.Errorf("login with a rotated key: %v", err)
+	}
+	if provider.served() != fetched+1 {
+		t.Errorf("JWKS fetched %v times after rotation, want %v", provider.served(), fetched+1)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	provider := newTestProvider(t)
+	rp := NewRelyingParty(Config{Issuer: provider.server.URL + "/", ClientID: testClientID, RedirectURI: "https://vivian.test/oidc/callback"}, provider.server.Client())
+	if _, _, err := rp.AuthCodeURL(context.Background(), ""); err == nil {
+		t.Error("discovery accepted a document for another issuer")
+	}
+}
+
+func TestOIDCStateIsSingleUse(t *testing.T) {
+	provider := newTestProvider(t)
+	rp := provider.relyingParty()
+	key := provider.keys[0]
+	ctx := context.Background()
+
+	location, state, err := rp.AuthCodeURL(ctx, "")
+	if err != nil {
+		t.Fatalf("auth code url: %v", err)
+	}
+	redirect, _ := url.Parse(location)
+	nonce := redirect.Query().Get("nonce")
+	provider.mu.Lock()
+	provider.mint = func() string { return key.signed(t, provider.claims(nonce)) }
+	provider.mu.Unlock()
+
+	if _, _, err := rp.Exchange(ctx, state, "code"); err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if _, _, err := rp.Exchange(ctx, state, "code"); err != ErrInvalidState {
+		t.Errorf("second exchange = %v, want ErrInvalidState", err)
+	}
+}
+
+func TestOIDCLinkAliasBoundToState(t *testing.T) {
+	provider := newTestProvider(t)
+	rp := provider.relyingParty()
+	key := provider.keys[0]
+	ctx := context.Background()
+
+	_, login, err := rp.AuthCodeURL(ctx, "")
+	if err != nil {
+		t.Fatalf("auth code url: %v", err)
+	}
+	location, link, err := rp.AuthCodeURL(ctx, "bella")
+	if err != nil {
+		t.Fatalf("auth code url: %v", err)
+	}
+	if alias := rp.LinkAlias(login); alias != "" {
+		t.Errorf("login state links to %q", alias)
+	}
+	if alias := rp.LinkAlias("unknown"); alias != "" {
+		t.Errorf("unknown state links to %q", alias)
+	}
+	if alias := rp.LinkAlias(link); alias != "bella" {
+		t.Fatalf("link state links to %q, want bella", alias)
+	}
+
+	redirect, _ := url.Parse(location)
+	nonce := redirect.Query().Get("nonce")
+	provider.mu.Lock()
+	provider.mint = func() string { return key.signed(t, provider.claims(nonce)) }
+	provider.mu.Unlock()
+	if _, alias, err := rp.Exchange(ctx, link, "code"); err != nil || alias != "bella" {
+		t.Fatalf("exchange = %q, %v, want bella", alias, err)
+	}
+	if alias := rp.LinkAlias(link); alias != "" {
+		t.Errorf("exchanged state still links to %q", alias)
+	}
+}
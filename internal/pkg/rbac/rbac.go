@@ -0,0 +1,93 @@
+package rbac
+
+import "net/http"
+
+type Role string
+
+type Permission string
+
+const (
+	ROLE_USER  Role = "user"
+	ROLE_ADMIN Role = "admin"
+
+	PERMISSION_KEYS_MANAGE     Permission = "keys:manage"
+	PERMISSION_2FA_MANAGE      Permission = "2fa:manage"
+	PERMISSION_SESSIONS_MANAGE Permission = "sessions:manage"
+	PERMISSION_CLIENTS_MANAGE  Permission = "clients:manage"
+	PERMISSION_OAUTH_AUTHORIZE Permission = "oauth:authorize"
+	PERMISSION_IDENTITY_LINK   Permission = "identity:link"
+	PERMISSION_BUCKET_READ     Permission = "bucket:read"
+	PERMISSION_BUCKET_LIST     Permission = "bucket:list"
+	PERMISSION_METRICS_READ    Permission = "metrics:read"
+)
+
+// ROLE_PERMISSIONS grants each role its permissions. Accounts without any
+// role are treated as ROLE_USER.
+var ROLE_PERMISSIONS = map[Role][]Permission{
+	ROLE_USER: {
+		PERMISSION_KEYS_MANAGE,
+		PERMISSION_2FA_MANAGE,
+		PERMISSION_SESSIONS_MANAGE,
+		PERMISSION_CLIENTS_MANAGE,
+		PERMISSION_OAUTH_AUTHORIZE,
+		PERMISSION_IDENTITY_LINK,
+		PERMISSION_BUCKET_READ,
+	},
+	ROLE_ADMIN: {
+		PERMISSION_KEYS_MANAGE,
+		PERMISSION_2FA_MANAGE,
+		PERMISSION_SESSIONS_MANAGE,
+		PERMISSION_CLIENTS_MANAGE,
+		PERMISSION_OAUTH_AUTHORIZE,
+		PERMISSION_IDENTITY_LINK,
+		PERMISSION_BUCKET_READ,
+		PERMISSION_BUCKET_LIST,
+		PERMISSION_METRICS_READ,
+	},
+}
+
+// POLICY maps a route, by method and mux path template, to the permission it
+// requires. A route that is authorized but has no entry here is refused, so
+// forgetting an entry fails closed.
+var POLICY = map[string]Permission{
+	policyKey(http.MethodPost, "/{alias}/keys"):            PERMISSION_KEYS_MANAGE,
+	policyKey(http.MethodGet, "/{alias}/keys"):             PERMISSION_KEYS_MANAGE,
+	policyKey(http.MethodDelete, "/{alias}/keys/{id}"):     PERMISSION_KEYS_MANAGE,
+	policyKey(http.MethodGet, "/{alias}/2FA"):              PERMISSION_2FA_MANAGE,
+	policyKey(http.MethodGet, "/{alias}/sessions"):         PERMISSION_SESSIONS_MANAGE,
+	policyKey(http.MethodDelete, "/{alias}/sessions"):      PERMISSION_SESSIONS_MANAGE,
+	policyKey(http.MethodDelete, "/{alias}/sessions/{id}"): PERMISSION_SESSIONS_MANAGE,
+	policyKey(http.MethodPost, "/{alias}/step-up"):         PERMISSION_SESSIONS_MANAGE,
+	policyKey(http.MethodPost, "/clients"):                 PERMISSION_CLIENTS_MANAGE,
+	policyKey(http.MethodGet, "/authorize"):                PERMISSION_OAUTH_AUTHORIZE,
+	policyKey(http.MethodPost, "/authorize"):               PERMISSION_OAUTH_AUTHORIZE,
+	policyKey(http.MethodGet, "/oidc/link"):                PERMISSION_IDENTITY_LINK,
+	policyKey(http.MethodGet, "/{alias}/bucket/fetch"):     PERMISSION_BUCKET_READ,
+	policyKey(http.MethodGet, "/socketcalls"):              PERMISSION_METRICS_READ,
+}
+
+func policyKey(method, template string) string {
+	return method + " " + template
+}
+
+// Required returns the permission POLICY demands for method on template.
+func Required(method, template string) (Permission, bool) {
+	permission, ok := POLICY[policyKey(method, template)]
+	return permission, ok
+}
+
+// Allowed reports whether any of roles grants permission. Unknown roles
+// grant nothing.
+func Allowed(roles []string, permission Permission) bool {
+	if len(roles) <= 0 {
+		roles = []string{string(ROLE_USER)}
+	}
+	for _, role := range roles {
+		for _, granted := range ROLE_PERMISSIONS[Role(role)] {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package rbac
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBucketFetchAllowedForUsers(t *testing.T) {
+	permission, ok := Required(http.MethodGet, "/{alias}/bucket/fetch")
+	if !ok {
+		t.Fatal("no policy for bucket fetch")
+	}
+	for _, roles := range [][]string{nil, {string(ROLE_USER)}, {string(ROLE_ADMIN)}} {
+		if !Allowed(roles, permission) {
+			t.Errorf("roles %v may not fetch their bucket", roles)
+		}
+	}
+	if Allowed([]string{string(ROLE_USER)}, PERMISSION_BUCKET_LIST) {
+		t.Error("users may list the buckets of others")
+	}
+}
+
+func TestUnknownRoleGrantsNothing(t *testing.T) {
+	for _, permission := range POLICY {
+		if Allowed([]string{"root"}, permission) {
+			t.Errorf("unknown role granted %v", permission)
+		}
+	}
+}
@@ -1,9 +1,39 @@
 package models
 
+import (
+	"strings"
+	"time"
+)
+
+const (
+	ACCOUNT_STATUS_ACTIVE  string = "active"
+	ACCOUNT_STATUS_PENDING string = "pending"
+)
+
 type Account struct {
-	ID       int
-	Alias    string
-	Email    string
-	Password string
+	ID               int
+	Alias            string
+	Email            string
+	Password         string
+	TwoFactorEnabled bool
+	Roles            []string
+	// Status is ACCOUNT_STATUS_PENDING until the email address is verified.
+	// Accounts loaded without a status predate registration and are active.
+	Status string
+	// CreatedAt is set when the account registers; pending accounts are
+	// removed once their verification link can no longer be redeemed.
+	CreatedAt time.Time
+	// PasswordChangedAt is set by a password reset; access tokens issued
+	// before it are no longer accepted.
+	PasswordChangedAt time.Time
 }
 
+func (a Account) Active() bool {
+	return a.Status != ACCOUNT_STATUS_PENDING
+}
+
+// NormalizeAlias returns the form alias is stored and looked up under, so
+// that aliases differing only in case name the same account.
+func NormalizeAlias(alias string) string {
+	return strings.ToLower(alias)
+}
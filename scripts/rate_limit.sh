@@ -3,5 +3,5 @@
 #while true
 #do
 #	url="http://127.0.0.1:8080/bella/2FA?action=generate"
-#	curl "$url"
+#	curl -H "Authorization: Bearer $VIVIAN_API_KEY" "$url"
 #done